@@ -0,0 +1,141 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adbwifi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// ADB transport constants from adb's adb.h.
+const (
+	cmdCNXN = 0x4e584e43
+	cmdSTLS = 0x534c5453
+	cmdAUTH = 0x48545541
+
+	adbVersion     = 0x01000001
+	adbSTLSVersion = 0x01000000
+	adbMaxPayload  = 1024 * 1024
+	adbHeaderSize  = 24
+
+	hostBanner = "host::features=shell_v2,cmd,stat_v2,ls_v2,fixed_push_mkdir,apex,abb,fixed_push_symlink_timestamp,abb_exec,remount_shell,track_app,sendrecv_v2,sendrecv_v2_brotli,sendrecv_v2_lz4,sendrecv_v2_zstd,sendrecv_v2_dry_run_send,openscreen_mdns"
+)
+
+// DeviceInfo is what a device reports about itself in its connection banner.
+type DeviceInfo struct {
+	Banner   string
+	Props    map[string]string
+	Features []string
+}
+
+// Connect opens a wireless debugging connection to the device at addr with
+// key, completing the STLS upgrade and TLS 1.3 handshake, and returns the
+// device's banner. It succeeds only if the device trusts key, which makes it
+// a check that pairing worked independently of the adb binary.
+func Connect(ctx context.Context, addr string, key *Key) (*DeviceInfo, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := writeADBMessage(conn, cmdCNXN, adbVersion, adbMaxPayload, []byte(hostBanner)); err != nil {
+		return nil, err
+	}
+	cmd, _, _, err := readADBMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch cmd {
+	case cmdSTLS:
+	case cmdAUTH:
+		return nil, fmt.Errorf("device requested legacy ADB authentication instead of TLS")
+	default:
+		return nil, fmt.Errorf("unexpected ADB message %#x", cmd)
+	}
+	if err := writeADBMessage(conn, cmdSTLS, adbSTLSVersion, 0, nil); err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, key.tlsConfig())
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	if tc.ConnectionState().Version != tls.VersionTLS13 {
+		return nil, errNotTLS13
+	}
+
+	cmd, _, data, err := readADBMessage(tc)
+	if err != nil {
+		return nil, fmt.Errorf("device rejected the connection (is this key paired?): %w", err)
+	}
+	if cmd != cmdCNXN {
+		return nil, fmt.Errorf("unexpected ADB message %#x after TLS handshake", cmd)
+	}
+	return parseBanner(string(data)), nil
+}
+
+func writeADBMessage(w io.Writer, cmd, arg0, arg1 uint32, data []byte) error {
+	hdr := make([]byte, adbHeaderSize, adbHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(hdr[0:], cmd)
+	binary.LittleEndian.PutUint32(hdr[4:], arg0)
+	binary.LittleEndian.PutUint32(hdr[8:], arg1)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(data)))
+	// The data checksum is not checked from version 0x01000001 onwards.
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	binary.LittleEndian.PutUint32(hdr[20:], cmd^0xffffffff)
+	_, err := w.Write(append(hdr, data...))
+	return err
+}
+
+func readADBMessage(r io.Reader) (cmd, arg0 uint32, data []byte, err error) {
+	var hdr [adbHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	cmd = binary.LittleEndian.Uint32(hdr[0:])
+	arg0 = binary.LittleEndian.Uint32(hdr[4:])
+	n := binary.LittleEndian.Uint32(hdr[12:])
+	if binary.LittleEndian.Uint32(hdr[20:]) != cmd^0xffffffff {
+		return 0, 0, nil, fmt.Errorf("invalid ADB message magic")
+	}
+	if n > adbMaxPayload {
+		return 0, 0, nil, fmt.Errorf("ADB message too large: %d bytes", n)
+	}
+	data = make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, 0, nil, err
+	}
+	return cmd, arg0, data, nil
+}
+
+// parseBanner parses a banner such as
+// "device::ro.product.name=x;ro.product.model=y;features=a,b".
+func parseBanner(banner string) *DeviceInfo {
+	info := &DeviceInfo{
+		Banner: strings.TrimRight(banner, "\x00"),
+		Props:  make(map[string]string),
+	}
+	_, props, _ := strings.Cut(info.Banner, "::")
+	for kv := range strings.SplitSeq(props, ";") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if k == "features" {
+			info.Features = strings.Split(v, ",")
+			continue
+		}
+		info.Props[k] = v
+	}
+	return info
+}
@@ -0,0 +1,213 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adbwifi
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keyBits = 2048
+
+	// androidPubKeyModulusSize is ANDROID_PUBKEY_MODULUS_SIZE from
+	// libcrypto_utils' android_pubkey.h.
+	androidPubKeyModulusSize = keyBits / 8
+)
+
+// Key is an ADB identity: an RSA key pair stored the way adb stores
+// ~/.android/adbkey, plus the self-signed certificate presented over TLS.
+type Key struct {
+	priv *rsa.PrivateKey
+	cert tls.Certificate
+	name string
+}
+
+// GenerateKey creates a fresh ADB identity. name is appended to the public
+// key (adb uses user@host) and is shown on the device's list of paired
+// computers.
+func GenerateKey(name string) (*Key, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(priv, name)
+}
+
+// LoadKey reads an ADB private key from path, as written by Save or by adb
+// itself. The name is taken from the matching .pub file if there is one.
+func LoadKey(path string) (*Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var priv *rsa.PrivateKey
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var ok bool
+		if priv, ok = k.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("%s: not an RSA key", path)
+		}
+	case "RSA PRIVATE KEY":
+		if priv, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+
+	var name string
+	if pub, err := os.ReadFile(path + ".pub"); err == nil {
+		if _, n, ok := strings.Cut(strings.TrimSpace(string(pub)), " "); ok {
+			name = n
+		}
+	}
+	return newKey(priv, name)
+}
+
+func newKey(priv *rsa.PrivateKey, name string) (*Key, error) {
+	if priv.N.BitLen() != keyBits {
+		return nil, fmt.Errorf("ADB keys must be %d-bit RSA keys", keyBits)
+	}
+	cert, err := selfSignedCert(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{priv: priv, cert: cert, name: name}, nil
+}
+
+// Save writes the private key to path and the public key to path.pub, in
+// the same format adb uses, so that the key can also be handed to the adb
+// binary (for example via ADB_VENDOR_KEYS).
+func (k *Key) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(k.priv)
+	if err != nil {
+		return err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, pemBytes, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".pub", []byte(k.PublicKey()+"\n"), 0o644)
+}
+
+// PublicKey returns the public key in adb's text format: the base64 encoded
+// Android RSA public key structure followed by the key name.
+func (k *Key) PublicKey() string {
+	s := base64.StdEncoding.EncodeToString(k.androidPubKey())
+	if k.name != "" {
+		s += " " + k.name
+	}
+	return s
+}
+
+// Fingerprint returns the MD5 fingerprint of the public key as shown by
+// Android in the "Allow USB debugging?" dialog.
+func (k *Key) Fingerprint() string {
+	sum := md5.Sum(k.androidPubKey())
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// Name returns the name the key is advertised under.
+func (k *Key) Name() string {
+	return k.name
+}
+
+// androidPubKey encodes the public key as the RSAPublicKey structure from
+// libcrypto_utils' android_pubkey.c. All integers are little-endian.
+func (k *Key) androidPubKey() []byte {
+	n := k.priv.N
+	r32 := new(big.Int).Lsh(big.NewInt(1), 32)
+	n0inv := new(big.Int).ModInverse(new(big.Int).Mod(n, r32), r32)
+	n0inv.Sub(r32, n0inv)
+	rr := new(big.Int).Lsh(big.NewInt(1), 2*keyBits)
+	rr.Mod(rr, n)
+
+	out := make([]byte, 0, 4+4+2*androidPubKeyModulusSize+4)
+	out = binary.LittleEndian.AppendUint32(out, androidPubKeyModulusSize/4)
+	out = binary.LittleEndian.AppendUint32(out, uint32(n0inv.Uint64()))
+	out = append(out, littleEndian(n, androidPubKeyModulusSize)...)
+	out = append(out, littleEndian(rr, androidPubKeyModulusSize)...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(k.priv.E))
+	return out
+}
+
+func littleEndian(v *big.Int, size int) []byte {
+	b := make([]byte, size)
+	v.FillBytes(b)
+	return reversed(b)
+}
+
+// selfSignedCert builds the same kind of certificate adb's
+// GenerateX509Certificate does for its TLS connections.
+func selfSignedCert(priv *rsa.PrivateKey) (tls.Certificate, error) {
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ski := sha1.Sum(pubDER)
+	name := pkix.Name{Country: []string{"US"}, Organization: []string{"Android"}, CommonName: "Adb"}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               name,
+		Issuer:                name,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          ski[:],
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// tlsConfig returns the TLS configuration adb uses for pairing and wireless
+// connections: TLS 1.3 only, always presenting our certificate, and not
+// verifying the device's self-signed certificate (trust is established by
+// the pairing code, not by a PKI).
+func (k *Key) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: true,
+		// adbd lists the keys it trusts as acceptable CAs, which a
+		// self-signed certificate never matches, so the certificate
+		// must be offered regardless of the request.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &k.cert, nil
+		},
+	}
+}
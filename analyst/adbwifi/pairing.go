@@ -0,0 +1,253 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Package adbwifi implements the client side of Android's wireless debugging
+// protocols (pairing and TLS connection setup) without the adb binary, so
+// that each case can use its own ADB identity.
+package adbwifi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Constants from adb's pairing_connection and pairing_auth libraries.
+const (
+	pairingHeaderVersion = 1
+	pairingHeaderSize    = 6
+
+	pairingMsgSPAKE2   = 0
+	pairingMsgPeerInfo = 1
+
+	maxPeerInfoSize   = 8192
+	maxPairingPayload = 2 * maxPeerInfoSize
+
+	peerInfoRSAPubKey  = 0
+	peerInfoDeviceGUID = 1
+
+	exportedKeyLabel = "adb-label\x00"
+	exportedKeySize  = 64
+
+	pairingCipherInfo = "adb pairing_auth aes-128-gcm key"
+)
+
+var (
+	clientName = []byte("adb pair client\x00")
+	serverName = []byte("adb pair server\x00")
+)
+
+// pairingTranscriptEnv names an environment variable that, when set to a
+// directory, makes Pair save a transcript of every successful pairing there
+// for TestPairingTranscripts. A transcript holds the pairing code and the
+// TLS keying material, so only set it when pairing test devices.
+const pairingTranscriptEnv = "MESH_ADB_PAIRING_TRANSCRIPT_DIR"
+
+// pairingTranscript records our SPAKE2 inputs and the device's messages, all
+// hex encoded, so that a pairing with a real adbd can be replayed offline.
+type pairingTranscript struct {
+	Password   string `json:"password"` // pairing code followed by the EKM
+	AliceRand  string `json:"alice_random"`
+	AliceMsg   string `json:"alice_msg"`
+	BobMsg     string `json:"bob_msg"`
+	PeerInfo   string `json:"peer_info"` // sealed by the device
+	DeviceGUID string `json:"device_guid"`
+}
+
+// ErrWrongPairingCode is returned when the device could not decrypt our
+// peer information, which means the pairing codes did not match.
+var ErrWrongPairingCode = errors.New("pairing code rejected by device")
+
+var errNotTLS13 = errors.New("device did not negotiate TLS 1.3")
+
+// Pair pairs key with the device listening for pairing requests on addr,
+// using the pairing code shown on the device. It returns the device GUID
+// the device reports once pairing succeeded.
+func Pair(ctx context.Context, addr, code string, key *Key) (string, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	tc := tls.Client(conn, key.tlsConfig())
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("TLS handshake: %w", err)
+	}
+	cs := tc.ConnectionState()
+	if cs.Version != tls.VersionTLS13 {
+		return "", errNotTLS13
+	}
+	ekm, err := cs.ExportKeyingMaterial(exportedKeyLabel, nil, exportedKeySize)
+	if err != nil {
+		return "", fmt.Errorf("exporting keying material: %w", err)
+	}
+
+	password := append([]byte(code), ekm...)
+	spake := newSPAKE2(true, clientName, serverName)
+	var random [64]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	msg, err := spake.generateMsgFrom(random, password)
+	if err != nil {
+		return "", err
+	}
+	if err := writePairingPacket(tc, pairingMsgSPAKE2, msg); err != nil {
+		return "", err
+	}
+	theirMsg, err := readPairingPacket(tc, pairingMsgSPAKE2)
+	if err != nil {
+		return "", err
+	}
+	keyMaterial, err := spake.processMsg(theirMsg)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := newPairingCipher(keyMaterial)
+	if err != nil {
+		return "", err
+	}
+
+	pub := key.PublicKey()
+	if len(pub) > maxPeerInfoSize-2 {
+		return "", errors.New("public key too large for pairing")
+	}
+	info := make([]byte, maxPeerInfoSize)
+	info[0] = peerInfoRSAPubKey
+	copy(info[1:], pub)
+	if err := writePairingPacket(tc, pairingMsgPeerInfo, c.seal(info)); err != nil {
+		return "", err
+	}
+
+	sealed, err := readPairingPacket(tc, pairingMsgPeerInfo)
+	if err != nil {
+		return "", err
+	}
+	theirInfo, err := c.open(sealed)
+	if err != nil || len(theirInfo) != maxPeerInfoSize {
+		return "", ErrWrongPairingCode
+	}
+	if theirInfo[0] != peerInfoDeviceGUID {
+		return "", fmt.Errorf("unexpected peer info type %d", theirInfo[0])
+	}
+	guid, _, _ := bytes.Cut(theirInfo[1:], []byte{0})
+	if dir := os.Getenv(pairingTranscriptEnv); dir != "" {
+		saveTranscript(dir, pairingTranscript{
+			Password:   hex.EncodeToString(password),
+			AliceRand:  hex.EncodeToString(random[:]),
+			AliceMsg:   hex.EncodeToString(msg),
+			BobMsg:     hex.EncodeToString(theirMsg),
+			PeerInfo:   hex.EncodeToString(sealed),
+			DeviceGUID: string(guid),
+		})
+	}
+	return string(guid), nil
+}
+
+// saveTranscript writes tr to a new file in dir. Recording is a test aid,
+// so a failure does not fail the pairing.
+func saveTranscript(dir string, tr pairingTranscript) {
+	b, err := json.MarshalIndent(tr, "", "  ")
+	if err != nil {
+		return
+	}
+	name := "pairing-" + time.Now().UTC().Format("20060102-150405.000000000") + ".json"
+	os.WriteFile(filepath.Join(dir, name), append(b, '\n'), 0o600)
+}
+
+func writePairingPacket(w io.Writer, typ uint8, payload []byte) error {
+	hdr := make([]byte, pairingHeaderSize, pairingHeaderSize+len(payload))
+	hdr[0] = pairingHeaderVersion
+	hdr[1] = typ
+	binary.BigEndian.PutUint32(hdr[2:], uint32(len(payload)))
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+func readPairingPacket(r io.Reader, want uint8) ([]byte, error) {
+	var hdr [pairingHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading pairing header: %w", err)
+	}
+	if hdr[0] != pairingHeaderVersion {
+		return nil, fmt.Errorf("unsupported pairing version %d", hdr[0])
+	}
+	if hdr[1] != want {
+		return nil, fmt.Errorf("unexpected pairing message type %d", hdr[1])
+	}
+	n := binary.BigEndian.Uint32(hdr[2:])
+	if n == 0 || n > maxPairingPayload {
+		return nil, fmt.Errorf("invalid pairing payload size %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading pairing payload: %w", err)
+	}
+	return payload, nil
+}
+
+// pairingCipher is adb's Aes128Gcm: AES-128-GCM keyed from the SPAKE2 key
+// via HKDF-SHA256, with separate little-endian sequence numbers as nonces
+// for each direction.
+type pairingCipher struct {
+	aead   cipher.AEAD
+	encSeq uint64
+	decSeq uint64
+}
+
+func newPairingCipher(keyMaterial []byte) (*pairingCipher, error) {
+	key, err := hkdf.Key(sha256.New, keyMaterial, nil, pairingCipherInfo, 16)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pairingCipher{aead: aead}, nil
+}
+
+func (c *pairingCipher) nonce(seq uint64) []byte {
+	n := make([]byte, c.aead.NonceSize())
+	binary.LittleEndian.PutUint64(n, seq)
+	return n
+}
+
+func (c *pairingCipher) seal(plaintext []byte) []byte {
+	out := c.aead.Seal(nil, c.nonce(c.encSeq), plaintext, nil)
+	c.encSeq++
+	return out
+}
+
+func (c *pairingCipher) open(ciphertext []byte) ([]byte, error) {
+	out, err := c.aead.Open(nil, c.nonce(c.decSeq), ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.decSeq++
+	return out, nil
+}
@@ -0,0 +1,213 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adbwifi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pairingCipherKey is the AES key for the key material seq(0, 64),
+// computed with OpenSSL:
+//
+//	openssl kdf -keylen 16 -kdfopt digest:SHA256 \
+//	    -kdfopt hexkey:000102...3f \
+//	    -kdfopt info:"adb pairing_auth aes-128-gcm key" HKDF
+const pairingCipherKey = "5e234c26fa41fb42e5d493b262c0def1"
+
+func TestPairingCipher(t *testing.T) {
+	c, err := newPairingCipher(seq(0, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(mustHex(t, pairingCipherKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// adb's Aes128Gcm copies the 64-bit sequence number into the start
+	// of an otherwise zero 12-byte nonce, in host order, which is little
+	// endian on every Android ABI.
+	msgs := [][]byte{[]byte("first"), make([]byte, maxPeerInfoSize), []byte("third")}
+	for seq, msg := range msgs {
+		nonce := make([]byte, 12)
+		nonce[0] = byte(seq)
+		want := ref.Seal(nil, nonce, msg, nil)
+		got := c.seal(msg)
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d sealed as %s, want %s", seq, short(got), short(want))
+		}
+	}
+
+	// The directions count separately: the first message received is
+	// opened with sequence number 0 however many were sent.
+	for seq, msg := range msgs {
+		nonce := make([]byte, 12)
+		nonce[0] = byte(seq)
+		got, err := c.open(ref.Seal(nil, nonce, msg, nil))
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("message %d: opened %s, %v", seq, short(got), err)
+		}
+	}
+}
+
+func TestPairingCipherOpenErrors(t *testing.T) {
+	alice, err := newPairingCipher(seq(0, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A peer that derived other key material, i.e. used another pairing
+	// code.
+	wrongCode, err := newPairingCipher(seq(1, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := newPairingCipher(seq(0, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := alice.seal([]byte("first")), alice.seal([]byte("second"))
+	if _, err := wrongCode.open(first); err == nil {
+		t.Error("opened with the wrong key")
+	}
+	if _, err := bob.open(second); err == nil {
+		t.Error("opened out of order")
+	}
+	// A failed open does not advance the sequence number.
+	if got, err := bob.open(first); err != nil || string(got) != "first" {
+		t.Errorf("opened %q, %v", got, err)
+	}
+	tampered := bytes.Clone(second)
+	tampered[0] ^= 1
+	if _, err := bob.open(tampered); err == nil {
+		t.Error("opened a tampered message")
+	}
+}
+
+func short(b []byte) string {
+	if len(b) > 24 {
+		return hex.EncodeToString(b[:24]) + "..."
+	}
+	return hex.EncodeToString(b)
+}
+
+// replayTranscript redoes our side of a recorded pairing and checks that
+// it yields the recorded message and opens the device's peer info.
+func replayTranscript(t *testing.T, tr pairingTranscript) {
+	t.Helper()
+	spake := newSPAKE2(true, clientName, serverName)
+	msg, err := spake.generateMsgFrom([64]byte(mustHex(t, tr.AliceRand)), mustHex(t, tr.Password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(msg); got != tr.AliceMsg {
+		t.Errorf("our message %s, recorded %s", got, tr.AliceMsg)
+	}
+	keyMaterial, err := spake.processMsg(mustHex(t, tr.BobMsg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newPairingCipher(keyMaterial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.open(mustHex(t, tr.PeerInfo))
+	if err != nil {
+		t.Fatalf("device peer info does not open with the derived key: %v", err)
+	}
+	if len(info) != maxPeerInfoSize || info[0] != peerInfoDeviceGUID {
+		t.Fatalf("peer info of %d bytes, type %d", len(info), info[0])
+	}
+	if guid, _, _ := bytes.Cut(info[1:], []byte{0}); string(guid) != tr.DeviceGUID {
+		t.Errorf("device GUID %q, recorded %q", guid, tr.DeviceGUID)
+	}
+}
+
+// TestPairingTranscripts replays pairings recorded against real devices
+// with MESH_ADB_PAIRING_TRANSCRIPT_DIR (see pairingTranscriptEnv). Copy the
+// transcripts into testdata to check them.
+func TestPairingTranscripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "pairing-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no recorded adbd pairing transcripts in testdata")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tr pairingTranscript
+			if err := json.Unmarshal(b, &tr); err != nil {
+				t.Fatal(err)
+			}
+			replayTranscript(t, tr)
+		})
+	}
+}
+
+// TestPairingTranscriptReplay records a pairing with a simulated device,
+// which runs this package's Bob side, and replays it.
+func TestPairingTranscriptReplay(t *testing.T) {
+	dir := t.TempDir()
+	password := append([]byte("123456"), seq(0x40, exportedKeySize)...)
+	alice := newSPAKE2(true, clientName, serverName)
+	bob := newSPAKE2(false, serverName, clientName)
+	aliceRand := [64]byte(seq(0, 64))
+	aliceMsg, err := alice.generateMsgFrom(aliceRand, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobMsg, err := bob.generateMsgFrom([64]byte(seq(0x80, 64)), password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := bob.processMsg(aliceMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := newPairingCipher(bobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := make([]byte, maxPeerInfoSize)
+	info[0] = peerInfoDeviceGUID
+	copy(info[1:], "adb-1a2b3c-x9y8z7")
+	saveTranscript(dir, pairingTranscript{
+		Password:   hex.EncodeToString(password),
+		AliceRand:  hex.EncodeToString(aliceRand[:]),
+		AliceMsg:   hex.EncodeToString(aliceMsg),
+		BobMsg:     hex.EncodeToString(bobMsg),
+		PeerInfo:   hex.EncodeToString(device.seal(info)),
+		DeviceGUID: "adb-1a2b3c-x9y8z7",
+	})
+
+	paths, err := filepath.Glob(filepath.Join(dir, "pairing-*.json"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("transcripts %q, %v", paths, err)
+	}
+	b, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tr pairingTranscript
+	if err := json.Unmarshal(b, &tr); err != nil {
+		t.Fatal(err)
+	}
+	replayTranscript(t, tr)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adbwifi
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"slices"
+
+	"filippo.io/edwards25519"
+)
+
+// The SPAKE2 implementation below mirrors BoringSSL's spake25519.c, which is
+// what adbd uses on the device side. Both ends must derive exactly the same
+// values, so the quirks of that implementation are reproduced deliberately.
+
+// spakeM and spakeN are the encodings of the M and N points BoringSSL
+// derives from the seeds "edwards25519 point generation seed (M)" and
+// "edwards25519 point generation seed (N)".
+var (
+	spakeM = mustPoint("5ada7e4bf6ddd9adb6626d32131c6b5c51a1e347a3478f53cfcf441b88eed12e")
+	spakeN = mustPoint("10e3df0ae37d8e7a99b5fe74b44672103dbddcbd06af680d71329a11693bc778")
+)
+
+// groupOrder is l, the order of the prime-order subgroup of edwards25519.
+var groupOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+func mustPoint(s string) *edwards25519.Point {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	p, err := new(edwards25519.Point).SetBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+type spake2 struct {
+	alice     bool
+	myName    []byte
+	theirName []byte
+
+	// privateKey is x; the effective SPAKE2 private key is 8x so that
+	// the cofactor of the peer's point is cleared.
+	privateKey *edwards25519.Scalar
+	// maskScalar is the password scalar divided by eight. It is applied
+	// to 8M or 8N, which equals the password scalar applied to M or N.
+	maskScalar   *edwards25519.Scalar
+	passwordHash [sha512.Size]byte
+	myMsg        []byte
+}
+
+func newSPAKE2(alice bool, myName, theirName []byte) *spake2 {
+	return &spake2{
+		alice:     alice,
+		myName:    slices.Clone(myName),
+		theirName: slices.Clone(theirName),
+	}
+}
+
+// generateMsg returns the message to send to the peer for the given password.
+func (s *spake2) generateMsg(password []byte) ([]byte, error) {
+	var random [64]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	return s.generateMsgFrom(random, password)
+}
+
+// generateMsgFrom is generateMsg with the private key derived from the
+// given random bytes, as BoringSSL derives it from its RAND_bytes output.
+func (s *spake2) generateMsgFrom(random [64]byte, password []byte) ([]byte, error) {
+	if s.myMsg != nil {
+		return nil, errors.New("spake2: message already generated")
+	}
+
+	x, err := new(edwards25519.Scalar).SetUniformBytes(random[:])
+	if err != nil {
+		return nil, err
+	}
+	s.privateKey = x
+
+	s.passwordHash = sha512.Sum512(password)
+	mask, err := passwordMaskScalar(s.passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	s.maskScalar = mask
+
+	eight := scalarFromUint64(8)
+	p := new(edwards25519.Point).ScalarBaseMult(new(edwards25519.Scalar).Multiply(x, eight))
+	myMask := s.mask(s.alice)
+	s.myMsg = new(edwards25519.Point).Add(p, myMask).Bytes()
+	return slices.Clone(s.myMsg), nil
+}
+
+// processMsg takes the peer's message and returns the 64-byte shared key.
+func (s *spake2) processMsg(theirMsg []byte) ([]byte, error) {
+	if s.myMsg == nil {
+		return nil, errors.New("spake2: message not generated")
+	}
+	if len(theirMsg) != 32 {
+		return nil, errors.New("spake2: invalid peer message length")
+	}
+	qStar, err := new(edwards25519.Point).SetBytes(theirMsg)
+	if err != nil {
+		return nil, errors.New("spake2: peer point is not on the curve")
+	}
+
+	q := new(edwards25519.Point).Subtract(qStar, s.mask(!s.alice))
+	q.MultByCofactor(q)
+	dh := new(edwards25519.Point).ScalarMult(s.privateKey, q).Bytes()
+
+	h := sha512.New()
+	if s.alice {
+		writeLengthPrefixed(h, s.myName)
+		writeLengthPrefixed(h, s.theirName)
+		writeLengthPrefixed(h, s.myMsg)
+		writeLengthPrefixed(h, theirMsg)
+	} else {
+		writeLengthPrefixed(h, s.theirName)
+		writeLengthPrefixed(h, s.myName)
+		writeLengthPrefixed(h, theirMsg)
+		writeLengthPrefixed(h, s.myMsg)
+	}
+	writeLengthPrefixed(h, dh)
+	writeLengthPrefixed(h, s.passwordHash[:])
+	return h.Sum(nil), nil
+}
+
+// mask returns the password mask point for Alice (M) or Bob (N).
+func (s *spake2) mask(alice bool) *edwards25519.Point {
+	base := spakeN
+	if alice {
+		base = spakeM
+	}
+	p := new(edwards25519.Point).MultByCofactor(base)
+	return p.ScalarMult(s.maskScalar, p)
+}
+
+// passwordMaskScalar reduces the password hash modulo l and then adds
+// multiples of l until the result is divisible by eight, as BoringSSL does
+// to clear the small-order component of M and N. It returns that value
+// divided by eight, which is always smaller than l.
+func passwordMaskScalar(hash [sha512.Size]byte) (*edwards25519.Scalar, error) {
+	reduced, err := new(edwards25519.Scalar).SetUniformBytes(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	ps := new(big.Int).SetBytes(reversed(reduced.Bytes()))
+	order := new(big.Int).Set(groupOrder)
+	for bit := uint(0); bit < 3; bit++ {
+		if ps.Bit(int(bit)) == 1 {
+			ps.Add(ps, order)
+		}
+		order.Lsh(order, 1)
+	}
+	ps.Rsh(ps, 3)
+
+	b := make([]byte, 32)
+	ps.FillBytes(b)
+	return new(edwards25519.Scalar).SetCanonicalBytes(reversed(b))
+}
+
+func scalarFromUint64(v uint64) *edwards25519.Scalar {
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint64(b, v)
+	s, _ := new(edwards25519.Scalar).SetCanonicalBytes(b)
+	return s
+}
+
+func writeLengthPrefixed(h interface{ Write([]byte) (int, error) }, b []byte) {
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(b)))
+	h.Write(l[:])
+	h.Write(b)
+}
+
+func reversed(b []byte) []byte {
+	out := slices.Clone(b)
+	slices.Reverse(out)
+	return out
+}
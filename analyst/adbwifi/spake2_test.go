@@ -0,0 +1,382 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package adbwifi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"slices"
+	"testing"
+)
+
+// The vectors below are a cross-check, not known answers from BoringSSL
+// or adbd: they were computed with refSPAKE2, a big-integer transcription
+// of BoringSSL's spake25519.c (password scalar hack enabled, as adbd uses
+// it) built on the affine formulas of the ed25519.py reference that
+// spake25519.c derives M and N with. It shares no code with spake2.go, so
+// the vectors catch a change to either side of the port, but a misreading
+// of spake25519.c made in both would go unnoticed. Interoperability with a
+// real adbd is checked by TestPairingTranscripts instead.
+var spake2Vectors = []struct {
+	name               string
+	password           string
+	aliceRand, bobRand string
+	aliceMsg, bobMsg   string
+	key                string
+}{
+	{
+		name:      "code-and-ekm",
+		password:  "123456" + hex.EncodeToString(seq(0x40, 64)),
+		aliceRand: hex.EncodeToString(seq(0x00, 64)),
+		bobRand:   hex.EncodeToString(seq(0x80, 64)),
+		aliceMsg:  "89b12a6abeda44a067491c02ef3d4db97238fc16969282ebd7f1ece4d6a2c8b9",
+		bobMsg:    "884bc39e2be0626c82c543b93dc0ec3d66308b39af906d7edc92dc38546b3071",
+		key:       "442b1f0eb8528132567089d8b5a18c5f9e08335355152c957f9007b1e26d082cc0a620c377c4d6b5be1a913b1a747a1d24efeb0d2336b665123d22ae19934afe",
+	},
+	{
+		name:      "empty-password",
+		password:  "",
+		aliceRand: hex.EncodeToString(bytes.Repeat([]byte{0xff}, 64)),
+		bobRand:   hex.EncodeToString(bytes.Repeat([]byte{0x01}, 64)),
+		aliceMsg:  "3936e8b425f49109ce26cdd506b40f6c4a8fa6330da9dd52ef647edc96de4cd8",
+		bobMsg:    "b37cd91d618f268b676403891139756454d1c4c8b71bacceb3f88504dc9dfdd6",
+		key:       "557ad638fa2343438a31a802314a183042d7931b3ba292813a9301619e82af38bbc0c9259a915ca987a2f089a63ea19bf32e3c2853fec1b5bc96680740f706b5",
+	},
+}
+
+func seq(start byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSPAKE2Vectors(t *testing.T) {
+	for _, v := range spake2Vectors {
+		t.Run(v.name, func(t *testing.T) {
+			password := []byte(v.password)
+			alice := newSPAKE2(true, clientName, serverName)
+			bob := newSPAKE2(false, serverName, clientName)
+			aliceMsg, err := alice.generateMsgFrom([64]byte(mustHex(t, v.aliceRand)), password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bobMsg, err := bob.generateMsgFrom([64]byte(mustHex(t, v.bobRand)), password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(aliceMsg); got != v.aliceMsg {
+				t.Errorf("Alice's message %s, want %s", got, v.aliceMsg)
+			}
+			if got := hex.EncodeToString(bobMsg); got != v.bobMsg {
+				t.Errorf("Bob's message %s, want %s", got, v.bobMsg)
+			}
+			aliceKey, err := alice.processMsg(bobMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bobKey, err := bob.processMsg(aliceMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(aliceKey); got != v.key {
+				t.Errorf("Alice's key %s, want %s", got, v.key)
+			}
+			if got := hex.EncodeToString(bobKey); got != v.key {
+				t.Errorf("Bob's key %s, want %s", got, v.key)
+			}
+		})
+	}
+}
+
+// TestSPAKE2Reference checks that refSPAKE2 reproduces the vectors, so
+// that they can be regenerated from it.
+func TestSPAKE2Reference(t *testing.T) {
+	for _, v := range spake2Vectors {
+		t.Run(v.name, func(t *testing.T) {
+			password := []byte(v.password)
+			alice := newRefSPAKE2(true, clientName, serverName, mustHex(t, v.aliceRand), password)
+			bob := newRefSPAKE2(false, serverName, clientName, mustHex(t, v.bobRand), password)
+			if got := hex.EncodeToString(alice.msg); got != v.aliceMsg {
+				t.Errorf("Alice's message %s, want %s", got, v.aliceMsg)
+			}
+			if got := hex.EncodeToString(bob.msg); got != v.bobMsg {
+				t.Errorf("Bob's message %s, want %s", got, v.bobMsg)
+			}
+			if got := hex.EncodeToString(alice.process(bob.msg)); got != v.key {
+				t.Errorf("Alice's key %s, want %s", got, v.key)
+			}
+			if got := hex.EncodeToString(bob.process(alice.msg)); got != v.key {
+				t.Errorf("Bob's key %s, want %s", got, v.key)
+			}
+		})
+	}
+}
+
+// TestSPAKE2PasswordScalar compares the password masks with refSPAKE2
+// for passwords that take every branch of the password scalar hack.
+func TestSPAKE2PasswordScalar(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for i := range 64 {
+		password := []byte{byte(i)}
+		ref := newRefSPAKE2(true, clientName, serverName, seq(0, 64), password)
+		hash := sha512.Sum512(password)
+		seen[refReduce(hash[:]).Uint64()&7] = true
+
+		s := newSPAKE2(true, clientName, serverName)
+		if _, err := s.generateMsgFrom([64]byte(seq(0, 64)), password); err != nil {
+			t.Fatal(err)
+		}
+		for _, alice := range []bool{true, false} {
+			want := refMask(ref.passwordScalar, alice)
+			if got := s.mask(alice).Bytes(); !bytes.Equal(got, want) {
+				t.Errorf("password %x, alice %v: mask %x, want %x", password, alice, got, want)
+			}
+		}
+	}
+	if len(seen) != 8 {
+		t.Errorf("only %d of 8 residues mod 8 covered", len(seen))
+	}
+}
+
+// TestSPAKE2Points derives M and N from their seeds as spake25519.c
+// describes: the SHA-256 of the seed, rehashed until it decodes as a
+// point.
+func TestSPAKE2Points(t *testing.T) {
+	for _, tt := range []struct {
+		seed string
+		want []byte
+	}{
+		{"edwards25519 point generation seed (M)", spakeM.Bytes()},
+		{"edwards25519 point generation seed (N)", spakeN.Bytes()},
+	} {
+		v := sha256.Sum256([]byte(tt.seed))
+		for {
+			if _, ok := refDecode(v[:]); ok {
+				break
+			}
+			v = sha256.Sum256(v[:])
+		}
+		if !bytes.Equal(v[:], tt.want) {
+			t.Errorf("%s: %x, want %x", tt.seed, v, tt.want)
+		}
+	}
+}
+
+func TestSPAKE2Errors(t *testing.T) {
+	alice := newSPAKE2(true, clientName, serverName)
+	bob := newSPAKE2(false, serverName, clientName)
+	if _, err := alice.processMsg(make([]byte, 32)); err == nil {
+		t.Error("processMsg before generateMsg succeeded")
+	}
+	aliceMsg, err := alice.generateMsg([]byte("123456"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.generateMsg([]byte("123456")); err == nil {
+		t.Error("second generateMsg succeeded")
+	}
+	bobMsg, err := bob.generateMsg([]byte("654321"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, err := alice.processMsg(bobMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := bob.processMsg(aliceMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(aliceKey, bobKey) {
+		t.Error("different passwords gave the same key")
+	}
+	if _, err := alice.processMsg(bobMsg[:31]); err == nil {
+		t.Error("short message accepted")
+	}
+	// y = 2 is not the y coordinate of a point on the curve.
+	notOnCurve := make([]byte, 32)
+	notOnCurve[0] = 2
+	if _, err := alice.processMsg(notOnCurve); err == nil {
+		t.Error("message off the curve accepted")
+	}
+}
+
+// refSPAKE2 follows SPAKE2_generate_msg and SPAKE2_process_msg of
+// spake25519.c step by step, with scalars as integers.
+type refSPAKE2 struct {
+	alice             bool
+	myName, theirName []byte
+	privateKey        *big.Int // 8x, as left_shift_3 leaves it
+	passwordScalar    *big.Int // a multiple of 8, below 8l
+	passwordHash      []byte
+	msg               []byte
+}
+
+func newRefSPAKE2(alice bool, myName, theirName, random, password []byte) *refSPAKE2 {
+	s := &refSPAKE2{alice: alice, myName: myName, theirName: theirName}
+	s.privateKey = new(big.Int).Lsh(refReduce(random), 3)
+	hash := sha512.Sum512(password)
+	s.passwordHash = hash[:]
+
+	// The password scalar hack: add l, 2l and 4l as needed to make the
+	// reduced hash a multiple of eight.
+	ps := refReduce(hash[:])
+	order := new(big.Int).Set(refL)
+	for bit := range 3 {
+		if ps.Bit(bit) == 1 {
+			ps.Add(ps, order)
+		}
+		order.Lsh(order, 1)
+	}
+	s.passwordScalar = ps
+
+	p := refScalarMult(s.privateKey, refBase)
+	mask, _ := refDecode(refMask(ps, alice))
+	s.msg = refEncode(refAdd(p, mask))
+	return s
+}
+
+func (s *refSPAKE2) process(theirMsg []byte) []byte {
+	qStar, ok := refDecode(theirMsg)
+	if !ok {
+		return nil
+	}
+	mask, _ := refDecode(refMask(s.passwordScalar, !s.alice))
+	negMask := refPoint{new(big.Int).Sub(refP, mask.x), mask.y}
+	dh := refEncode(refScalarMult(s.privateKey, refAdd(qStar, negMask)))
+
+	h := sha512.New()
+	prefixed := func(b []byte) {
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	if s.alice {
+		prefixed(s.myName)
+		prefixed(s.theirName)
+		prefixed(s.msg)
+		prefixed(theirMsg)
+	} else {
+		prefixed(s.theirName)
+		prefixed(s.myName)
+		prefixed(theirMsg)
+		prefixed(s.msg)
+	}
+	prefixed(dh)
+	prefixed(s.passwordHash)
+	return h.Sum(nil)
+}
+
+// refMask returns the encoding of ps·M for Alice or ps·N for Bob.
+func refMask(ps *big.Int, alice bool) []byte {
+	base := spakeN.Bytes()
+	if alice {
+		base = spakeM.Bytes()
+	}
+	p, _ := refDecode(base)
+	return refEncode(refScalarMult(ps, p))
+}
+
+// Affine edwards25519 arithmetic after ed25519.py.
+var (
+	refP    = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	refL, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+	refD    = refMod(new(big.Int).Mul(big.NewInt(-121665), refInv(big.NewInt(121666))))
+	refI    = new(big.Int).Exp(big.NewInt(2), new(big.Int).Rsh(new(big.Int).Sub(refP, big.NewInt(1)), 2), refP)
+	refBase = func() refPoint {
+		y := refMod(new(big.Int).Mul(big.NewInt(4), refInv(big.NewInt(5))))
+		return refPoint{refXRecover(y), y}
+	}()
+)
+
+type refPoint struct{ x, y *big.Int }
+
+func refMod(v *big.Int) *big.Int { return v.Mod(v, refP) }
+
+func refInv(v *big.Int) *big.Int { return new(big.Int).ModInverse(v, refP) }
+
+// refReduce reduces a little-endian integer modulo l.
+func refReduce(b []byte) *big.Int {
+	v := new(big.Int).SetBytes(reversed(b))
+	return v.Mod(v, refL)
+}
+
+func refAdd(a, b refPoint) refPoint {
+	x1y2 := new(big.Int).Mul(a.x, b.y)
+	x2y1 := new(big.Int).Mul(b.x, a.y)
+	y1y2 := new(big.Int).Mul(a.y, b.y)
+	x1x2 := new(big.Int).Mul(a.x, b.x)
+	dxxyy := refMod(new(big.Int).Mul(refD, new(big.Int).Mul(x1x2, y1y2)))
+	x := new(big.Int).Mul(new(big.Int).Add(x1y2, x2y1), refInv(new(big.Int).Add(big.NewInt(1), dxxyy)))
+	y := new(big.Int).Mul(new(big.Int).Add(y1y2, x1x2), refInv(refMod(new(big.Int).Sub(big.NewInt(1), dxxyy))))
+	return refPoint{refMod(x), refMod(y)}
+}
+
+func refScalarMult(k *big.Int, p refPoint) refPoint {
+	q := refPoint{big.NewInt(0), big.NewInt(1)}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		q = refAdd(q, q)
+		if k.Bit(i) == 1 {
+			q = refAdd(q, p)
+		}
+	}
+	return q
+}
+
+func refXRecover(y *big.Int) *big.Int {
+	yy := new(big.Int).Mul(y, y)
+	xx := new(big.Int).Mul(new(big.Int).Sub(yy, big.NewInt(1)), refInv(refMod(new(big.Int).Add(new(big.Int).Mul(refD, yy), big.NewInt(1)))))
+	refMod(xx)
+	x := new(big.Int).Exp(xx, new(big.Int).Rsh(new(big.Int).Add(refP, big.NewInt(3)), 3), refP)
+	if refMod(new(big.Int).Sub(new(big.Int).Mul(x, x), xx)).Sign() != 0 {
+		x = refMod(x.Mul(x, refI))
+	}
+	if x.Bit(0) == 1 {
+		x.Sub(refP, x)
+	}
+	return x
+}
+
+func refOnCurve(p refPoint) bool {
+	xx := new(big.Int).Mul(p.x, p.x)
+	yy := new(big.Int).Mul(p.y, p.y)
+	lhs := refMod(new(big.Int).Sub(yy, xx))
+	rhs := refMod(new(big.Int).Add(big.NewInt(1), new(big.Int).Mul(refD, new(big.Int).Mul(xx, yy))))
+	return lhs.Cmp(rhs) == 0
+}
+
+func refDecode(b []byte) (refPoint, bool) {
+	le := slices.Clone(b)
+	sign := le[31] >> 7
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reversed(le))
+	x := refXRecover(y)
+	if uint(x.Bit(0)) != uint(sign) {
+		x.Sub(refP, x)
+	}
+	p := refPoint{x, y}
+	return p, refOnCurve(p)
+}
+
+func refEncode(p refPoint) []byte {
+	b := make([]byte, 32)
+	p.y.FillBytes(b)
+	b = reversed(b)
+	b[31] |= byte(p.x.Bit(0)) << 7
+	return b
+}
@@ -0,0 +1,560 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// Portions of this code are derived from androidqf (Android Quick Forensics)
+// Copyright (c) 2021–2022 Claudio Guarnieri.
+// Use of this software is governed by the MVT License 1.1, available at:
+// https://license.mvt.re/1.1/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/acquisition"
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+	"github.com/BARGHEST-ngo/androidqf_mesh/log"
+	"github.com/BARGHEST-ngo/androidqf_mesh/modules"
+)
+
+// defaultAcquisitionTimeout bounds a whole acquisition.
+// (ov) my experience is generally it shouldn't take more than 60 minutes.
+// we should verify this with user feedback
+const defaultAcquisitionTimeout = 60 * time.Minute
+
+// acquisitionFlags are the acquisition options shared by adbcollect and
+// adbpair --qf.
+type acquisitionFlags struct {
+	fast     bool
+	module   string
+	modules  string
+	exclude  string
+	profile  string
+	profiles string
+	output   string
+	timeout  time.Duration
+
+	autoTimeout   bool
+	noEstimate    bool
+	allowMismatch bool
+}
+
+func (f *acquisitionFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.fast, "fast", false, "Fast mode (skip some checks)")
+	fs.StringVar(&f.module, "module", "", "Specific module to run (same as --modules with one module)")
+	fs.StringVar(&f.modules, "modules", "", "Comma-separated modules to run; glob patterns are allowed")
+	fs.StringVar(&f.exclude, "exclude", "", "Comma-separated modules to skip; glob patterns are allowed")
+	fs.StringVar(&f.profile, "profile", "", "Named module profile to run (see adbcollect --list)")
+	fs.StringVar(&f.profiles, "profiles", "", "Profiles file (default: "+profilesFile+" next to meshcli, if present)")
+	fs.StringVar(&f.output, "output", "", "Output directory for collected data")
+	f.timeout = defaultAcquisitionTimeout
+	fs.Var(timeoutValue{&f.timeout, &f.autoTimeout}, "timeout", "Abort the acquisition after this long (0 for no limit, \"auto\" to derive it from the estimated duration)")
+	fs.BoolVar(&f.noEstimate, "no-estimate", false, "Do not measure throughput and estimate the acquisition time before starting")
+	fs.BoolVar(&f.allowMismatch, "allow-identity-mismatch", false, "Continue even if the ADB device does not match the MESH peer's identity")
+}
+
+// selection combines --profile, --modules/--module and --exclude into the
+// list of modules to run and whether to use fast mode.
+func (f *acquisitionFlags) selection(profiles map[string]moduleProfile) ([]string, bool, error) {
+	var available []string
+	for _, mod := range modules.List() {
+		available = append(available, mod.Name())
+	}
+
+	include := splitList(f.modules)
+	if f.module != "" {
+		include = append(include, f.module)
+	}
+	exclude := splitList(f.exclude)
+	fast := f.fast
+
+	if f.profile != "" {
+		p, ok := profiles[f.profile]
+		if !ok {
+			return nil, false, fmt.Errorf("unknown profile %q (available: %s)",
+				f.profile, strings.Join(sortedProfileNames(profiles), ", "))
+		}
+		if len(include) == 0 {
+			include = p.Include
+		}
+		exclude = append(exclude, p.Exclude...)
+		fast = fast || p.Fast
+	}
+
+	selected, err := selectModules(available, include, exclude)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid module selection: %w", err)
+	}
+	return selected, fast, nil
+}
+
+// options resolves the flags into the options for a new acquisition of the
+// device with the given serial.
+func (f *acquisitionFlags) options(serial string) (acquisitionOptions, error) {
+	profiles, err := loadProfiles(f.profiles)
+	if err != nil {
+		return acquisitionOptions{}, err
+	}
+	selected, fast, err := f.selection(profiles)
+	if err != nil {
+		return acquisitionOptions{}, err
+	}
+	return acquisitionOptions{
+		Serial:  serial,
+		Output:  f.output,
+		Modules: selected,
+		Fast:    fast,
+		Timeout: f.timeout,
+
+		AutoTimeout:   f.autoTimeout,
+		NoEstimate:    f.noEstimate,
+		AllowMismatch: f.allowMismatch,
+	}, nil
+}
+
+// acquisitionOptions describe one run of the acquisition pipeline.
+type acquisitionOptions struct {
+	// Serial selects the ADB device; empty means the only connected one.
+	Serial string
+	// Output is the acquisition folder; empty lets androidqf pick one
+	// next to the executable.
+	Output string
+	// Modules are the names of the modules to run, in order.
+	Modules []string
+	Fast    bool
+	// Resume is the folder of an interrupted acquisition to continue. It
+	// replaces Output, Modules and Fast with those of the original run.
+	Resume string
+	// Timeout bounds the whole acquisition; zero means no limit.
+	Timeout time.Duration
+	// AutoTimeout derives Timeout from the estimated duration instead.
+	AutoTimeout bool
+	// NoEstimate skips measuring throughput and estimating the duration.
+	NoEstimate bool
+	// Case, if set, receives the acquisition's chain-of-custody events.
+	Case *Case
+	// Binding is the device identity binding if it was already checked,
+	// as adbpair does; otherwise it is established from the serial.
+	Binding       *deviceBinding
+	AllowMismatch bool
+}
+
+// runAcquisition runs the androidqf acquisition pipeline against a device:
+// it waits for the device, runs the selected modules while tracking progress
+// for --resume, and hashes, stores and encrypts the result. Whether the
+// output is streamed and encrypted is decided by the acquisition package
+// from the key file next to the executable, as in androidqf.
+func runAcquisition(ctx context.Context, opts acquisitionOptions) error {
+	// Cancelling ctx abandons the running module, while the timeout only
+	// takes effect between modules.
+	interrupt := ctx
+	if opts.Timeout > 0 && !opts.AutoTimeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	var progress *acquisitionProgress
+	if opts.Resume != "" {
+		var err error
+		progress, err = loadProgress(opts.Resume)
+		if err != nil {
+			return fmt.Errorf("unable to resume acquisition: %w", err)
+		}
+		if progress.Completed {
+			return fmt.Errorf("acquisition in %s is already complete", opts.Resume)
+		}
+		if opts.Serial == "" {
+			opts.Serial = progress.Serial
+		}
+		opts.Fast = progress.Fast
+		opts.Output = opts.Resume
+		log.Infof("Resuming acquisition in %s, remaining modules: %v", opts.Output, progress.remaining())
+	} else {
+		log.Infof("Selected modules: %s", strings.Join(opts.Modules, ", "))
+	}
+
+	log.Debug("Starting androidqf")
+	if adb.Client == nil {
+		adbClient, err := adb.New()
+		if err != nil {
+			return fmt.Errorf("impossible to initialize ADB: %w", err)
+		}
+		adb.Client = adbClient
+	}
+
+	serial, err := waitForDevice(ctx, opts.Serial)
+	if err != nil {
+		return err
+	}
+
+	// Record the device's identity up front, while it is surely connected.
+	device := collectDeviceMetadata(ctx, serial)
+	binding := opts.Binding
+	if binding == nil {
+		if peer, err := peerForSerial(ctx, serial); err != nil {
+			log.Warning(fmt.Sprintf("Cannot bind the device to a MESH peer: %v", err))
+		} else {
+			binding = bindDevice(ctx, peer, serial)
+			if err := checkBinding(opts.Case, binding, opts.AllowMismatch); err != nil {
+				return err
+			}
+		}
+	}
+
+	mods := opts.Modules
+	if progress != nil {
+		mods = progress.remaining()
+	}
+	if !opts.NoEstimate {
+		checkEstimate(&opts, mods)
+	}
+	if opts.AutoTimeout {
+		if opts.Timeout == 0 {
+			opts.Timeout = defaultAcquisitionTimeout
+			log.Warning(fmt.Sprintf("No estimate to derive the timeout from, using %s", opts.Timeout))
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	acq, err := acquisition.New(opts.Output)
+	if err != nil {
+		log.Debug(err)
+		return fmt.Errorf("impossible to initialise the acquisition: %w", err)
+	}
+
+	// Start acquisitions
+	log.Info(fmt.Sprintf("Started new acquisition in %s", acq.StoragePath))
+
+	if binding != nil && !acq.StreamingMode {
+		if err := writeBinding(acq.StoragePath, binding); err != nil {
+			log.ErrorExc("Failed to record the device identity binding", err)
+		}
+	}
+
+	if progress == nil {
+		progress = newProgress(acq.StoragePath, serial, opts.Modules)
+		progress.Fast = opts.Fast
+	} else if acq.StreamingMode {
+		return fmt.Errorf("acquisitions in streaming mode cannot be resumed")
+	}
+
+	// In streaming mode the output is a single encrypted stream that
+	// cannot be appended to later, so there is nothing to resume.
+	trackProgress := !acq.StreamingMode
+	saveProgress := func(err error) {
+		if trackProgress && err != nil {
+			log.ErrorExc("Failed to update acquisition progress", err)
+		}
+	}
+	if trackProgress {
+		saveProgress(progress.save())
+	}
+
+	started := time.Now()
+	total := len(progress.Modules)
+	events.emit(progressEvent{
+		Event:   eventAcquisitionStarted,
+		Path:    acq.StoragePath,
+		Total:   total,
+		Details: map[string]any{"modules": progress.remaining(), "serial": serial, "fast": opts.Fast},
+	})
+	logCase(opts.Case, "acquisition_started", map[string]any{
+		"path":    acq.StoragePath,
+		"uuid":    acq.UUID,
+		"serial":  serial,
+		"modules": progress.remaining(),
+		"fast":    opts.Fast,
+		"resumed": opts.Resume != "",
+	})
+	fail := func(err error) error {
+		logCase(opts.Case, "acquisition_failed", map[string]any{"path": acq.StoragePath, "error": err.Error()})
+		events.emit(progressEvent{
+			Event:      eventAcquisitionFailed,
+			Path:       acq.StoragePath,
+			DurationMS: time.Since(started).Milliseconds(),
+			Error:      err.Error(),
+		})
+		return err
+	}
+
+	var failed int
+	for _, mod := range modules.List() {
+		mp := progress.module(mod.Name())
+		if mp == nil {
+			continue
+		}
+		index := slices.Index(progress.Modules, mp) + 1
+		if mp.Status == moduleCompleted {
+			log.Infof("Skipping module %s, already completed", mod.Name())
+			events.emit(progressEvent{Event: eventModuleSkipped, Module: mod.Name(), Index: index, Total: total, Status: moduleCompleted})
+			continue
+		}
+
+		// Modules cannot be interrupted, so cancellation and the
+		// timeout take effect between modules.
+		if err := ctx.Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Error(fmt.Sprintf("Acquisition timed out after %s.", opts.Timeout))
+			}
+			if trackProgress {
+				log.Infof("Resume with: meshcli adbcollect --resume %s", acq.StoragePath)
+			}
+			return fail(fmt.Errorf("acquisition stopped before module %s: %w", mod.Name(), err))
+		}
+
+		events.emit(progressEvent{Event: eventModuleStarted, Module: mod.Name(), Index: index, Total: total})
+		modStarted := time.Now()
+		var sizeBefore int64
+		if trackProgress {
+			sizeBefore = dirSize(acq.StoragePath)
+		}
+		finished := func(err error) {
+			saveProgress(progress.finish(mp, err))
+			ev := progressEvent{
+				Event:      eventModuleFinished,
+				Module:     mod.Name(),
+				Index:      index,
+				Total:      total,
+				Status:     statusSucceeded,
+				DurationMS: time.Since(modStarted).Milliseconds(),
+			}
+			if trackProgress {
+				ev.Bytes = dirSize(acq.StoragePath) - sizeBefore
+			}
+			if err != nil {
+				failed++
+				ev.Status = statusFailed
+				if errors.Is(err, context.Canceled) {
+					ev.Status = statusInterrupted
+				}
+				ev.Error = err.Error()
+			}
+			events.emit(ev)
+			logCase(opts.Case, "module_finished", stepDetails(err, map[string]any{
+				"module":      mod.Name(),
+				"duration_ms": ev.DurationMS,
+				"bytes":       ev.Bytes,
+			}))
+		}
+
+		saveProgress(progress.start(mp))
+		err = mod.InitStorage(acq.StoragePath)
+		if err != nil {
+			log.Infof(
+				"ERROR: failed to initialize storage for module %s: %v",
+				mod.Name(),
+				err,
+			)
+			finished(err)
+			continue
+		}
+
+		err = runModule(interrupt, mod, acq, opts.Fast)
+		finished(err)
+		if errors.Is(err, context.Canceled) {
+			log.Error("Acquisition interrupted.")
+			if trackProgress {
+				log.Infof("Resume with: meshcli adbcollect --resume %s", acq.StoragePath)
+			}
+			return fail(fmt.Errorf("acquisition interrupted during module %s: %w", mod.Name(), err))
+		}
+		if err != nil {
+			log.Infof("ERROR: failed to run module %s: %v", mod.Name(), err)
+
+			// A module failing because the device went away would
+			// take every following module down with it; stop here
+			// and leave the acquisition resumable instead.
+			if _, stateErr := adb.Client.GetState(); stateErr != nil && trackProgress {
+				log.Error("Lost connection to the device, stopping acquisition.")
+				log.Infof("Resume with: meshcli adbcollect --resume %s", acq.StoragePath)
+				return fail(fmt.Errorf("connection to device lost during module %s: %w", mod.Name(), stateErr))
+			}
+		}
+	}
+
+	if acq.StreamingMode {
+		// In streaming mode, all data is already encrypted in the zip stream
+		log.Info("Finalizing encrypted acquisition...")
+		log.Warning("No signed manifest is written in streaming mode.")
+		acq.Complete()
+	} else {
+		// Traditional mode: hash files, then encrypt if key exists
+		err = acq.HashFiles()
+		if err != nil {
+			log.ErrorExc("Failed to generate list of file hashes", err)
+			return fail(err)
+		}
+
+		acq.StoreInfo()
+		logAcquisitionHashes(opts.Case, acq.StoragePath)
+
+		// Mark the acquisition complete before it is possibly
+		// encrypted and removed from disk.
+		progress.Completed = true
+		saveProgress(progress.save())
+
+		// Complete closes androidqf's command.log, which the manifest
+		// covers too, so the rest is only logged to the console.
+		acq.Complete()
+
+		// The manifest covers everything above, so it comes last.
+		sum, err := writeManifest(acq.StoragePath, acq.UUID, device, opts.Case)
+		if err != nil {
+			log.ErrorExc("Failed to write the signed acquisition manifest", err)
+			logCase(opts.Case, "acquisition_manifest", map[string]any{"path": acq.StoragePath, "error": err.Error()})
+		} else {
+			log.Infof("Signed acquisition manifest written to %s", manifestFile)
+			logCase(opts.Case, "acquisition_manifest", map[string]any{
+				"path":     filepath.Join(acq.StoragePath, manifestFile),
+				"sha256":   sum,
+				"device":   device,
+				"node_key": device.NodeKey,
+			})
+		}
+
+		err = acq.StoreSecurely()
+		if err != nil {
+			log.ErrorExc("Something failed while encrypting the acquisition", err)
+			log.Warning("WARNING: The secure storage of the acquisition folder failed! The data is unencrypted!")
+		}
+	}
+
+	log.Info("Acquisition completed.")
+	logCase(opts.Case, "acquisition_completed", map[string]any{
+		"path":           acq.StoragePath,
+		"serial":         serial,
+		"node_key":       device.NodeKey,
+		"tailscale_ips":  device.TailscaleIPs,
+		"failed_modules": failed,
+		"streaming":      acq.StreamingMode,
+	})
+	events.emit(progressEvent{
+		Event:      eventAcquisitionComplete,
+		Path:       acq.StoragePath,
+		Total:      total,
+		DurationMS: time.Since(started).Milliseconds(),
+		Details:    map[string]any{"failed_modules": failed},
+	})
+	return nil
+}
+
+// runModule runs mod, or gives up on it when ctx is cancelled. Modules
+// cannot be interrupted, so an abandoned module keeps running until the
+// process exits; its output is incomplete and it is re-run on resume.
+func runModule(ctx context.Context, mod modules.Module, acq *acquisition.Acquisition, fast bool) error {
+	done := make(chan error, 1)
+	go func() { done <- mod.Run(acq, fast) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hashesFile is the hash list written by acquisition.HashFiles.
+const hashesFile = "hashes.csv"
+
+// logAcquisitionHashes records the acquisition's hash list in the case log,
+// together with the hash of the list itself, so that the files can later be
+// tied to the case even after they leave the analyst's machine.
+func logAcquisitionHashes(c *Case, dir string) {
+	if c == nil {
+		return
+	}
+	path := filepath.Join(dir, hashesFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logCase(c, "acquisition_hashes", map[string]any{"path": path, "error": err.Error()})
+		return
+	}
+	files := map[string]string{}
+	records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err == nil {
+		for _, r := range records {
+			if len(r) >= 2 {
+				files[r[0]] = r[1]
+			}
+		}
+	}
+	sum := sha256.Sum256(b)
+	logCase(c, "acquisition_hashes", map[string]any{
+		"path":   path,
+		"sha256": hex.EncodeToString(sum[:]),
+		"files":  files,
+	})
+}
+
+// checkEstimate estimates the duration of the acquisition of mods and
+// reports it. With AutoTimeout it sets the timeout from the estimate,
+// otherwise it warns when the estimate exceeds the timeout.
+func checkEstimate(opts *acquisitionOptions, mods []string) {
+	log.Info("Measuring throughput from the device...")
+	est, err := estimateAcquisition(mods)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Cannot estimate the acquisition time: %v", err))
+		return
+	}
+	log.Infof("Throughput %s/s, estimated size %s, estimated time %s",
+		formatBytes(int64(est.Throughput)), formatBytes(est.Bytes), est.ETA.Round(time.Second))
+
+	switch {
+	case opts.AutoTimeout:
+		opts.Timeout = est.autoTimeout()
+		log.Infof("Timeout set to %s from the estimate", opts.Timeout)
+	case opts.Timeout > 0 && est.ETA > opts.Timeout:
+		log.Warning(fmt.Sprintf("WARNING: the estimated time %s exceeds the timeout of %s; the acquisition will probably be stopped before it completes. Use --timeout auto, a longer --timeout or a smaller profile.",
+			est.ETA.Round(time.Second), opts.Timeout))
+	}
+	details := map[string]any{
+		"bytes":          est.Bytes,
+		"throughput_bps": int64(est.Throughput),
+		"eta_seconds":    int64(est.ETA.Seconds()),
+		"timeout":        opts.Timeout.String(),
+		"auto_timeout":   opts.AutoTimeout,
+	}
+	events.emit(progressEvent{Event: eventAcquisitionEstimate, Total: len(mods), Bytes: est.Bytes, DurationMS: est.ETA.Milliseconds(), Details: details})
+	logCase(opts.Case, "acquisition_estimate", details)
+}
+
+// waitForDevice selects the device with the given serial (or the only
+// connected device) and waits until it is connected and authorized,
+// retrying every 5 seconds until ctx is done.
+func waitForDevice(ctx context.Context, serial string) (string, error) {
+	checkADBClient()
+	for {
+		s, err := adb.Client.SetSerial(serial)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error trying to connect over ADB: %s", err))
+
+		} else {
+
+			_, err = adb.Client.GetState()
+			if err == nil {
+				return s, nil
+			}
+			log.Debug(err)
+			log.Error("Unable to get device state. Please make sure it is connected and authorized. Trying again in 5 seconds...")
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
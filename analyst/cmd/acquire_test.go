@@ -0,0 +1,62 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/acquisition"
+)
+
+// blockingModule is a module whose Run returns only once release is closed.
+type blockingModule struct {
+	release chan struct{}
+}
+
+func (m *blockingModule) Name() string             { return "blocking" }
+func (m *blockingModule) InitStorage(string) error { return nil }
+func (m *blockingModule) Run(*acquisition.Acquisition, bool) error {
+	<-m.release
+	return errors.New("ran to the end")
+}
+
+func TestRunModuleInterrupted(t *testing.T) {
+	mod := &blockingModule{release: make(chan struct{})}
+	defer close(mod.release)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runModule(ctx, mod, nil, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("runModule returned %v, want %v", err, context.Canceled)
+	}
+
+	dir := t.TempDir()
+	p := newProgress(dir, "serial", []string{mod.Name()})
+	mp := p.module(mod.Name())
+	if err := p.start(mp); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.finish(mp, context.Canceled); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadProgress(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.module(mod.Name()); got.Status != moduleInterrupted || got.Error == "" {
+		t.Errorf("module recorded as %q %q", got.Status, got.Error)
+	}
+	if got := loaded.remaining(); len(got) != 1 || got[0] != mod.Name() {
+		t.Errorf("remaining modules %q, want the interrupted one", got)
+	}
+}
+
+func TestRunModuleFinished(t *testing.T) {
+	mod := &blockingModule{release: make(chan struct{})}
+	close(mod.release)
+	if err := runModule(context.Background(), mod, nil, false); err == nil || errors.Is(err, context.Canceled) {
+		t.Errorf("runModule returned %v, want the module's error", err)
+	}
+}
@@ -5,20 +5,85 @@
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
 	"github.com/peterbourgon/ff/v3/ffcli"
 )
 
 var adbcleanArgs struct {
-	serial string
+	serial    string
+	caseDir   string
+	steps     string
+	dryRun    bool
+	force     bool
+	revokeAll bool
+}
+
+// cleanStep is one action of adbclean.
+type cleanStep struct {
+	Name        string
+	Description string
+	// Command is run with adb shell; steps without one use run instead.
+	Command []string
+	run     func(c *Case) error
+	// Fatal steps stop adbclean when they fail.
+	Fatal bool
+}
+
+// cleanSteps are the actions adbclean can take, in the order they run.
+var cleanSteps = []cleanStep{
+	{Name: "batterystats", Description: "Reset battery stats history", Command: []string{"dumpsys", "batterystats", "--reset"}},
+	{Name: "procstats", Description: "Clear process stats", Command: []string{"dumpsys", "procstats", "--clear"}},
+	{Name: "statsd_puller_cache", Description: "Clear statsd puller cache", Command: []string{"cmd", "stats", "clear-puller-cache"}},
+	{Name: "logcat", Description: "Clear logcat ring buffers", Command: []string{"logcat", "-b", "all", "-c"}, Fatal: true},
+	{Name: "adb_key", Description: "Revoke the case's ADB key on the device and delete the analyst-side copy", run: func(c *Case) error {
+		revokeDeviceADBKeys(c, adbcleanArgs.revokeAll)
+		// The adb server keeps the loaded key in memory, so the current
+		// connection survives for adbdisable even though the key is gone.
+		return deleteCaseADBKey(c, false)
+	}},
+}
+
+// cleanReport is the record of an adbclean run written to the case folder.
+type cleanReport struct {
+	Time        time.Time       `json:"time"`
+	Serial      string          `json:"serial"`
+	Acquisition string          `json:"acquisition,omitempty"`
+	Forced      bool            `json:"forced,omitempty"`
+	Steps       []cleanStepDone `json:"steps"`
+}
+
+type cleanStepDone struct {
+	Name    string `json:"name"`
+	Command string `json:"command,omitempty"`
+	Status  string `json:"status"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
 func AdbcleanCmd() *ffcli.Command {
 	fs := flag.NewFlagSet("adbclean", flag.ContinueOnError)
 	fs.StringVar(&adbcleanArgs.serial, "serial", "", "Device serial number")
+	fs.StringVar(&adbcleanArgs.caseDir, "case", "", "case whose ADB key to revoke (default: $"+caseEnv+" or the current case)")
+	fs.StringVar(&adbcleanArgs.steps, "steps", "", "comma-separated steps to run (default: all); see --help")
+	fs.BoolVar(&adbcleanArgs.dryRun, "dry-run", false, "list the planned steps without changing the device")
+	fs.BoolVar(&adbcleanArgs.force, "force", false, "run even if the case has no completed acquisition of this device")
+	fs.BoolVar(&adbcleanArgs.revokeAll, revokeAllADBKeysFlag, false, "in the adb_key step, revoke every host's ADB authorization, including the device owner's (destructive)")
+
+	var names []string
+	for _, s := range cleanSteps {
+		names = append(names, fmt.Sprintf("  %-20s %s", s.Name, s.Description))
+	}
 
 	return &ffcli.Command{
 		Name:       "adbclean",
@@ -26,60 +91,209 @@ func AdbcleanCmd() *ffcli.Command {
 		ShortHelp:  "Clears as much logging as possible from the session",
 		LongHelp: `In situations where you want to clean up after a session (for removing traces of forensics in case of seizure), adbclean will clear the logcat ring buffers and reset shell-accessible telemetry counters.
 
-[IMPORTANT] This should only be used AFTER a forensics backup. If used before, you will tamper with evidence.
+[IMPORTANT] This should only be used AFTER a forensics backup. If used before, you will tamper with evidence. adbclean therefore refuses to run unless the case log records a completed acquisition of the same device with no failed modules. MESH devices are recognised by their node key or MESH address, since the wireless debugging port changes when wireless debugging restarts; --force overrides this, for instance when the backup was taken with another tool, and is recorded in the case log.
+
+This is best-effort scrub of shell-accessible state only. The case's ADB key is removed from adb_keys where that file is writable (root or debuggable builds) and the analyst-side copy is deleted; --revoke-all-adb-keys instead deletes adb_keys and sets adb_allowed_connection_time to 1ms, which also revokes the hosts the device owner trusts and leaves that setting changed. Wireless debugging history and any root-only logs (tombstones, dropbox, pstore) are NOT removed and remain recoverable by a forensic examiner.
+
+Steps, in the order they run (select with --steps):
+` + strings.Join(names, "\n") + `
 
-This is best-effort scrub of shell-accessible state only. Paired ADB key, wireless debugging history, and any root-only logs (tombstones, dropbox, pstore) are NOT removed and remain recoverable by a forensic examiner — only factory reset clears the paired-keys store.
+--dry-run lists the steps that would run, with their commands, and checks for the acquisition without touching the device. Otherwise the outcome of each step is written as JSON to adbclean-<time>.json in the case folder and recorded in the case log.
 
 Examples:
   mesh adbclean
   mesh adbclean --serial devicename
+  mesh adbclean --dry-run
+  mesh adbclean --steps logcat,adb_key
 `,
 		FlagSet: fs,
 		Exec:    runcleanCmd,
 	}
 }
 
+// selectCleanSteps returns the steps named in list, in run order.
+func selectCleanSteps(list string) ([]cleanStep, error) {
+	want := splitList(list)
+	if len(want) == 0 {
+		return cleanSteps, nil
+	}
+	for _, w := range want {
+		if !slices.ContainsFunc(cleanSteps, func(s cleanStep) bool { return s.Name == w }) {
+			return nil, fmt.Errorf("unknown step %q", w)
+		}
+	}
+	var steps []cleanStep
+	for _, s := range cleanSteps {
+		if slices.Contains(want, s.Name) {
+			steps = append(steps, s)
+		}
+	}
+	return steps, nil
+}
+
+// completedAcquisition returns the path of the last acquisition of device
+// that the case log records as completed with no failed modules.
+func completedAcquisition(c *Case, device deviceMetadata) (string, error) {
+	if c == nil {
+		return "", errors.New("no case selected")
+	}
+	entries, err := readCaseLog(c.logPath())
+	if err != nil {
+		return "", fmt.Errorf("unable to read case log: %w", err)
+	}
+	var path string
+	var incomplete []string
+	for _, e := range entries {
+		if e.Event != "acquisition_completed" {
+			continue
+		}
+		var d struct {
+			Path          string   `json:"path"`
+			Serial        string   `json:"serial"`
+			NodeKey       string   `json:"node_key"`
+			TailscaleIPs  []string `json:"tailscale_ips"`
+			FailedModules *int     `json:"failed_modules"`
+		}
+		if json.Unmarshal(e.Details, &d) != nil || !sameDevice(device, d.Serial, d.NodeKey, d.TailscaleIPs) {
+			continue
+		}
+		if d.FailedModules == nil || *d.FailedModules != 0 {
+			incomplete = append(incomplete, d.Path)
+			continue
+		}
+		path = d.Path
+	}
+	if path == "" && len(incomplete) > 0 {
+		return "", fmt.Errorf("case %s has acquisitions of %s only with failed modules: %s", c.ID, device.Serial, strings.Join(incomplete, ", "))
+	}
+	if path == "" {
+		return "", fmt.Errorf("case %s has no completed acquisition of %s", c.ID, device.Serial)
+	}
+	return path, nil
+}
+
+// sameDevice reports whether a recorded acquisition was of device. The
+// wireless debugging port changes whenever wireless debugging restarts, so
+// MESH devices are matched on their node key, or failing that on their
+// MESH address; other serials must match exactly.
+func sameDevice(device deviceMetadata, serial, nodeKey string, ips []string) bool {
+	if device.NodeKey != "" && nodeKey != "" {
+		return device.NodeKey == nodeKey
+	}
+	host, _, err := net.SplitHostPort(device.Serial)
+	if err != nil {
+		return device.Serial == serial
+	}
+	if recorded, _, err := net.SplitHostPort(serial); err == nil && recorded == host {
+		return true
+	}
+	return slices.Contains(ips, host)
+}
+
 func runcleanCmd(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	steps, err := selectCleanSteps(adbcleanArgs.steps)
+	if err != nil {
+		return err
+	}
+
 	adbClient, err := adb.New()
 	if err != nil {
 		return fmt.Errorf("impossible to initialize ADB: %v", err)
 	}
 	adb.Client = adbClient
-	if adbcleanArgs.serial != "" {
-		adb.Client.Serial = adbcleanArgs.serial
+	serial, err := adb.Client.SetSerial(adbcleanArgs.serial)
+	if err != nil {
+		return fmt.Errorf("unable to select device: %w", err)
 	}
 
-	fmt.Printf("Resetting battery stats history\n")
-	out, err := adb.Client.Shell("dumpsys", "batterystats", "--reset")
+	c, err := openCase(adbcleanArgs.caseDir, false)
 	if err != nil {
-		fmt.Printf("failed to reset batterystats (continuing): %v\n", err)
-	} else {
-		fmt.Printf("batterystats reset: %s\n", out)
+		return err
 	}
 
-	fmt.Printf("Clearing process stats\n")
-	out, err = adb.Client.Shell("dumpsys", "procstats", "--clear")
-	if err != nil {
-		fmt.Printf("failed to clear procstats (continuing): %v\n", err)
-	} else {
-		fmt.Printf("procstats cleared: %s\n", out)
+	report := cleanReport{Time: time.Now().UTC(), Serial: serial}
+	acqPath, guardErr := completedAcquisition(c, collectDeviceMetadata(ctx, serial))
+	switch {
+	case guardErr == nil:
+		report.Acquisition = acqPath
+		fmt.Printf("Found completed acquisition of %s: %s\n", serial, acqPath)
+	case adbcleanArgs.force:
+		report.Forced = true
+		fmt.Printf("WARNING: %v; continuing because of --force\n", guardErr)
+	case !adbcleanArgs.dryRun:
+		return fmt.Errorf("refusing to clean %s, it may destroy evidence: %w (run adbcollect first, or use --force)", serial, guardErr)
+	default:
+		fmt.Printf("WARNING: %v; adbclean will refuse to run without --force\n", guardErr)
 	}
 
-	fmt.Printf("Clearing statsd puller cache\n")
-	out, err = adb.Client.Shell("cmd", "stats", "clear-puller-cache")
-	if err != nil {
-		fmt.Printf("failed to clear statsd puller cache (continuing): %v\n", err)
-	} else {
-		fmt.Printf("statsd puller cache cleared: %s\n", out)
+	if adbcleanArgs.dryRun {
+		fmt.Printf("Planned steps for %s (dry run, nothing is changed):\n", serial)
+		for i, s := range steps {
+			fmt.Printf("  %d. %-20s %s\n", i+1, s.Name, s.Description)
+			if len(s.Command) > 0 {
+				fmt.Printf("     adb -s %s shell %s\n", serial, strings.Join(s.Command, " "))
+			}
+		}
+		return nil
 	}
 
-	fmt.Printf("Clearing logcat ring buffers\n")
-	out, err = adb.Client.Shell("logcat", "-b", "all", "-c")
-	if err != nil {
-		return fmt.Errorf("failed to run `adb shell logcat -b all -c`: %v", err)
+	var failed error
+	for _, s := range steps {
+		done := cleanStepDone{Name: s.Name, Command: strings.Join(s.Command, " ")}
+		fmt.Printf("%s\n", s.Description)
+		var out string
+		if s.run != nil {
+			err = s.run(c)
+		} else {
+			out, err = adb.Client.Shell(s.Command...)
+		}
+		done.Output = strings.TrimSpace(out)
+		if err != nil {
+			done.Status, done.Error = statusFailed, err.Error()
+			fmt.Printf("%s failed: %v\n", s.Name, err)
+		} else {
+			done.Status = statusSucceeded
+			if done.Output != "" {
+				fmt.Printf("%s: %s\n", s.Name, done.Output)
+			}
+		}
+		report.Steps = append(report.Steps, done)
+		logCase(c, "adb_clean", stepDetails(err, map[string]any{"step": s.Name, "serial": serial}))
+		if err != nil && s.Fatal {
+			failed = fmt.Errorf("failed to run `adb shell %s`: %v", done.Command, err)
+			break
+		}
 	}
-	fmt.Printf("logcat cleared: %s\n", out)
 
+	if err := writeCleanReport(c, &report); err != nil {
+		fmt.Printf("WARNING: unable to write the adbclean report: %v\n", err)
+	}
+	if failed != nil {
+		return failed
+	}
 	fmt.Printf("adbclean complete. Root-only artifacts remain — see --help.\n")
 	return nil
 }
+
+// writeCleanReport saves the report in the case folder and records it in
+// the case log. Without a case it is printed instead.
+func writeCleanReport(c *Case, report *cleanReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		fmt.Printf("%s\n", b)
+		return nil
+	}
+	path := filepath.Join(c.Dir, "adbclean-"+report.Time.Format("20060102-150405")+".json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("adbclean report written to %s\n", path)
+	logCase(c, "adb_clean_report", map[string]any{"path": path, "report": report})
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompletedAcquisition(t *testing.T) {
+	c := testCase(t)
+	for _, d := range []map[string]any{
+		{"path": "/acq/usb", "serial": "R58M123", "failed_modules": 0},
+		{"path": "/acq/failed", "serial": "100.64.0.7:40123", "node_key": "nodekey:bb", "tailscale_ips": []string{"100.64.0.7"}, "failed_modules": 2},
+		{"path": "/acq/mesh", "serial": "100.64.0.5:40123", "node_key": "nodekey:aa", "tailscale_ips": []string{"100.64.0.5"}, "failed_modules": 0},
+		{"path": "/acq/old", "serial": "100.64.0.9:37001"},
+	} {
+		if err := c.Log("acquisition_completed", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		device deviceMetadata
+		want   string
+		err    string
+	}{
+		{name: "usb", device: deviceMetadata{Serial: "R58M123"}, want: "/acq/usb"},
+		{name: "node-key-new-port", device: deviceMetadata{Serial: "100.64.0.5:45555", NodeKey: "nodekey:aa"}, want: "/acq/mesh"},
+		{name: "mesh-ip-new-port", device: deviceMetadata{Serial: "100.64.0.5:45555"}, want: "/acq/mesh"},
+		{name: "node-key-differs", device: deviceMetadata{Serial: "100.64.0.5:45555", NodeKey: "nodekey:cc"}, err: "no completed acquisition"},
+		{name: "failed-modules", device: deviceMetadata{Serial: "100.64.0.7:45555", NodeKey: "nodekey:bb"}, err: "failed modules"},
+		{name: "failed-modules-unknown", device: deviceMetadata{Serial: "100.64.0.9:37001"}, err: "failed modules"},
+		{name: "other-usb", device: deviceMetadata{Serial: "R58M999"}, err: "no completed acquisition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := completedAcquisition(c, tt.device)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, %v; want error containing %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
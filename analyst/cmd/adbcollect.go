@@ -10,13 +10,13 @@
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/BARGHEST-ngo/androidqf_mesh/acquisition"
-	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
 	"github.com/BARGHEST-ngo/androidqf_mesh/log"
 	"github.com/BARGHEST-ngo/androidqf_mesh/modules"
 	"github.com/BARGHEST-ngo/androidqf_mesh/utils"
@@ -24,23 +24,33 @@
 )
 
 var adbcollectArgs struct {
-	verbose bool
-	fast    string
-	list    string
-	module  string
-	output  string
-	serial  string
-	version bool
+	verbose  bool
+	list     bool
+	serial   string
+	resume   string
+	events   string
+	caseDir  string
+	allPeers bool
+	peers    string
+	parallel int
+	noPair   bool
+	version  bool
+	acq      acquisitionFlags
 }
 
 func AdbcollectCmd() *ffcli.Command {
 	fs := flag.NewFlagSet("adbcollect", flag.ContinueOnError)
 	fs.BoolVar(&adbcollectArgs.verbose, "verbose", false, "Enable verbose output")
-	fs.StringVar(&adbcollectArgs.fast, "fast", "", "Fast mode (skip some checks)")
-	fs.StringVar(&adbcollectArgs.list, "list", "", "List available modules")
-	fs.StringVar(&adbcollectArgs.module, "module", "", "Specific module to run")
-	fs.StringVar(&adbcollectArgs.output, "output", "", "Output directory for collected data")
+	fs.BoolVar(&adbcollectArgs.list, "list", false, "List available modules and profiles")
+	adbcollectArgs.acq.register(fs)
+	fs.BoolVar(&adbcollectArgs.allPeers, "all-android-peers", false, "Pair with and acquire every Android MESH peer, in parallel")
+	fs.StringVar(&adbcollectArgs.peers, "peers", "", "With --all-android-peers, only these comma-separated peers (hostname, MagicDNS name or MESH IP)")
+	fs.IntVar(&adbcollectArgs.parallel, "parallel", defaultParallel, "With --all-android-peers, how many devices to acquire at once")
+	fs.BoolVar(&adbcollectArgs.noPair, "no-pair", false, "With --all-android-peers, only acquire peers already connected over ADB")
+	fs.StringVar(&adbcollectArgs.caseDir, "case", "", "Case to record the acquisition in (default: $"+caseEnv+", the current case, or a new case)")
 	fs.StringVar(&adbcollectArgs.serial, "serial", "", "Device serial number")
+	fs.StringVar(&adbcollectArgs.resume, "resume", "", "Resume an interrupted acquisition from its folder")
+	fs.StringVar(&adbcollectArgs.events, "progress-json", "", "Write newline-delimited JSON progress events to a file, or \"-\" for stdout")
 	fs.BoolVar(&adbcollectArgs.version, "version", false, "Show version information")
 
 	return &ffcli.Command{
@@ -53,6 +63,42 @@ func AdbcollectCmd() *ffcli.Command {
   mesh adbcollect
   mesh adbcollect --output /path/to/output
   mesh adbcollect --module BackupTar
+  mesh adbcollect --modules getprop,settings,packages
+  mesh adbcollect --profile triage
+  mesh adbcollect --profile full --exclude BackupTar
+  mesh adbcollect --resume /path/to/acquisition
+  mesh adbcollect --timeout 3h
+  mesh adbcollect --timeout auto
+  mesh adbcollect --all-android-peers --profile triage --output /cases/batch
+
+Profiles are named module selections. The built-in profiles are "full", "no-backup" and "triage"; more can be defined (or the built-in ones overridden) in a JSON file such as:
+
+  {
+    "quick": {
+      "description": "settings and packages only",
+      "include": ["settings", "packages"],
+      "exclude": [],
+      "fast": true
+    }
+  }
+
+With --progress-json, adbcollect emits one JSON object per line for acquisition_estimate (with the estimated bytes and duration_ms), acquisition_started, module_started, module_skipped, module_finished (with duration_ms, bytes and error), acquisition_complete and acquisition_failed. Every event carries a schema version "v". With "-", events go to stdout and the regular output moves to stderr.
+
+When a profile is combined with --modules, --modules replaces the profile's includes and --exclude adds to its excludes. The selection is validated against the available modules before the acquisition starts.
+
+The acquisition is aborted after --timeout (60 minutes by default); modules cannot be interrupted, so the limit is checked between modules. An acquisition stopped this way can be resumed. Ctrl-C or SIGTERM stops it at once instead: the running module is abandoned and marked interrupted in the progress manifest (` + progressFile + `), module_finished (with status "interrupted") and acquisition_failed are emitted, the interruption is recorded in the case log, and the acquisition can be resumed.
+
+Before the acquisition starts, adbcollect streams 2 MiB of random data from the device (read from /dev/urandom, nothing is written to the device) to measure the throughput over the current path, and estimates the size of the selected modules (the installed apps are sized on the device, other modules from typical sizes). It prints the estimated time and warns when it exceeds --timeout. With --timeout auto, the timeout is derived from the estimate instead (twice the estimate plus 10 minutes, at least 15 minutes). --no-estimate skips the measurement; --timeout auto then falls back to 60 minutes.
+
+The acquisition is recorded in the case log (see "mesh case"): the modules run, their outcome and the final hash list.
+
+Before the acquisition is encrypted, a manifest (` + manifestFile + `) listing every output file with its hash, together with the device's MESH identity (node key, MESH IPs, hostname, OS version) and ADB properties, is written and signed with the analyst key. Check it later with "mesh verify".
+
+With --all-android-peers, adbcollect works on every Android MESH peer (or those listed in --peers; a peer named twice is acquired once). Peers that are not connected over ADB are paired one after the other, each with a new case (which does not become the current case) and its own ADB key, so the analyst enters each device's pairing code in turn; the adb server is then restarted once with all keys. The acquisitions run in parallel (--parallel at a time), each in its own adbcollect process, into <output>/<hostname>_<ip>, with the process output in <hostname>_<ip>.log and progress events in <hostname>_<ip>.events.jsonl next to it.
+
+Before acquiring a device connected over MESH, adbcollect checks that it is the MESH peer it claims to be (see "mesh adbpair --help") and records the comparison in ` + bindingFile + `; use --allow-identity-mismatch to acquire anyway.
+
+If the connection to the device drops during an acquisition, the acquisition folder is kept unfinalized together with a progress manifest (` + progressFile + `). Run adbcollect again with --resume and the folder to reconnect, skip the modules that already completed and re-run only the failed or interrupted ones.
 `,
 		FlagSet: fs,
 		Exec:    runcollectCmd,
@@ -60,114 +106,79 @@ func AdbcollectCmd() *ffcli.Command {
 }
 
 func runcollectCmd(ctx context.Context, args []string) error {
-	//(ov) my experience is generally it shouldn't take more than 60 minutes.
-	//we should verify this with user feedback
-	ctx, cancel := context.WithTimeout(ctx, 60*time.Minute)
-	defer cancel()
-
 	if len(args) > 0 {
 		return fmt.Errorf("unexpected arguments: %v", args)
 	}
 
+	closeEvents, err := openEvents(adbcollectArgs.events)
+	if err != nil {
+		return fmt.Errorf("unable to open progress output: %w", err)
+	}
+	defer closeEvents()
+
+	// Stop on Ctrl-C or SIGTERM through ctx, so that the acquisition
+	// records the interruption and the deferred calls run.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	if adbcollectArgs.verbose {
 		log.SetLogLevel(log.DEBUG)
 	}
 	if adbcollectArgs.version {
 		log.Infof("AndroidQF version: %s", utils.Version)
 		// include WARD version
-		os.Exit(0)
+		return nil
 	}
 
-	if adbcollectArgs.list != "" {
+	if adbcollectArgs.list {
+		profiles, err := loadProfiles(adbcollectArgs.acq.profiles)
+		if err != nil {
+			return err
+		}
 		mods := modules.List()
 		log.Info("List of modules:")
 		// include WARD modules if not combined with AndroidQF
 		for _, mod := range mods {
 			log.Infof("- %s", mod.Name())
 		}
-		os.Exit(0)
-	}
-
-	log.Debug("Starting androidqf")
-	adbClient, err := adb.New()
-	if err != nil {
-		log.Fatal("Impossible to initialize ADB: ", err)
-	}
-
-	adb.Client = adbClient
-
-	for {
-		adbcollectArgs.serial, err = adbClient.SetSerial(adbcollectArgs.serial)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error trying to connect over ADB: %s", err))
-
-		} else {
-
-			_, err = adbClient.GetState()
-			if err == nil {
-				break
-			}
-			log.Debug(err)
-			log.Error("Unable to get device state. Please make sure it is connected and authorized. Trying again in 5 seconds...")
-		}
-		select {
-		case <-time.After(5 * time.Second):
-		case <-ctx.Done():
-			return ctx.Err()
+		log.Info("List of profiles:")
+		for _, name := range sortedProfileNames(profiles) {
+			log.Infof("- %s: %s", name, profiles[name].Description)
 		}
+		return nil
 	}
 
-	acq, err := acquisition.New(adbcollectArgs.output)
-	if err != nil {
-		log.Debug(err)
-		log.FatalExc("Impossible to initialise the acquisition", err)
-	}
-
-	// Start acquisitions
-	log.Info(fmt.Sprintf("Started new acquisition in %s", acq.StoragePath))
-
-	mods := modules.List()
-	for _, mod := range mods {
-		if (adbcollectArgs.module != "") && (adbcollectArgs.module != mod.Name()) {
-			continue
+	if adbcollectArgs.allPeers {
+		if adbcollectArgs.resume != "" || adbcollectArgs.serial != "" || adbcollectArgs.caseDir != "" {
+			return errors.New("--all-android-peers cannot be combined with --resume, --serial or --case")
 		}
-		err = mod.InitStorage(acq.StoragePath)
+		opts, err := adbcollectArgs.acq.options("")
 		if err != nil {
-			log.Infof(
-				"ERROR: failed to initialize storage for module %s: %v",
-				mod.Name(),
-				err,
-			)
-			continue
-		}
-
-		err = mod.Run(acq, adbcollectArgs.fast != "")
-		if err != nil {
-			log.Infof("ERROR: failed to run module %s: %v", mod.Name(), err)
+			return err
 		}
+		return runAllPeers(ctx, opts)
 	}
 
-	if acq.StreamingMode {
-		// In streaming mode, all data is already encrypted in the zip stream
-		log.Info("Finalizing encrypted acquisition...")
-	} else {
-		// Traditional mode: hash files, then encrypt if key exists
-		err = acq.HashFiles()
+	opts := acquisitionOptions{
+		Serial:  adbcollectArgs.serial,
+		Resume:  adbcollectArgs.resume,
+		Timeout: adbcollectArgs.acq.timeout,
+
+		AutoTimeout:   adbcollectArgs.acq.autoTimeout,
+		NoEstimate:    adbcollectArgs.acq.noEstimate,
+		AllowMismatch: adbcollectArgs.acq.allowMismatch,
+	}
+	if adbcollectArgs.resume == "" {
+		opts, err = adbcollectArgs.acq.options(adbcollectArgs.serial)
 		if err != nil {
-			log.ErrorExc("Failed to generate list of file hashes", err)
 			return err
 		}
+	}
 
-		acq.StoreInfo()
-
-		err = acq.StoreSecurely()
-		if err != nil {
-			log.ErrorExc("Something failed while encrypting the acquisition", err)
-			log.Warning("WARNING: The secure storage of the acquisition folder failed! The data is unencrypted!")
-		}
+	opts.Case, err = openCase(adbcollectArgs.caseDir, true)
+	if err != nil {
+		return err
 	}
 
-	acq.Complete()
-	log.Info("Acquisition completed.")
-	return nil
+	return runAcquisition(ctx, opts)
 }
@@ -7,7 +7,11 @@
 	"context"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"slices"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
@@ -15,12 +19,16 @@
 )
 
 var adbdisableArgs struct {
-	serial string
+	serial    string
+	caseDir   string
+	revokeAll bool
 }
 
 func AdbdisableCmd() *ffcli.Command {
 	fs := flag.NewFlagSet("adbdisable", flag.ContinueOnError)
 	fs.StringVar(&adbdisableArgs.serial, "serial", "", "serial of the device")
+	fs.StringVar(&adbdisableArgs.caseDir, "case", "", "case whose ADB key to revoke (default: $"+caseEnv+" or the current case)")
+	fs.BoolVar(&adbdisableArgs.revokeAll, revokeAllADBKeysFlag, false, "revoke every host's ADB authorization, including the device owner's (destructive)")
 
 	return &ffcli.Command{
 		Name:       "adbdisable",
@@ -28,6 +36,8 @@ func AdbdisableCmd() *ffcli.Command {
 		ShortHelp:  "The ADB disable utility disables the developer mode on the Android node",
 		LongHelp: `Since leaving ADB developer mode open is dangerous in light of non-consensual forensics, the ADB disable utility allows an analyst to disable developer mode entirely on the android node they are analyzing.
 
+Only the device selected with --serial (or the only connected device) is touched. Before disabling, adbdisable removes the case's ADB key from the device's adb_keys as far as the shell permits (root or debuggable builds only). --revoke-all-adb-keys instead deletes adb_keys and sets adb_allowed_connection_time to 1ms; this also revokes the hosts the device owner trusts and leaves the setting changed, so its previous value is printed and logged for the owner to restore. It then turns off development_settings_enabled, adb_enabled and adb_wifi_enabled one at a time, reading each back; a setting that cannot be read back because adbd already dropped the connection is reported as unverified. Finally it confirms from the MESH side, before disconnecting, that the device has left the adb server, that its wireless debugging port refuses connections and that it no longer advertises wireless debugging over mDNS; a device whose mDNS responder does not answer at all is reported as not verified rather than passed. A report lists each setting's previous and new value and each check's result, and is recorded in the case log. Only when no check fails is the analyst-side copy of the case key deleted and the adb server stopped.
+
 Examples:
   mesh adbdisable
   mesh adbdisable --serial devicename
@@ -37,81 +47,239 @@ func AdbdisableCmd() *ffcli.Command {
 	}
 }
 
-func triggerDeveloperModeCheck() {
-	checkADBClient()
-	adb.Client.Shell("am", "start", "-a", "android.settings.APPLICATION_DEVELOPMENT_SETTINGS")
-	time.Sleep(1 * time.Second)
+// disableSettings are the global settings adbdisable turns off, in order.
+// development_settings_enabled goes first while the connection is surely
+// still up. Turning off adb_enabled or adb_wifi_enabled stops adbd and with
+// it the connection we are using, so each is written on its own, wireless
+// debugging last since that is what MESH connections use.
+var disableSettings = []string{
+	"development_settings_enabled",
+	"adb_enabled",
+	"adb_wifi_enabled",
 }
 
-func validateDisable() error {
-	checkADBClient()
-	fmt.Printf("Validating ADB disablement...\n")
+// settingChange is one line of the adbdisable report.
+type settingChange struct {
+	Setting  string `json:"setting"`
+	Previous string `json:"previous"`
+	Value    string `json:"value"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
 
-	const maxRetries = 10
-	const retryDelay = 2 * time.Second
+// portCheck is a post-disable check made from the MESH side.
+type portCheck struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Unverified is set when the check could not be made; it has not
+	// passed, but does not show that ADB is still enabled either.
+	Unverified bool   `json:"unverified,omitempty"`
+	Detail     string `json:"detail"`
+}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		time.Sleep(retryDelay)
+const (
+	disablePollAttempts = 10
+	disablePollDelay    = 2 * time.Second
+	disableDialTimeout  = 2 * time.Second
+)
 
-		devices, err := adb.Client.Devices()
+func runadbdisable(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	adbClient, err := adb.New()
+	if err != nil {
+		return fmt.Errorf("impossible to initialize ADB: %v", err)
+	}
+	adb.Client = adbClient
+
+	// Every shell command below goes to this device only.
+	serial, err := adb.Client.SetSerial(adbdisableArgs.serial)
+	if err != nil {
+		return fmt.Errorf("unable to select device: %w", err)
+	}
+	if _, err := adb.Client.GetState(); err != nil {
+		return fmt.Errorf("device %s is not connected: %w", serial, err)
+	}
+	fmt.Printf("Disabling ADB on Android device %s\n", serial)
+
+	c, err := openCase(adbdisableArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	revokeDeviceADBKeys(c, adbdisableArgs.revokeAll)
+
+	changes := make([]*settingChange, len(disableSettings))
+	for i, name := range disableSettings {
+		prev, err := adb.Client.Shell("settings", "get", "global", name)
 		if err != nil {
-			return fmt.Errorf("unable to get devices: %w", err)
+			prev = "unknown"
 		}
+		changes[i] = &settingChange{Setting: name, Previous: strings.TrimSpace(prev), Value: "0"}
+	}
 
-		if len(devices) == 0 {
-			fmt.Printf("ADB disablement successful - no devices connected\n")
-			return nil
-		}
+	changes[0].apply(false)
+	if changes[0].Result != "changed" {
+		printDisableReport(changes, nil)
+		logDisable(c, serial, changes, nil)
+		return fmt.Errorf("failed to turn off %s: %s", disableSettings[0], changes[0].Error)
+	}
+	for _, ch := range changes[1:] {
+		ch.apply(true)
+	}
 
-		var targetDevice string
-		for _, d := range devices {
-			if adbdisableArgs.serial == "" || strings.Contains(d, adbdisableArgs.serial) {
-				targetDevice = d
-				break
-			}
+	// The device must leave the adb server on its own; disconnecting
+	// first would make that check pass regardless.
+	checks := verifyDisabled(ctx, serial)
+	if err := disconnect(serial); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+	printDisableReport(changes, checks)
+	logDisable(c, serial, changes, checks)
+
+	for _, chk := range checks {
+		if !chk.Passed && !chk.Unverified {
+			return fmt.Errorf("ADB does not appear to be disabled: %s: %s", chk.Check, chk.Detail)
 		}
+	}
+	if err := deleteCaseADBKey(c, true); err != nil {
+		return err
+	}
+	fmt.Printf("ADB disable process complete.\n")
+	return nil
+}
 
-		if targetDevice == "" {
-			fmt.Printf("ADB disablement successful - device not found\n")
-			return nil
+// apply writes 0 to the setting and reads it back. When dropMayFail is
+// set, adbd may stop as the setting takes effect and take our connection
+// with it; a write or read-back that fails then leaves the setting
+// unverified rather than failed, and the MESH-side checks decide.
+func (ch *settingChange) apply(dropMayFail bool) {
+	if _, err := adb.Client.Shell("settings", "put", "global", ch.Setting, ch.Value); err != nil {
+		ch.Error = err.Error()
+		ch.Result = "failed"
+		if dropMayFail {
+			ch.Result = "unverified (connection closed by device)"
 		}
+		return
+	}
+	got, err := adb.Client.Shell("settings", "get", "global", ch.Setting)
+	switch {
+	case err != nil:
+		ch.Result = "unverified (connection closed by device)"
+		ch.Error = "unable to read back: " + err.Error()
+	case strings.TrimSpace(got) != ch.Value:
+		ch.Result = "failed"
+		ch.Error = "reads back as " + strings.TrimSpace(got)
+	default:
+		ch.Result = "changed"
+	}
+}
 
-		adb.Client.Serial = targetDevice
-		state, err := adb.Client.GetState()
+// verifyDisabled checks that the device is gone from the adb server and,
+// for wireless connections, that the debug port no longer accepts
+// connections and no wireless debugging service is advertised over MESH.
+func verifyDisabled(ctx context.Context, serial string) []portCheck {
+	checkADBClient()
+	fmt.Printf("Validating ADB disablement...\n")
 
-		if err != nil || state == "offline" {
-			fmt.Printf("ADB disablement successful - device is offline\n")
-			return nil
+	var checks []portCheck
+	gone := portCheck{Check: "adb_device_gone", Detail: "device still listed by the adb server"}
+	for attempt := 1; attempt <= disablePollAttempts; attempt++ {
+		devices, err := adb.Client.Devices()
+		if err == nil && !slices.Contains(devices, serial) {
+			gone.Passed, gone.Detail = true, "device no longer listed by the adb server"
+			break
 		}
-
-		if attempt == 1 {
-			triggerDeveloperModeCheck()
+		if err == nil {
+			adb.Client.Serial = serial
+			if state, err := adb.Client.GetState(); err != nil || state == "offline" {
+				gone.Passed, gone.Detail = true, "device is offline"
+				break
+			}
 		}
+		fmt.Printf("Validating disablement (attempt %d/%d)...\n", attempt, disablePollAttempts)
+		time.Sleep(disablePollDelay)
+	}
+	checks = append(checks, gone)
+
+	host, port, err := net.SplitHostPort(serial)
+	if err != nil {
+		fmt.Printf("%s is not a wireless connection, skipping MESH-side port checks\n", serial)
+		return checks
+	}
 
-		fmt.Printf("Validating disablement (attempt %d/%d)...\n", attempt, maxRetries)
+	closed := portCheck{Check: "debug_port_closed", Detail: "port " + port + " still accepts connections"}
+	for attempt := 1; attempt <= disablePollAttempts; attempt++ {
+		conn, err := net.DialTimeout("tcp", serial, disableDialTimeout)
+		if err != nil {
+			closed.Passed, closed.Detail = true, "port "+port+" refuses connections"
+			break
+		}
+		conn.Close()
+		time.Sleep(disablePollDelay)
 	}
+	checks = append(checks, closed)
 
-	return fmt.Errorf("validation timeout: device still connected after %d attempts", maxRetries)
+	checks = append(checks, mdnsCheck(browseADBServices(ctx, host, mdnsTimeout)))
+	return checks
 }
 
-func runadbdisable(ctx context.Context, args []string) error {
-	adbClient, err := adb.New()
-	if err != nil {
-		return fmt.Errorf("impossible to initialize ADB: %v", err)
+// mdnsCheck judges the outcome of browsing the device's mDNS services. Only
+// a responder that answered without ADB services shows they are gone; an
+// error or silence leaves it open.
+func mdnsCheck(ports adbPorts, err error) portCheck {
+	chk := portCheck{Check: "no_mdns_service"}
+	switch {
+	case len(ports.pair) > 0 || len(ports.connect) > 0:
+		chk.Detail = fmt.Sprintf("still advertising pairing %v / debug %v", ports.pair, ports.connect)
+	case err != nil:
+		chk.Unverified, chk.Detail = true, "mDNS not answering: "+err.Error()
+	case !ports.answered:
+		chk.Unverified, chk.Detail = true, "no mDNS response from the device"
+	default:
+		chk.Passed, chk.Detail = true, "mDNS answered without wireless debugging services"
 	}
-	adb.Client = adbClient
-	fmt.Printf("Disabling ADB on Android device\n")
-	out, err := adb.Client.Shell("settings", "put", "global", "development_settings_enabled", "0")
-	if err != nil {
-		return fmt.Errorf("failed to run `adb shell settings put global development_settings_enabled 0`: %v", err)
-	}
-	fmt.Printf("ADB disabled: %s\n", out)
-	if err := validateDisable(); err != nil {
-		return err
+	return chk
+}
+
+func printDisableReport(changes []*settingChange, checks []portCheck) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tPREVIOUS\tNEW\tRESULT")
+	for _, ch := range changes {
+		result := ch.Result
+		if ch.Error != "" {
+			result += ": " + ch.Error
+		}
+		if result == "" {
+			result = "not attempted"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ch.Setting, sanitizeForTerminal(ch.Previous), ch.Value, result)
 	}
-	if err := disconnect(""); err != nil {
-		return fmt.Errorf("failed to disconnect devices after ADB disable: %v", err)
+	w.Flush()
+	if len(checks) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAIL")
+		for _, chk := range checks {
+			result := "PASS"
+			switch {
+			case chk.Unverified:
+				result = "NOT VERIFIED"
+			case !chk.Passed:
+				result = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", chk.Check, result, sanitizeForTerminal(chk.Detail))
+		}
+		w.Flush()
 	}
-	fmt.Printf("All devices disconnected. ADB disable process complete.\n")
-	return nil
+	fmt.Println()
+}
+
+func logDisable(c *Case, serial string, changes []*settingChange, checks []portCheck) {
+	logCase(c, "adb_disable", map[string]any{
+		"serial":   serial,
+		"settings": changes,
+		"checks":   checks,
+	})
 }
@@ -0,0 +1,33 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMDNSCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		ports      adbPorts
+		err        error
+		passed     bool
+		unverified bool
+	}{
+		{name: "answered-without-adb", ports: adbPorts{answered: true}, passed: true},
+		{name: "silent", unverified: true},
+		{name: "read-error", err: errors.New("connection refused"), unverified: true},
+		{name: "pairing", ports: adbPorts{pair: []int{37000}, answered: true}},
+		{name: "debug", ports: adbPorts{connect: []int{41000}, answered: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chk := mdnsCheck(tt.ports, tt.err)
+			if chk.Passed != tt.passed || chk.Unverified != tt.unverified {
+				t.Errorf("passed %v, unverified %v; want %v, %v (%s)", chk.Passed, chk.Unverified, tt.passed, tt.unverified, chk.Detail)
+			}
+		})
+	}
+}
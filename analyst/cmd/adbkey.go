@@ -0,0 +1,146 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/BARGHEST-ngo/MESH/analyst/adbwifi"
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+)
+
+// deviceADBKeysFile is where adbd keeps the keys it trusts. Only root can
+// modify it, so editing it succeeds on rooted or debuggable builds only.
+const deviceADBKeysFile = "/data/misc/adb/adb_keys"
+
+// adbKeysRewritten is echoed by the device once adb_keys was rewritten
+// without the case's key.
+const adbKeysRewritten = "mesh-adb-keys-rewritten"
+
+// adbAllowedConnectionTime is the global setting after which adbd forgets
+// keys that have not been used (7 days by default). Setting it to 1ms makes
+// the device drop every key as soon as its connection is gone.
+const adbAllowedConnectionTime = "adb_allowed_connection_time"
+
+// revokeAllADBKeysFlag names the flag that makes revokeDeviceADBKeys revoke
+// every host's authorization instead of only the case's.
+const revokeAllADBKeysFlag = "revoke-all-adb-keys"
+
+// revokeDeviceADBKeys asks the device to forget the case's ADB key, as far
+// as the ADB shell allows, and records each step in the case log. It must
+// run while the device is still connected.
+//
+// With all set it is destructive: it deletes adb_keys outright and sets
+// adb_allowed_connection_time to 1ms, which also revokes the hosts the
+// device owner trusts. The setting cannot be restored afterwards without
+// undoing the expiry, so its previous value is printed and logged for the
+// owner to restore.
+func revokeDeviceADBKeys(c *Case, all bool) {
+	checkADBClient()
+	if all {
+		revokeAllDeviceADBKeys(c)
+		return
+	}
+	fmt.Printf("Revoking the case's ADB authorization on the device (best effort)...\n")
+
+	if c == nil {
+		fmt.Printf("  No case selected, skipping ADB key revocation\n")
+		return
+	}
+	key, err := adbwifi.LoadKey(c.ADBKeyPath())
+	if err != nil {
+		logRevokeStep(c, "remove_case_adb_key", err, map[string]any{"path": deviceADBKeysFile})
+		return
+	}
+	// adb_keys holds one "<base64 key> <name>" line per trusted host; keep
+	// every line but ours. grep exits 1 when no line is left, which still
+	// leaves a valid file, but 2 when it could not read adb_keys: then the
+	// copy is empty and the file must be left alone, or the owner's
+	// trusted hosts would be deleted with ours.
+	pub, _, _ := strings.Cut(key.PublicKey(), " ")
+	tmp := deviceADBKeysFile + ".mesh"
+	out, err := adb.Client.Shell(fmt.Sprintf("grep -vF '%s' %s > %s; rc=$?; if [ $rc -le 1 ]; then cat %s > %s && echo %s; else echo grep exited $rc; fi; rm -f %s",
+		pub, deviceADBKeysFile, tmp, tmp, deviceADBKeysFile, adbKeysRewritten, tmp))
+	if err == nil && !strings.Contains(out, adbKeysRewritten) {
+		err = errors.New(strings.TrimSpace(out))
+	}
+	logRevokeStep(c, "remove_case_adb_key", err, map[string]any{
+		"path":        deviceADBKeysFile,
+		"fingerprint": key.Fingerprint(),
+	})
+}
+
+func revokeAllDeviceADBKeys(c *Case) {
+	fmt.Printf("Revoking ALL ADB authorizations on the device, including the owner's (best effort)...\n")
+
+	prev, _ := adb.Client.Shell("settings", "get", "global", adbAllowedConnectionTime)
+	prev = strings.TrimSpace(prev)
+	_, err := adb.Client.Shell("settings", "put", "global", adbAllowedConnectionTime, "1")
+	logRevokeStep(c, "expire_adb_authorizations", err, map[string]any{
+		"setting":  adbAllowedConnectionTime,
+		"previous": prev,
+		"value":    "1",
+	})
+	if err == nil {
+		fmt.Printf("  %s was %q; restore it on the device once ADB is no longer needed\n", adbAllowedConnectionTime, sanitizeForTerminal(prev))
+	}
+
+	out, err := adb.Client.Shell("rm", "-f", deviceADBKeysFile)
+	if err == nil && strings.Contains(out, "denied") {
+		err = errors.New(strings.TrimSpace(out))
+	}
+	logRevokeStep(c, "clear_adb_keys", err, map[string]any{"path": deviceADBKeysFile})
+}
+
+func logRevokeStep(c *Case, step string, err error, details map[string]any) {
+	details["step"] = step
+	if err != nil {
+		fmt.Printf("  %s: not permitted (%v)\n", step, err)
+		details["error"] = err.Error()
+	} else {
+		fmt.Printf("  %s: done\n", step)
+	}
+	logCase(c, "adb_key_revoke", details)
+}
+
+// deleteCaseADBKey removes the analyst-side copy of the case's ADB key so
+// that the workstation keeps no trust relationship with the device. If
+// stopServer is set the adb server, which keeps loaded keys in memory, is
+// stopped too.
+func deleteCaseADBKey(c *Case, stopServer bool) error {
+	if c == nil {
+		fmt.Printf("No case selected, skipping ADB key deletion\n")
+		return nil
+	}
+	path := c.ADBKeyPath()
+	key, err := adbwifi.LoadKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Case ADB key already deleted\n")
+		return nil
+	}
+
+	details := map[string]any{"path": path}
+	if key != nil {
+		details["fingerprint"] = key.Fingerprint()
+	}
+	for _, p := range []string{path, path + ".pub"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			details["error"] = err.Error()
+			logCase(c, "adb_key_deleted", details)
+			return fmt.Errorf("failed to delete case ADB key: %w", err)
+		}
+	}
+	fmt.Printf("Deleted case ADB key %s\n", path)
+
+	if stopServer && adb.Client != nil {
+		exec.Command(adb.Client.ExePath, "kill-server").Run()
+		details["adb_server_stopped"] = true
+	}
+	logCase(c, "adb_key_deleted", details)
+	return nil
+}
@@ -5,24 +5,26 @@
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/netip"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/BARGHEST-ngo/androidqf_mesh/acquisition"
+	"github.com/BARGHEST-ngo/MESH/analyst/adbwifi"
 	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
-	"github.com/BARGHEST-ngo/androidqf_mesh/log"
-	"github.com/BARGHEST-ngo/androidqf_mesh/modules"
-	rt "github.com/botherder/go-savetime/runtime"
-	"github.com/google/uuid"
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 )
 
@@ -30,6 +32,10 @@ type AndroidPeer struct {
 	IP       string
 	HostName string
 	DNSName  string
+	NodeID   string
+	NodeKey  string
+	// TailscaleIPs are all of the peer's MESH addresses; IP is the first.
+	TailscaleIPs []netip.Addr
 }
 
 type PairingArgs struct {
@@ -37,24 +43,98 @@ type PairingArgs struct {
 	PairPort    int
 	DebugPort   int
 	PairingCode string
+	Key         *adbwifi.Key
+	KeyPath     string
 }
 
-const maxAutoPairAttempts = 5
+const (
+	maxAutoPairAttempts = 5
+	pairTimeout         = 30 * time.Second
+
+	// adbKeyName is the name the analyst's ADB key is listed under on the
+	// device. It deliberately carries no analyst or workstation details.
+	adbKeyName = "mesh-analyst"
+)
+
+// Exit codes returned by adbpair so that scripts can tell which stage failed.
+const (
+	exitUsage         = 2
+	exitPeerSelection = 3
+	exitDataPath      = 4
+	exitPortDiscovery = 5
+	exitPairing       = 6
+	exitConnect       = 7
+	exitInputRequired = 8
+	exitIdentity      = 9
+)
+
+// errInputRequired is returned when adbpair would have to prompt the user
+// but is running with --yes.
+var errInputRequired = errors.New("input required but running non-interactively")
 
 var adbpairliteArgs struct {
-	qf bool
+	qf        bool
+	peer      string
+	code      string
+	pairPort  int
+	debugPort int
+	yes       bool
+	adbKey    string
+	caseDir   string
+	events    string
+	acq       acquisitionFlags
 }
 
 func AdbPairCmd() *ffcli.Command {
 	fs := flag.NewFlagSet("adbpair", flag.ContinueOnError)
 	fs.BoolVar(&adbpairliteArgs.qf, "qf", false, "perform adbcollect (AndroidQF/WARD) immediately after connection")
+	fs.StringVar(&adbpairliteArgs.peer, "peer", "", "Android peer to pair with, by hostname, MagicDNS name or MESH IP")
+	fs.StringVar(&adbpairliteArgs.code, "code", "", "6-digit pairing code shown on the device")
+	fs.IntVar(&adbpairliteArgs.pairPort, "pair-port", 0, "pairing port shown on the device (skips pairing port discovery)")
+	fs.IntVar(&adbpairliteArgs.debugPort, "debug-port", 0, "wireless debugging port shown on the device (skips debug port discovery)")
+	fs.BoolVar(&adbpairliteArgs.yes, "yes", false, "never prompt; fail with a distinct exit code when input is missing")
+	fs.StringVar(&adbpairliteArgs.adbKey, "adb-key", "", "ADB private key to pair with; created if missing (default: the case's key)")
+	fs.StringVar(&adbpairliteArgs.events, "progress-json", "", "write newline-delimited JSON progress events to a file, or \"-\" for stdout")
+	fs.StringVar(&adbpairliteArgs.caseDir, "case", "", "case directory (default: $"+caseEnv+", the current case, or a new case)")
+	adbpairliteArgs.acq.register(fs)
 
 	return &ffcli.Command{
 		Name:       "adbpair",
 		ShortUsage: "mesh adbpair [flags]",
 		ShortHelp:  "Pair & connect to a device on the MESH network via ADB",
-		FlagSet:    fs,
-		Exec:       runAdbPair,
+		LongHelp: `The adbpair command pairs with an Android device on the MESH network over wireless debugging and connects to it via ADB.
+
+Without flags, adbpair guides the analyst through peer selection, port discovery and pairing interactively. For scripted acquisitions, pass --peer, --code and optionally --pair-port/--debug-port together with --yes so that adbpair never prompts.
+
+Ports are discovered by asking the device's mDNS responder over MESH for the wireless debugging services. If none are advertised, adbpair falls back to a rate-limited scan of the device's ephemeral ports (32768-60999, about 30 seconds); --pair-port and --debug-port skip discovery altogether.
+
+Pairing is done natively (SPAKE2 over TLS 1.3) with a fresh ADB key generated for the case and stored in the case directory, rather than the shared key in ~/.android, so that the device never learns a long-lived analyst identity. The adb server is then restarted with that key (via ADB_VENDOR_KEYS) for the connection used by adbcollect. adbclean and adbdisable revoke and delete the key again.
+
+With --qf, the acquisition runs right after the connection is validated, with the same pipeline and options (--output, --modules, --exclude, --profile, --fast, --timeout) as adbcollect. Resume an interrupted acquisition with adbcollect --resume.
+
+With --progress-json, adbpair emits a pairing_step event (with status started, succeeded or failed) for each of the steps select_peer, check_data_path, discover_ports, pair, resolve_debug_port, verify_key, connect, validate and bind_identity.
+
+After connecting, adbpair binds the device to the MESH peer: the device must hold one of the peer's MESH addresses on its interfaces, and its model and Android version must match the peer's Hostinfo. On a mismatch, or when the MESH address (or every check) cannot be verified, adbpair stops, unless --allow-identity-mismatch is given. The comparison is recorded in the case log and, with --qf, in the acquisition (` + bindingFile + `).
+
+Exit codes:
+  1  unexpected error
+  2  invalid flags
+  3  Android peer not found or ambiguous
+  4  MESH data path to the peer is broken
+  5  pairing or debug port could not be found
+  6  pairing failed
+  7  connecting or validating the ADB session failed
+  8  input required but --yes was given
+  9  the ADB device does not match the MESH peer's identity
+
+Examples:
+  mesh adbpair
+  mesh adbpair --peer pixel-7 --code 123456 --yes
+  mesh adbpair --peer 100.64.0.5 --code 123456 --pair-port 37123 --debug-port 41235 --yes
+  mesh adbpair --peer pixel-7 --code 123456 --yes --qf --profile triage --output /cases/pixel-7
+`,
+		FlagSet: fs,
+		Exec:    runAdbPair,
 	}
 }
 
@@ -63,79 +143,178 @@ func runAdbPair(ctx context.Context, args []string) error {
 		return fmt.Errorf("unexpected arguments: %v", args)
 	}
 
-	pairingArgs := PairingArgs{}
-
-	fmt.Println("Starting automatic pairing...")
-
-	chosenPeer, err := selectAndroidPeer(ctx)
+	closeEvents, err := openEvents(adbpairliteArgs.events)
 	if err != nil {
-		return fmt.Errorf("unable to select an Android client: %w", err)
+		return fmt.Errorf("unable to open progress output: %w", err)
 	}
-	pairingArgs.Host = chosenPeer.IP
+	defer closeEvents()
 
-	if err := checkDataPath(ctx, chosenPeer.IP); err != nil {
-		return err
+	nonInteractive = adbpairliteArgs.yes
+	if adbpairliteArgs.code != "" {
+		if err := validatePairingCode(adbpairliteArgs.code); err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("invalid --code: %w", err))
+		}
+	} else if nonInteractive {
+		return withExitCode(exitInputRequired, fmt.Errorf("%w: --code is required with --yes", errInputRequired))
+	}
+	// Resolve the acquisition options up front so that a typo in the
+	// module selection does not surface only after pairing.
+	var acqOpts acquisitionOptions
+	if adbpairliteArgs.qf {
+		var err error
+		acqOpts, err = adbpairliteArgs.acq.options("")
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	for _, p := range []int{adbpairliteArgs.pairPort, adbpairliteArgs.debugPort} {
+		if p < 0 || p > 65535 {
+			return withExitCode(exitUsage, fmt.Errorf("invalid port: %d", p))
+		}
 	}
 
-	fmt.Printf("Using Android device: %s (%s)\n\n", chosenPeer.HostName, chosenPeer.IP)
-	fmt.Println("On the Android device:")
-	fmt.Println("1. Enable Wireless Debugging")
-	fmt.Println("2. Tap 'Pair device with pairing code'")
-	ReadString("Press Enter when the pairing dialog is open...")
+	pairingArgs := PairingArgs{
+		PairPort:    adbpairliteArgs.pairPort,
+		DebugPort:   adbpairliteArgs.debugPort,
+		PairingCode: adbpairliteArgs.code,
+	}
 
-	fmt.Println("Scanning for open ports...")
-	openPorts, err := scanOpenPorts(chosenPeer.IP)
+	c, err := openCase(adbpairliteArgs.caseDir, true)
 	if err != nil {
-		return fmt.Errorf("port scan failed: %w", err)
-	}
-	if len(openPorts) == 0 {
-		return fmt.Errorf("no open ports found on %s - is the pairing dialog open?", chosenPeer.IP)
+		return err
 	}
+	acqOpts.Case = c
 
-	pairingArgs.PairingCode = ReadStringWithValidation("Enter the pairing code shown on the device: ", validatePairingCode)
+	fmt.Println("Starting automatic pairing...")
 
-	adbClient, err := adb.New()
+	events.startPairingStep("select_peer")
+	chosenPeer, err := selectAndroidPeer(ctx, adbpairliteArgs.peer)
 	if err != nil {
-		return fmt.Errorf("failed to initialize ADB: %w", err)
+		err = fmt.Errorf("unable to select an Android client: %w", err)
+		events.pairingStep("select_peer", err, nil)
+		logCase(c, "peer_selected", map[string]any{"requested": adbpairliteArgs.peer, "error": err.Error()})
+		return withExitCode(exitPeerSelection, err)
+	}
+	events.pairingStep("select_peer", nil, map[string]any{"ip": chosenPeer.IP, "dns_name": chosenPeer.DNSName})
+	logCase(c, "peer_selected", map[string]any{
+		"ip":        chosenPeer.IP,
+		"hostname":  chosenPeer.HostName,
+		"dns_name":  chosenPeer.DNSName,
+		"node_id":   chosenPeer.NodeID,
+		"node_key":  chosenPeer.NodeKey,
+		"requested": adbpairliteArgs.peer,
+	})
+	if err := pairPeer(ctx, c, chosenPeer, &pairingArgs, adbpairliteArgs.adbKey); err != nil {
+		return err
 	}
-	adb.Client = adbClient
 
-	devices, err := adb.Client.Devices()
+	serial, binding, err := connectPeer(ctx, c, chosenPeer, &pairingArgs, adbpairliteArgs.acq.allowMismatch)
 	if err != nil {
-		return fmt.Errorf("failed to get devices: %w", err)
+		return err
 	}
-	if len(devices) > 0 {
-		fmt.Printf("Found existing ADB devices: %v\n", devices)
-		if err := disconnect(""); err != nil {
+
+	if adbpairliteArgs.qf {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Println("Performing forensics acquisition")
+		acqOpts.Serial = serial
+		acqOpts.Binding = binding
+		if err := runAcquisition(ctx, acqOpts); err != nil {
 			return err
 		}
 	}
 
-	pairedPort, err := pairWithDiscovery(&pairingArgs, openPorts)
+	return nil
+}
+
+// pairPeer pairs with peer over wireless debugging using the ADB key at
+// keyPath (default: the case's key) and checks that the device then accepts
+// the key on its debug port. It talks to the device natively and leaves the
+// adb server alone, so that several devices can be paired before the server
+// is restarted with all their keys. On success args holds the key and the
+// debug port.
+func pairPeer(ctx context.Context, c *Case, peer *AndroidPeer, args *PairingArgs, keyPath string) error {
+	args.Host = peer.IP
+
+	events.startPairingStep("check_data_path")
+	err := checkDataPath(ctx, peer.IP)
+	events.pairingStep("check_data_path", err, nil)
 	if err != nil {
-		return err
+		return withExitCode(exitDataPath, err)
 	}
 
-	debugPort, err := resolveDebugPort(chosenPeer.IP, openPorts, pairedPort)
-	if err != nil {
-		return fmt.Errorf("unable to locate debug port: %w", err)
+	fmt.Printf("Using Android device: %s (%s)\n\n", peer.HostName, peer.IP)
+	if !nonInteractive {
+		fmt.Println("On the Android device:")
+		fmt.Println("1. Enable Wireless Debugging")
+		fmt.Println("2. Tap 'Pair device with pairing code'")
+		ReadString("Press Enter when the pairing dialog is open...")
 	}
-	pairingArgs.DebugPort = debugPort
 
-	if err := connect(&pairingArgs); err != nil {
-		return err
+	ports := adbPorts{pair: []int{args.PairPort}}
+	if args.PairPort == 0 {
+		events.startPairingStep("discover_ports")
+		ports, err = discoverADBPorts(ctx, peer.IP)
+		if err == nil && len(ports.pair) == 0 {
+			err = fmt.Errorf("no pairing port found on %s - is the pairing dialog open?", peer.IP)
+		}
+		events.pairingStep("discover_ports", err, map[string]any{"pair_ports": ports.pair, "connect_ports": ports.connect})
+		if err != nil {
+			return withExitCode(exitPortDiscovery, err)
+		}
 	}
 
-	if err := validateConnect(); err != nil {
-		return err
+	if args.PairingCode == "" {
+		args.PairingCode = ReadStringWithValidation("Enter the pairing code shown on the device: ", validatePairingCode)
+		if args.PairingCode == "" {
+			return withExitCode(exitInputRequired, fmt.Errorf("%w: no terminal to read the pairing code from, use --code", errInputRequired))
+		}
 	}
 
-	if adbpairliteArgs.qf {
-		if err := qf(); err != nil {
-			return err
+	args.KeyPath = keyPath
+	if args.KeyPath == "" {
+		args.KeyPath = c.ADBKeyPath()
+	}
+	var created bool
+	args.Key, created, err = loadADBKey(args.KeyPath)
+	if err != nil {
+		return fmt.Errorf("unable to prepare ADB key: %w", err)
+	}
+	fmt.Printf("Using ADB key %s (fingerprint %s)\n", args.KeyPath, args.Key.Fingerprint())
+	if created {
+		logCase(c, "adb_key_created", map[string]any{
+			"path":        args.KeyPath,
+			"fingerprint": args.Key.Fingerprint(),
+		})
+	}
+
+	events.startPairingStep("pair")
+	pairedPort, err := pairWithDiscovery(ctx, args, ports.pair)
+	events.pairingStep("pair", err, map[string]any{"port": pairedPort})
+	logCase(c, "adb_paired", stepDetails(err, map[string]any{"ip": peer.IP, "port": pairedPort}))
+	if err != nil {
+		return withExitCode(exitPairing, err)
+	}
+
+	if args.DebugPort == 0 {
+		events.startPairingStep("resolve_debug_port")
+		debugPort, err := resolveDebugPort(ctx, peer.IP, ports.connect, pairedPort)
+		if err != nil {
+			err = fmt.Errorf("unable to locate debug port: %w", err)
+		}
+		events.pairingStep("resolve_debug_port", err, map[string]any{"port": debugPort})
+		if err != nil {
+			return withExitCode(exitPortDiscovery, err)
 		}
+		args.DebugPort = debugPort
 	}
 
+	events.startPairingStep("verify_key")
+	err = verifyDeviceKey(ctx, args)
+	events.pairingStep("verify_key", err, map[string]any{"port": args.DebugPort})
+	if err != nil {
+		return withExitCode(exitConnect, err)
+	}
 	return nil
 }
 
@@ -164,15 +343,30 @@ func checkDataPath(ctx context.Context, ip string) error {
 	return nil
 }
 
-func pairWithDiscovery(args *PairingArgs, openPorts []int) (int, error) {
+// withExitCode attaches an adbpair exit code to err. Errors caused by a
+// missing prompt in --yes mode always get exitInputRequired.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, errInputRequired) {
+		code = exitInputRequired
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+func pairWithDiscovery(ctx context.Context, args *PairingArgs, openPorts []int) (int, error) {
 	if len(openPorts) > maxAutoPairAttempts {
+		if nonInteractive {
+			return 0, fmt.Errorf("%w: found %d open ports, use --pair-port", errInputRequired, len(openPorts))
+		}
 		fmt.Printf("Found %d open ports - too many to try automatically, please identify the pairing port:\n", len(openPorts))
 		choice, ok := promptForPort(openPorts)
 		if !ok {
 			return 0, fmt.Errorf("invalid port selection")
 		}
 		args.PairPort = openPorts[choice]
-		if err := pair(args); err != nil {
+		if err := pair(ctx, args); err != nil {
 			return 0, err
 		}
 		return args.PairPort, nil
@@ -181,7 +375,10 @@ func pairWithDiscovery(args *PairingArgs, openPorts []int) (int, error) {
 	for _, port := range openPorts {
 		args.PairPort = port
 		fmt.Printf("Trying port %d...\n", port)
-		if err := pair(args); err != nil {
+		if err := pair(ctx, args); err != nil {
+			if errors.Is(err, adbwifi.ErrWrongPairingCode) {
+				return 0, err
+			}
 			continue
 		}
 		return port, nil
@@ -189,24 +386,45 @@ func pairWithDiscovery(args *PairingArgs, openPorts []int) (int, error) {
 	return 0, fmt.Errorf("pairing failed on all discovered ports")
 }
 
-func pair(args *PairingArgs) error {
-	if adb.Client == nil {
-		return fmt.Errorf("adb not initialized")
-	}
-
-	if args == nil {
+func pair(ctx context.Context, args *PairingArgs) error {
+	if args == nil || args.Key == nil {
 		return fmt.Errorf("invalid pairing args")
 	}
 
-	output, err := adb.Client.Exec("pair", net.JoinHostPort(args.Host, strconv.Itoa(args.PairPort)), args.PairingCode)
+	ctx, cancel := context.WithTimeout(ctx, pairTimeout)
+	defer cancel()
+
+	guid, err := adbwifi.Pair(ctx, net.JoinHostPort(args.Host, strconv.Itoa(args.PairPort)), args.PairingCode, args.Key)
 	if err != nil {
-		return fmt.Errorf("ADB pair failed: %w\nOutput: %s", err, string(output))
+		return fmt.Errorf("ADB pair failed: %w", err)
 	}
-	fmt.Println("ADB pair successful")
+	fmt.Printf("ADB pair successful (device %s)\n", guid)
 	return nil
 }
 
-func resolveDebugPort(ip string, openPorts []int, pairedPort int) (int, error) {
+// loadADBKey returns the ADB key at path, generating and saving a fresh one
+// if there is none yet. created reports whether a new key was generated.
+func loadADBKey(path string) (key *adbwifi.Key, created bool, err error) {
+	if _, err := os.Stat(path); err == nil {
+		key, err := adbwifi.LoadKey(path)
+		return key, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, false, err
+	}
+
+	fmt.Println("Generating ADB key for this case...")
+	key, err = adbwifi.GenerateKey(adbKeyName)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := key.Save(path); err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+func resolveDebugPort(ctx context.Context, ip string, openPorts []int, pairedPort int) (int, error) {
 	var candidates []int
 	for _, p := range openPorts {
 		if p != pairedPort {
@@ -216,12 +434,15 @@ func resolveDebugPort(ip string, openPorts []int, pairedPort int) (int, error) {
 
 	switch len(candidates) {
 	case 0:
-		fmt.Println("Scanning for debug port...")
-		return selectPort(ip)
+		fmt.Println("Looking for debug port...")
+		return selectPort(ctx, ip)
 	case 1:
 		fmt.Printf("Found debug port: %d\n", candidates[0])
 		return candidates[0], nil
 	default:
+		if nonInteractive {
+			return 0, fmt.Errorf("%w: multiple debug port candidates %v, use --debug-port", errInputRequired, candidates)
+		}
 		fmt.Println("Multiple debug port candidates, please select:")
 		choice, ok := promptForPort(candidates)
 		if !ok {
@@ -231,55 +452,194 @@ func resolveDebugPort(ip string, openPorts []int, pairedPort int) (int, error) {
 	}
 }
 
-func connect(args *PairingArgs) error {
+// verifyDeviceKey connects to the device's debug port natively to check
+// that it accepts the key used for pairing.
+func verifyDeviceKey(ctx context.Context, args *PairingArgs) error {
+	if args == nil || args.Key == nil {
+		return fmt.Errorf("invalid pairing args")
+	}
+	addr := net.JoinHostPort(args.Host, strconv.Itoa(args.DebugPort))
+
+	fmt.Printf("Verifying that the device trusts the ADB key...\n")
+	ctx, cancel := context.WithTimeout(ctx, pairTimeout)
+	defer cancel()
+	info, err := adbwifi.Connect(ctx, addr, args.Key)
+	if err != nil {
+		return fmt.Errorf("wireless debugging connection failed: %w", err)
+	}
+	fmt.Printf("Device accepted the key: %s\n", sanitizeForTerminal(info.Props["ro.product.model"]))
+	return nil
+}
+
+// connectPeer connects the adb server to a peer paired with pairPeer,
+// checks that the connection really goes to the peer and binds the device
+// to the peer's identity. Devices already connected are disconnected first.
+func connectPeer(ctx context.Context, c *Case, peer *AndroidPeer, args *PairingArgs, allowMismatch bool) (serial string, binding *deviceBinding, err error) {
+	adbClient, err := adb.New()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to initialize ADB: %w", err)
+	}
+	adb.Client = adbClient
+
+	devices, err := adb.Client.Devices()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get devices: %w", err)
+	}
+	if len(devices) > 0 {
+		fmt.Printf("Found existing ADB devices: %v\n", devices)
+		if err := disconnect(""); err != nil {
+			return "", nil, err
+		}
+	}
+
+	serial = net.JoinHostPort(args.Host, strconv.Itoa(args.DebugPort))
+
+	events.startPairingStep("connect")
+	err = connect(ctx, args)
+	events.pairingStep("connect", err, map[string]any{"port": args.DebugPort})
+	logCase(c, "adb_connected", stepDetails(err, map[string]any{"serial": serial}))
+	if err != nil {
+		return "", nil, withExitCode(exitConnect, err)
+	}
+
+	events.startPairingStep("validate")
+	err = validateConnect(ctx, peer, serial)
+	events.pairingStep("validate", err, nil)
+	logCase(c, "adb_validated", stepDetails(err, map[string]any{
+		"serial":   serial,
+		"node_key": peer.NodeKey,
+	}))
+	if err != nil {
+		return "", nil, withExitCode(exitConnect, err)
+	}
+
+	// Other devices may still be attached over USB; the binding checks must
+	// ask the one just connected.
+	if _, err := adb.Client.SetSerial(serial); err != nil {
+		return "", nil, withExitCode(exitConnect, fmt.Errorf("unable to select device %s: %w", serial, err))
+	}
+
+	events.startPairingStep("bind_identity")
+	binding = bindDevice(ctx, peer, serial)
+	err = checkBinding(c, binding, allowMismatch)
+	events.pairingStep("bind_identity", err, map[string]any{"checks": binding.Checks})
+	if err != nil {
+		return "", nil, withExitCode(exitIdentity, err)
+	}
+	return serial, binding, nil
+}
+
+// connect restarts the adb server with the pairing key and connects it to
+// the device's debug port.
+func connect(ctx context.Context, args *PairingArgs) error {
 	if adb.Client == nil {
 		return fmt.Errorf("adb not initialized")
 	}
-	if args == nil {
+	if args == nil || args.Key == nil {
 		return fmt.Errorf("invalid pairing args")
 	}
+	addr := net.JoinHostPort(args.Host, strconv.Itoa(args.DebugPort))
+
+	if err := useADBKeys(args.KeyPath); err != nil {
+		return err
+	}
+
 	fmt.Printf("Connecting to device...\n")
-	output, err := adb.Client.Exec("connect", net.JoinHostPort(args.Host, strconv.Itoa(args.DebugPort)))
+	output, err := adb.Client.Exec("connect", addr)
 	if err != nil {
 		return fmt.Errorf("ADB connect failed: %w\nOutput: %s", err, string(output))
 	}
 	return nil
 }
 
-func validateConnect() error {
+// validateConnect checks that the adb server is connected to serial and
+// that serial is an address of the chosen MESH peer, so that acquisition
+// never runs against a device that merely answers on a MESH-like address.
+func validateConnect(ctx context.Context, peer *AndroidPeer, serial string) error {
 	checkADBClient()
 	fmt.Printf("Validating ADB session...\n")
 	devices, err := adb.Client.Devices()
 	if err != nil {
 		return fmt.Errorf("failed to get devices: %w", err)
 	}
-	switch len(devices) {
-	case 0:
-		return fmt.Errorf("no devices connected after ADB connect")
-	case 1:
-		fmt.Printf("Success! Device connected\n")
-		for _, d := range devices {
-			if strings.HasPrefix(d, "100.") {
-				fmt.Printf("Success! Valid MESH network device\n")
-				fmt.Printf("You may proceed with forensics acquision\n")
-				fmt.Printf("Use mesh adbcollect\n")
-				return nil
-			}
+	if !slices.Contains(devices, serial) {
+		if len(devices) == 0 {
+			return fmt.Errorf("no devices connected after ADB connect")
 		}
-		return fmt.Errorf("wrong device connected/paried")
-	default:
-		return fmt.Errorf("multiple devices connected after ADB connect: %v", devices)
+		return fmt.Errorf("%s is not among the connected devices: %v", serial, devices)
+	}
+	fmt.Printf("Success! Device connected\n")
+	if len(devices) > 1 {
+		fmt.Printf("Note: other ADB devices are connected too: %v\n", devices)
+	}
+
+	if err := checkSerialMatchesPeer(ctx, serial, peer); err != nil {
+		return err
+	}
+	fmt.Printf("Success! Valid MESH network device\n")
+	fmt.Printf("You may proceed with forensics acquision\n")
+	fmt.Printf("Use mesh adbcollect\n")
+	return nil
+}
+
+// checkSerialMatchesPeer verifies against the current MESH status that the
+// host of a wireless ADB serial is one of the peer's MESH addresses (IPv4 or
+// IPv6), and that the peer still holds the node key it was selected with.
+func checkSerialMatchesPeer(ctx context.Context, serial string, peer *AndroidPeer) error {
+	host, _, err := net.SplitHostPort(serial)
+	if err != nil {
+		return fmt.Errorf("device %s is not connected over the network", serial)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("device %s is not connected by IP address", serial)
+	}
+	addr = addr.WithZone("")
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if string(ps.ID) != peer.NodeID {
+			continue
+		}
+		if ps.PublicKey.String() != peer.NodeKey {
+			return fmt.Errorf("MESH peer %s changed node key since it was selected", peer.HostName)
+		}
+		if slices.Contains(ps.TailscaleIPs, addr) {
+			return nil
+		}
+		return fmt.Errorf("wrong device connected/paired: %s is not a MESH address of %s (%v)", addr, peer.HostName, ps.TailscaleIPs)
 	}
+	return fmt.Errorf("MESH peer %s is no longer in the network", peer.HostName)
 }
 
-func selectAndroidPeer(ctx context.Context) (*AndroidPeer, error) {
+// selectAndroidPeer picks the Android peer to work with. If want is set, the
+// peer it identifies is used; otherwise the only Android peer is used, or the
+// analyst is asked to choose between several.
+func selectAndroidPeer(ctx context.Context, want string) (*AndroidPeer, error) {
 	peers, err := getAndroidPeers(ctx)
 	if err != nil || len(peers) == 0 {
 		return nil, fmt.Errorf("unable to find any connected Android clients")
 	}
 
+	if want != "" {
+		for _, p := range peers {
+			if p.matches(want) {
+				fmt.Printf("found requested Android device: %s (%s)\n", p.HostName, p.IP)
+				return &p, nil
+			}
+		}
+		return nil, fmt.Errorf("no Android client matches %q", want)
+	}
+
 	var chosenPeer AndroidPeer
 	if len(peers) > 1 {
+		if nonInteractive {
+			return nil, fmt.Errorf("%w: %d Android clients found, use --peer", errInputRequired, len(peers))
+		}
 		choice, valid := promptForAndroidClient(peers)
 		if !valid {
 			return nil, fmt.Errorf("invalid client selection")
@@ -293,6 +653,40 @@ func selectAndroidPeer(ctx context.Context) (*AndroidPeer, error) {
 	return &chosenPeer, nil
 }
 
+// newAndroidPeer describes a peer from the MESH client's status. Peers of
+// other OSes are described the same way where they are looked up by name.
+func newAndroidPeer(ps *ipnstate.PeerStatus) AndroidPeer {
+	p := AndroidPeer{
+		HostName:     sanitizeForTerminal(ps.HostName),
+		DNSName:      ps.DNSName,
+		NodeID:       string(ps.ID),
+		NodeKey:      ps.PublicKey.String(),
+		TailscaleIPs: ps.TailscaleIPs,
+	}
+	if len(ps.TailscaleIPs) > 0 {
+		p.IP = ps.TailscaleIPs[0].String()
+	}
+	return p
+}
+
+// matches reports whether s identifies the peer, either as its hostname, its
+// MagicDNS name (short or fully qualified) or one of its MESH IPs.
+func (p AndroidPeer) matches(s string) bool {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return slices.Contains(p.TailscaleIPs, addr) || addr.String() == p.IP
+	}
+	if strings.EqualFold(sanitizeForTerminal(s), p.HostName) {
+		return true
+	}
+	dnsName := strings.TrimSuffix(p.DNSName, ".")
+	if dnsName == "" {
+		return false
+	}
+	s = strings.TrimSuffix(s, ".")
+	short, _, _ := strings.Cut(dnsName, ".")
+	return strings.EqualFold(s, dnsName) || strings.EqualFold(s, short)
+}
+
 func getAndroidPeers(ctx context.Context) ([]AndroidPeer, error) {
 	status, err := localClient.Status(ctx)
 	if err != nil {
@@ -310,12 +704,7 @@ func getAndroidPeers(ctx context.Context) ([]AndroidPeer, error) {
 			continue
 		}
 
-		out = append(out, AndroidPeer{
-			IP:       peer.TailscaleIPs[0].String(),
-			HostName: sanitizeForTerminal(peer.HostName),
-			DNSName:  peer.DNSName,
-		})
-
+		out = append(out, newAndroidPeer(peer))
 	}
 	return out, nil
 }
@@ -357,12 +746,12 @@ func promptForSelection(choices []string) (int, bool) {
 	return choice - 1, true
 }
 
-func selectPort(ip string) (int, error) {
-	fmt.Println("Scanning for port...")
-	openPorts, err := scanOpenPorts(ip)
+func selectPort(ctx context.Context, ip string) (int, error) {
+	ports, err := discoverADBPorts(ctx, ip)
 	if err != nil {
-		return -1, fmt.Errorf("port scan failed: %w", err)
+		return -1, err
 	}
+	openPorts := ports.connect
 	if len(openPorts) == 0 {
 		return -1, fmt.Errorf("no open ports found on %s", ip)
 	}
@@ -372,6 +761,9 @@ func selectPort(ip string) (int, error) {
 		pairPort = openPorts[0]
 		fmt.Printf("Found port: %d\n", pairPort)
 	} else {
+		if nonInteractive {
+			return -1, fmt.Errorf("%w: found open ports %v", errInputRequired, openPorts)
+		}
 		choice, ok := promptForPort(openPorts)
 		if !ok {
 			return -1, fmt.Errorf("invalid port selection")
@@ -382,20 +774,23 @@ func selectPort(ip string) (int, error) {
 	return pairPort, nil
 }
 
-func scanOpenPorts(ip string) ([]int, error) {
-	const workers = 1000
+// scanOpenPorts dials the ephemeral port range of the device at ip at no
+// more than scanRate connection attempts per second and returns the ports
+// that accepted a connection.
+func scanOpenPorts(ctx context.Context, ip string) ([]int, error) {
 	const dialTimeout = 1 * time.Second
 
-	jobs := make(chan int, workers)
+	jobs := make(chan int, scanWorkers)
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	var open []int
 
-	for range workers {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	for range scanWorkers {
 		wg.Go(func() {
 			for p := range jobs {
 				addr := net.JoinHostPort(ip, strconv.Itoa(p))
-				conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+				conn, err := dialer.DialContext(ctx, "tcp", addr)
 				if err == nil {
 					conn.Close()
 					mu.Lock()
@@ -406,78 +801,23 @@ func scanOpenPorts(ip string) ([]int, error) {
 		})
 	}
 
-	for port := 5000; port <= 65535; port++ {
-		jobs <- port
+	tick := time.NewTicker(time.Second / scanRate)
+	defer tick.Stop()
+scan:
+	for port := scanPortFirst; port <= scanPortLast; port++ {
+		select {
+		case <-ctx.Done():
+			break scan
+		case <-tick.C:
+			jobs <- port
+		}
 	}
 	close(jobs)
 
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	sort.Ints(open)
 	return open, nil
 }
-
-func qf() error {
-	devices, err := adb.Client.Devices()
-	if err != nil {
-		return fmt.Errorf("failed to get devices: %w", err)
-	}
-
-	for _, d := range devices {
-		if strings.HasPrefix(d, "100.") {
-			fmt.Println("Performing forensics acquisition")
-			fmt.Println("Starting androidqf")
-
-			acqUUID := uuid.New().String()
-
-			for {
-				d, err = adb.Client.SetSerial(d)
-				if err != nil {
-					log.Error(fmt.Sprintf("Error trying to connect over ADB: %s", err))
-				} else {
-					_, err = adb.Client.GetState()
-					if err == nil {
-						break
-					}
-					log.Debug(err)
-					log.Error("Unable to get device state. Please make sure it is connected and authorized. Trying again in 5 seconds...")
-				}
-				time.Sleep(5 * time.Second)
-			}
-
-			outputFolder := filepath.Join(rt.GetExecutableDirectory(), acqUUID)
-			acq, err := acquisition.New(outputFolder)
-			if err != nil {
-				log.FatalExc("Impossible to initialise the acquisition", err)
-			}
-
-			log.Info(fmt.Sprintf("Started new acquisition in %s", acq.StoragePath))
-
-			for _, mod := range modules.List() {
-				if err := mod.InitStorage(acq.StoragePath); err != nil {
-					log.Infof("ERROR: failed to initialize storage for module %s: %v", mod.Name(), err)
-					continue
-				}
-				if err := mod.Run(acq, false); err != nil {
-					log.Infof("ERROR: failed to run module %s: %v", mod.Name(), err)
-				}
-			}
-
-			if err := acq.HashFiles(); err != nil {
-				log.ErrorExc("Failed to generate list of file hashes", err)
-				return err
-			}
-
-			acq.StoreInfo()
-
-			if err := acq.StoreSecurely(); err != nil {
-				log.ErrorExc("Something failed while encrypting the acquisition", err)
-				log.Warning("WARNING: The secure storage of the acquisition folder failed! The data is unencrypted!")
-			}
-
-			acq.Complete()
-			log.Info("Acquisition completed.")
-			return nil
-		}
-	}
-	return nil
-}
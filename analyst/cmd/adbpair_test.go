@@ -0,0 +1,150 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAdbPairExitCodes(t *testing.T) {
+	// The exit codes are part of the command's interface for scripts:
+	// each must keep its value and be documented in the help.
+	tests := []struct {
+		code int
+		want int
+		doc  string
+	}{
+		{exitUsage, 2, "invalid flags"},
+		{exitPeerSelection, 3, "Android peer not found or ambiguous"},
+		{exitDataPath, 4, "MESH data path to the peer is broken"},
+		{exitPortDiscovery, 5, "pairing or debug port could not be found"},
+		{exitPairing, 6, "pairing failed"},
+		{exitConnect, 7, "connecting or validating the ADB session failed"},
+		{exitInputRequired, 8, "input required but --yes was given"},
+		{exitIdentity, 9, "the ADB device does not match the MESH peer's identity"},
+	}
+	help := AdbPairCmd().LongHelp
+	for _, tt := range tests {
+		if tt.code != tt.want {
+			t.Errorf("exit code for %q is %d, want %d", tt.doc, tt.code, tt.want)
+		}
+		if line := fmt.Sprintf("  %d  %s\n", tt.want, tt.doc); !strings.Contains(help, line) {
+			t.Errorf("help does not document exit code %d as %q", tt.want, tt.doc)
+		}
+	}
+}
+
+func TestWithExitCode(t *testing.T) {
+	if err := withExitCode(exitPairing, nil); err != nil {
+		t.Errorf("withExitCode(nil) = %v", err)
+	}
+
+	errPair := errors.New("pairing rejected")
+	tests := []struct {
+		name string
+		code int
+		err  error
+		want int
+	}{
+		{name: "plain", code: exitPairing, err: errPair, want: exitPairing},
+		{name: "wrapped", code: exitConnect, err: fmt.Errorf("connect: %w", errPair), want: exitConnect},
+		// A stage that would have prompted under --yes reports missing
+		// input rather than its own failure.
+		{name: "input-required", code: exitPeerSelection, err: fmt.Errorf("%w: 2 Android clients found, use --peer", errInputRequired), want: exitInputRequired},
+		{name: "input-required-wrapped", code: exitPortDiscovery, err: fmt.Errorf("discovery: %w", fmt.Errorf("%w: found 9 open ports", errInputRequired)), want: exitInputRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := withExitCode(tt.code, tt.err)
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("%v is not an ExitError", err)
+			}
+			if exitErr.Code != tt.want {
+				t.Errorf("exit code %d, want %d", exitErr.Code, tt.want)
+			}
+			if !errors.Is(err, tt.err) || err.Error() != tt.err.Error() {
+				t.Errorf("error %q does not carry %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRunAdbPairValidation(t *testing.T) {
+	saved, savedNonInteractive := adbpairliteArgs, nonInteractive
+	t.Cleanup(func() { adbpairliteArgs, nonInteractive = saved, savedNonInteractive })
+
+	// Every case fails before a case directory is opened or the MESH
+	// daemon is asked for peers.
+	tests := []struct {
+		name  string
+		set   func()
+		code  int
+		input bool
+	}{
+		{name: "short-code", set: func() { adbpairliteArgs.code = "12345" }, code: exitUsage},
+		{name: "letters-in-code", set: func() { adbpairliteArgs.code = "12a456" }, code: exitUsage},
+		{name: "bad-code-with-yes", set: func() { adbpairliteArgs.code, adbpairliteArgs.yes = "1234567", true }, code: exitUsage},
+		{name: "yes-without-code", set: func() { adbpairliteArgs.yes = true }, code: exitInputRequired, input: true},
+		{name: "yes-without-code-with-qf", set: func() { adbpairliteArgs.yes, adbpairliteArgs.qf = true, true }, code: exitInputRequired, input: true},
+		{name: "negative-pair-port", set: func() { adbpairliteArgs.code, adbpairliteArgs.pairPort = "123456", -1 }, code: exitUsage},
+		{name: "debug-port-too-large", set: func() { adbpairliteArgs.code, adbpairliteArgs.debugPort = "123456", 65536 }, code: exitUsage},
+		{
+			name: "unknown-module",
+			set: func() {
+				adbpairliteArgs.code, adbpairliteArgs.qf = "123456", true
+				adbpairliteArgs.acq.modules = "getprop,getprops"
+			},
+			code: exitUsage,
+		},
+		{
+			name: "unknown-profile",
+			set: func() {
+				adbpairliteArgs.code, adbpairliteArgs.yes, adbpairliteArgs.qf = "123456", true, true
+				adbpairliteArgs.acq.profile = "quick"
+			},
+			code: exitUsage,
+		},
+		{
+			name: "everything-excluded",
+			set: func() {
+				adbpairliteArgs.code, adbpairliteArgs.qf = "123456", true
+				adbpairliteArgs.acq.exclude = "*"
+			},
+			code: exitUsage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adbpairliteArgs = saved
+			adbpairliteArgs.acq = acquisitionFlags{}
+			adbpairliteArgs.caseDir = t.TempDir()
+			tt.set()
+
+			err := runAdbPair(context.Background(), nil)
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("runAdbPair returned %v, want an ExitError", err)
+			}
+			if exitErr.Code != tt.code {
+				t.Errorf("exit code %d (%v), want %d", exitErr.Code, err, tt.code)
+			}
+			if got := errors.Is(err, errInputRequired); got != tt.input {
+				t.Errorf("%v wraps errInputRequired: %v, want %v", err, got, tt.input)
+			}
+		})
+	}
+
+	// Stray arguments are an unexpected error, without a stage exit code.
+	adbpairliteArgs = saved
+	err := runAdbPair(context.Background(), []string{"pixel-7"})
+	var exitErr *ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		t.Errorf("runAdbPair with arguments returned %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+)
+
+// bindingFile records, in the acquisition folder, why the acquired device is
+// believed to be the enrolled MESH peer.
+const bindingFile = "mesh_device_binding.json"
+
+// Outcomes of a binding check.
+const (
+	bindingMatch    = "match"
+	bindingMismatch = "mismatch"
+	bindingUnknown  = "unknown"
+)
+
+// deviceBinding ties the device answering over ADB to a MESH peer by
+// comparing what each of them reports.
+type deviceBinding struct {
+	Time   time.Time      `json:"time"`
+	Peer   bindingPeer    `json:"peer"`
+	Device bindingDevice  `json:"device"`
+	Checks []bindingCheck `json:"checks"`
+}
+
+type bindingPeer struct {
+	NodeID      string   `json:"node_id"`
+	NodeKey     string   `json:"node_key"`
+	HostName    string   `json:"hostname"`
+	MeshIPs     []string `json:"mesh_ips"`
+	OSVersion   string   `json:"os_version,omitempty"`
+	DeviceModel string   `json:"device_model,omitempty"`
+}
+
+type bindingDevice struct {
+	ADBSerial    string   `json:"adb_serial"`
+	SerialNo     string   `json:"serialno,omitempty"`
+	Fingerprint  string   `json:"build_fingerprint,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	OSVersion    string   `json:"os_version,omitempty"`
+	InterfaceIPs []string `json:"interface_ips,omitempty"`
+}
+
+type bindingCheck struct {
+	Name     string `json:"name"`
+	Result   string `json:"result"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// failures returns the checks that keep the binding from being
+// established: those that contradict it, and those that could not be made
+// when nothing else confirms it. The MESH address is the check that ties the
+// device to the peer, so it cannot be left unknown; if every check is
+// unknown, nothing was compared at all.
+func (b *deviceBinding) failures() []bindingCheck {
+	var out []bindingCheck
+	known := false
+	for _, c := range b.Checks {
+		switch {
+		case c.Result == bindingMismatch:
+			out = append(out, c)
+		case c.Result == bindingUnknown && c.Name == "mesh_address":
+			out = append(out, c)
+		}
+		known = known || c.Result != bindingUnknown
+	}
+	if !known {
+		return b.Checks
+	}
+	return out
+}
+
+// bindDevice compares the device connected as serial with the MESH peer.
+// The strongest check is that the device itself holds one of the peer's
+// MESH addresses on its interfaces; model and OS version are compared with
+// the Hostinfo the MESH client reports. The node key is kept by the MESH app
+// in storage the ADB shell cannot read, so it is recorded from the MESH side
+// only.
+func bindDevice(ctx context.Context, peer *AndroidPeer, serial string) *deviceBinding {
+	checkADBClient()
+	b := &deviceBinding{
+		Time: time.Now().UTC(),
+		Peer: bindingPeer{
+			NodeID:   peer.NodeID,
+			NodeKey:  peer.NodeKey,
+			HostName: peer.HostName,
+		},
+		Device: bindingDevice{ADBSerial: serial},
+	}
+
+	var meshIPs []netip.Addr
+	if st, err := localClient.Status(ctx); err == nil {
+		for _, k := range st.Peers() {
+			if ps := st.Peer[k]; string(ps.ID) == peer.NodeID {
+				meshIPs = ps.TailscaleIPs
+			}
+		}
+	}
+	for _, ip := range meshIPs {
+		b.Peer.MeshIPs = append(b.Peer.MeshIPs, ip.String())
+	}
+	if len(meshIPs) > 0 {
+		if who, err := localClient.WhoIs(ctx, meshIPs[0].String()); err == nil && who.Node != nil && who.Node.Hostinfo.Valid() {
+			b.Peer.OSVersion = who.Node.Hostinfo.OSVersion()
+			b.Peer.DeviceModel = who.Node.Hostinfo.DeviceModel()
+		}
+	}
+
+	getprop := func(name string) string {
+		out, err := adb.Client.Shell("getprop", name)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(out)
+	}
+	b.Device.SerialNo = getprop("ro.serialno")
+	b.Device.Fingerprint = getprop("ro.build.fingerprint")
+	b.Device.Manufacturer = getprop("ro.product.manufacturer")
+	b.Device.Model = getprop("ro.product.model")
+	b.Device.OSVersion = getprop("ro.build.version.release")
+	deviceIPs := deviceInterfaceAddrs()
+	for _, ip := range deviceIPs {
+		b.Device.InterfaceIPs = append(b.Device.InterfaceIPs, ip.String())
+	}
+
+	addrCheck := bindingCheck{Name: "mesh_address", Expected: strings.Join(b.Peer.MeshIPs, ",")}
+	switch {
+	case len(meshIPs) == 0 || len(deviceIPs) == 0:
+		addrCheck.Result = bindingUnknown
+	case slices.ContainsFunc(meshIPs, func(ip netip.Addr) bool { return slices.Contains(deviceIPs, ip) }):
+		addrCheck.Result = bindingMatch
+	default:
+		addrCheck.Result = bindingMismatch
+	}
+	addrCheck.Actual = strings.Join(b.Device.InterfaceIPs, ",")
+	b.Checks = append(b.Checks, addrCheck)
+
+	b.Checks = append(b.Checks, compareBinding("device_model", b.Peer.DeviceModel,
+		androidModelName(b.Device.Manufacturer, b.Device.Model), func(want, got string) bool {
+			// ChromeOS devices report a "ChromeOS: " prefix.
+			return strings.HasSuffix(strings.ToLower(want), strings.ToLower(got))
+		}))
+	b.Checks = append(b.Checks, compareBinding("os_version", b.Peer.OSVersion, b.Device.OSVersion, func(want, got string) bool {
+		// The MESH client may append " [nogoogle]".
+		return want == got || strings.HasPrefix(want, got+" ")
+	}))
+	return b
+}
+
+func compareBinding(name, want, got string, equal func(want, got string) bool) bindingCheck {
+	c := bindingCheck{Name: name, Expected: want, Actual: got, Result: bindingUnknown}
+	if want != "" && got != "" {
+		c.Result = bindingMismatch
+		if equal(want, got) {
+			c.Result = bindingMatch
+		}
+	}
+	return c
+}
+
+// androidModelName builds the model name the way the MESH Android client
+// reports it in Hostinfo: the manufacturer followed by the model, with the
+// manufacturer removed from the model if it is repeated there.
+func androidModelName(manufacturer, model string) string {
+	if manufacturer == "" || model == "" {
+		return ""
+	}
+	if i := strings.Index(strings.ToLower(model), strings.ToLower(manufacturer)); i != -1 {
+		model = strings.TrimSpace(model[i+len(manufacturer):])
+	}
+	return manufacturer + " " + model
+}
+
+// deviceInterfaceAddrs lists the IP addresses configured on the device.
+func deviceInterfaceAddrs() []netip.Addr {
+	out, err := adb.Client.Shell("ip", "-o", "addr", "show")
+	if err != nil {
+		return nil
+	}
+	var addrs []netip.Addr
+	for line := range strings.SplitSeq(out, "\n") {
+		f := strings.Fields(line)
+		for i := 0; i+1 < len(f); i++ {
+			if f[i] != "inet" && f[i] != "inet6" {
+				continue
+			}
+			if p, err := netip.ParsePrefix(f[i+1]); err == nil {
+				addrs = append(addrs, p.Addr().WithZone(""))
+			}
+		}
+	}
+	return addrs
+}
+
+// peerForSerial finds the Android MESH peer a wireless ADB serial points to.
+func peerForSerial(ctx context.Context, serial string) (*AndroidPeer, error) {
+	host, _, err := net.SplitHostPort(serial)
+	if err != nil {
+		return nil, fmt.Errorf("device %s is not connected over the network", serial)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, fmt.Errorf("device %s is not connected by IP address", serial)
+	}
+	peers, err := getAndroidPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range peers {
+		if slices.Contains(p.TailscaleIPs, addr.WithZone("")) {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not an Android MESH peer", host)
+}
+
+// printBinding reports the binding checks to the analyst.
+func printBinding(b *deviceBinding) {
+	fmt.Printf("Device identity binding with MESH peer %s:\n", sanitizeForTerminal(b.Peer.HostName))
+	for _, c := range b.Checks {
+		fmt.Printf("  %-13s %-9s expected %q, device reports %q\n", c.Name, c.Result,
+			sanitizeForTerminal(c.Expected), sanitizeForTerminal(c.Actual))
+	}
+}
+
+// checkBinding prints the binding, records it in the case log and fails on
+// a mismatch, or on checks that could not be made, unless allowMismatch is
+// set.
+func checkBinding(c *Case, b *deviceBinding, allowMismatch bool) error {
+	printBinding(b)
+	logCase(c, "device_binding", map[string]any{"binding": b})
+	bad := b.failures()
+	if len(bad) == 0 {
+		return nil
+	}
+	var names []string
+	for _, m := range bad {
+		names = append(names, m.Name+" "+m.Result)
+	}
+	err := fmt.Errorf("the ADB device cannot be bound to MESH peer %s (%s)", sanitizeForTerminal(b.Peer.HostName), strings.Join(names, ", "))
+	if allowMismatch {
+		fmt.Printf("WARNING: %v; continuing as requested\n", err)
+		return nil
+	}
+	return err
+}
+
+func writeBinding(dir string, b *deviceBinding) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, bindingFile), data, 0o600)
+}
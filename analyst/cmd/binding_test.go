@@ -0,0 +1,56 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBindingFailures(t *testing.T) {
+	check := func(name, result string) bindingCheck {
+		return bindingCheck{Name: name, Result: result}
+	}
+	tests := []struct {
+		name   string
+		checks []bindingCheck
+		want   []string
+	}{
+		{
+			name:   "all-match",
+			checks: []bindingCheck{check("mesh_address", bindingMatch), check("device_model", bindingMatch), check("os_version", bindingMatch)},
+		},
+		{
+			name:   "metadata-unknown",
+			checks: []bindingCheck{check("mesh_address", bindingMatch), check("device_model", bindingUnknown), check("os_version", bindingUnknown)},
+		},
+		{
+			name:   "mismatch",
+			checks: []bindingCheck{check("mesh_address", bindingMatch), check("device_model", bindingMismatch), check("os_version", bindingMatch)},
+			want:   []string{"device_model"},
+		},
+		{
+			name:   "address-unknown",
+			checks: []bindingCheck{check("mesh_address", bindingUnknown), check("device_model", bindingMatch), check("os_version", bindingMatch)},
+			want:   []string{"mesh_address"},
+		},
+		{
+			name:   "all-unknown",
+			checks: []bindingCheck{check("mesh_address", bindingUnknown), check("device_model", bindingUnknown), check("os_version", bindingUnknown)},
+			want:   []string{"mesh_address", "device_model", "os_version"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &deviceBinding{Checks: tt.checks}
+			var got []string
+			for _, c := range b.failures() {
+				got = append(got, c.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("failures() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
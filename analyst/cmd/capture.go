@@ -0,0 +1,310 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var captureArgs struct {
+	out         string
+	filter      string
+	rotateSize  int64
+	rotateEvery time.Duration
+	duration    time.Duration
+	caseDir     string
+}
+
+func CaptureCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	fs.StringVar(&captureArgs.out, "out", "", "pcapng file to write (required)")
+	fs.StringVar(&captureArgs.filter, "filter", "", "only keep packets matching this filter, e.g. \"tcp port 443 or udp port 53\"")
+	fs.Int64Var(&captureArgs.rotateSize, "rotate-size", 0, "start a new file after this many MiB (0 for no limit)")
+	fs.DurationVar(&captureArgs.rotateEvery, "rotate-every", 0, "start a new file after this long (0 for no limit)")
+	fs.DurationVar(&captureArgs.duration, "duration", 0, "stop after this long (default: until interrupted)")
+	fs.StringVar(&captureArgs.caseDir, "case", "", "case to record the capture in (default: $"+caseEnv+" or the current case)")
+
+	return &ffcli.Command{
+		Name:       "capture",
+		ShortUsage: "meshcli capture [flags] --out <file.pcapng> <peer>",
+		ShortHelp:  "Capture a peer's traffic to a pcapng file",
+		LongHelp: strings.TrimSpace(`
+Captures the traffic between the MESH network and a peer, given by
+hostname, MagicDNS name or MESH IP, as seen by the local MESH client. When
+the analyst node is the peer's exit node, this includes the peer's internet
+traffic; no tcpdump or iptables setup is needed.
+
+Packets are written as raw IP to a pcapng file that Wireshark and tshark
+read directly, marked inbound (from the peer) or outbound. The section
+header carries comments with the peer's identity (hostname, node ID, node
+key, MESH IPs), the analyst host and key fingerprint, the filter and the
+capture start time; the file ends with interface statistics holding the
+start and stop times, the packet count and why the capture stopped.
+
+--filter takes a subset of the pcap-filter syntax: [src|dst] host <addr>,
+[src|dst] net <prefix>, [src|dst] port <n>, tcp, udp, icmp, icmp6, ip and
+ip6, combined with not (!), and (&&), or (||) and parentheses. Comparisons
+such as != or tcp[13] = 2 are not supported and are rejected.
+
+With --rotate-size or --rotate-every, a new file is started when the
+current one reaches the size or age (checked as packets arrive); files are
+numbered <out>-0001.pcapng, <out>-0002.pcapng and so on.
+
+Each file is hashed when it is closed. The SHA-256 is written next to it
+in <file>.sha256, in the format of sha256sum, and recorded in the case log
+with the packet count and time span. The capture stops on Ctrl-C, after
+--duration, or when the MESH client ends the stream.
+
+Examples:
+  meshcli capture --out pixel-7.pcapng pixel-7
+  meshcli capture --out dns.pcapng --filter "udp port 53" 100.64.0.5
+  meshcli capture --out pixel-7.pcapng --rotate-size 100 --duration 24h pixel-7
+`),
+		FlagSet: fs,
+		Exec:    runCapture,
+	}
+}
+
+// captureSession writes a capture to one or more rotated pcapng files.
+type captureSession struct {
+	base     string
+	rotate   bool
+	comments []string
+	c        *Case
+
+	index   int
+	f       *os.File
+	pw      *pcapngWriter
+	started time.Time
+
+	files   []string
+	packets uint64
+}
+
+func runCapture(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: meshcli capture [flags] --out <file.pcapng> <peer>")
+	}
+	if captureArgs.out == "" {
+		return errors.New("--out is required")
+	}
+	filter, err := parseCaptureFilter(captureArgs.filter)
+	if err != nil {
+		return fmt.Errorf("invalid --filter: %w", err)
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	ps, err := findPeer(st, args[0])
+	if err != nil {
+		return err
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("peer %s has no MESH address", args[0])
+	}
+	peerIPs := ps.TailscaleIPs
+
+	c, err := openCase(captureArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	priv, err := loadAnalystKey()
+	if err != nil {
+		return err
+	}
+	fingerprint := keyFingerprint(priv.Public().(ed25519.PublicKey))
+	hostname, _ := os.Hostname()
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if captureArgs.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, captureArgs.duration)
+		defer cancel()
+	}
+
+	rc, err := localClient.StreamDebugCapture(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start capture: %w", err)
+	}
+	defer rc.Close()
+	// Reads from the stream block until a packet arrives; closing it is
+	// what ends the capture on Ctrl-C or --duration.
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	cr, err := newCaptureReader(rc)
+	if err != nil {
+		return err
+	}
+
+	var ips []string
+	for _, ip := range peerIPs {
+		ips = append(ips, ip.String())
+	}
+	start := time.Now().UTC()
+	s := &captureSession{
+		base:   captureArgs.out,
+		rotate: captureArgs.rotateSize > 0 || captureArgs.rotateEvery > 0,
+		c:      c,
+		comments: []string{
+			fmt.Sprintf("MESH capture of peer %s (%s), node ID %s, node key %s, MESH IPs %s",
+				ps.HostName, ps.DNSName, ps.ID, ps.PublicKey, strings.Join(ips, ", ")),
+			fmt.Sprintf("Captured on %s by analyst key %s", hostname, fingerprint),
+			fmt.Sprintf("Capture started %s", start.Format(time.RFC3339Nano)),
+			fmt.Sprintf("Filter: %s", orDash(captureArgs.filter)),
+		},
+	}
+	logCase(c, "capture_started", map[string]any{
+		"peer":      ps.HostName,
+		"node_id":   string(ps.ID),
+		"node_key":  ps.PublicKey.String(),
+		"mesh_ips":  ips,
+		"filter":    captureArgs.filter,
+		"out":       captureArgs.out,
+		"duration":  captureArgs.duration.String(),
+		"rotate_mb": captureArgs.rotateSize,
+	})
+	if err := s.open(); err != nil {
+		return err
+	}
+	fmt.Printf("Capturing traffic of %s (%s) to %s, Ctrl-C to stop...\n", sanitizeForTerminal(ps.HostName), strings.Join(ips, ", "), s.f.Name())
+
+	reason, captureErr := s.run(ctx, cr, peerIPs, filter)
+	if err := s.close(reason); err != nil && captureErr == nil {
+		captureErr = err
+	}
+	logCase(c, "capture_stopped", stepDetails(captureErr, map[string]any{
+		"reason":  reason,
+		"files":   s.files,
+		"packets": s.packets,
+	}))
+	fmt.Printf("Capture stopped (%s): %d packets in %d file(s)\n", reason, s.packets, len(s.files))
+	return captureErr
+}
+
+// run copies the peer's packets from the stream until it ends and returns
+// why it stopped.
+func (s *captureSession) run(ctx context.Context, cr *captureReader, peerIPs []netip.Addr, filter captureFilter) (string, error) {
+	maxBytes := captureArgs.rotateSize << 20
+	for {
+		p, err := cr.next()
+		if err != nil {
+			switch {
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				return "duration reached", nil
+			case ctx.Err() != nil:
+				return "interrupted", nil
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				return "capture stream ended", nil
+			}
+			return "error", fmt.Errorf("reading capture stream: %w", err)
+		}
+		if p.Path == pathDisco {
+			continue
+		}
+		ip, ok := parseIPPacket(p.Data)
+		if !ok || !(slices.Contains(peerIPs, ip.src) || slices.Contains(peerIPs, ip.dst)) || !filter(&ip) {
+			continue
+		}
+
+		if s.pw.packets > 0 && ((maxBytes > 0 && s.pw.bytes >= maxBytes) ||
+			(captureArgs.rotateEvery > 0 && time.Since(s.started) >= captureArgs.rotateEvery)) {
+			if err := s.close("rotated"); err != nil {
+				return "error", err
+			}
+			if err := s.open(); err != nil {
+				return "error", err
+			}
+		}
+		inbound := p.Path == pathFromPeer || p.Path == pathSynthesizedToLocal
+		if err := s.pw.writePacket(p, inbound); err != nil {
+			return "error", fmt.Errorf("writing %s: %w", s.f.Name(), err)
+		}
+		s.packets++
+	}
+}
+
+func (s *captureSession) open() error {
+	s.index++
+	path := s.base
+	if s.rotate {
+		ext := filepath.Ext(s.base)
+		path = fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(s.base, ext), s.index, ext)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create capture file: %w", err)
+	}
+	s.started = time.Now().UTC()
+	comments := s.comments
+	if s.rotate {
+		comments = append(slices.Clip(comments), fmt.Sprintf("File %d, opened %s", s.index, s.started.Format(time.RFC3339Nano)))
+	}
+	pw, err := newPcapngWriter(f, comments)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	s.f, s.pw = f, pw
+	return nil
+}
+
+// close ends the current file, hashes it and records it in the case log.
+func (s *captureSession) close(reason string) error {
+	if s.f == nil {
+		return nil
+	}
+	f, pw := s.f, s.pw
+	s.f, s.pw = nil, nil
+	end := time.Now().UTC()
+	err := pw.close(s.started, end, fmt.Sprintf("Capture stopped %s: %s", end.Format(time.RFC3339Nano), reason))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("closing %s: %w", f.Name(), err)
+	}
+
+	sum, size, err := writeChecksum(f.Name())
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f.Name())
+	details := map[string]any{
+		"path":    f.Name(),
+		"sha256":  sum,
+		"size":    size,
+		"packets": pw.packets,
+		"reason":  reason,
+	}
+	if pw.packets > 0 {
+		details["first_packet"] = pw.first
+		details["last_packet"] = pw.last
+	}
+	logCase(s.c, "capture_file", details)
+	fmt.Printf("Wrote %s (%d packets, SHA-256 %s)\n", f.Name(), pw.packets, sum)
+	return nil
+}
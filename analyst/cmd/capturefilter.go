@@ -0,0 +1,263 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ipPacket holds the fields of an IP packet that capture filters look at.
+type ipPacket struct {
+	version  int
+	proto    uint8
+	src, dst netip.Addr
+	sport    uint16
+	dport    uint16
+	hasPorts bool
+	// payload is the TCP or UDP payload, when the header is complete.
+	payload []byte
+}
+
+// IP protocol numbers.
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// parseIPPacket decodes the IP header of a raw packet. It returns false for
+// data that is not an IPv4 or IPv6 packet.
+func parseIPPacket(b []byte) (ipPacket, bool) {
+	var p ipPacket
+	if len(b) < 1 {
+		return p, false
+	}
+	var payload []byte
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if len(b) < 20 || ihl < 20 || len(b) < ihl {
+			return p, false
+		}
+		p.version, p.proto = 4, b[9]
+		p.src = netip.AddrFrom4([4]byte(b[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(b[16:20]))
+		// Only the first fragment carries the ports.
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			payload = b[ihl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return p, false
+		}
+		// Extension headers are not followed; their packets match on
+		// addresses but not on protocol or ports.
+		p.version, p.proto = 6, b[6]
+		p.src = netip.AddrFrom16([16]byte(b[8:24]))
+		p.dst = netip.AddrFrom16([16]byte(b[24:40]))
+		payload = b[40:]
+	default:
+		return p, false
+	}
+	if (p.proto == protoTCP || p.proto == protoUDP) && len(payload) >= 4 {
+		p.sport = binary.BigEndian.Uint16(payload[0:2])
+		p.dport = binary.BigEndian.Uint16(payload[2:4])
+		p.hasPorts = true
+		switch {
+		case p.proto == protoUDP && len(payload) >= 8:
+			p.payload = payload[8:]
+		case p.proto == protoTCP && len(payload) >= 20:
+			if hl := int(payload[12]>>4) * 4; hl >= 20 && len(payload) >= hl {
+				p.payload = payload[hl:]
+			}
+		}
+	}
+	return p, true
+}
+
+// captureFilter decides whether a packet is kept.
+type captureFilter func(p *ipPacket) bool
+
+// parseCaptureFilter compiles a filter in a subset of the pcap-filter
+// syntax:
+//
+//	[src|dst] host <addr>    [src|dst] net <prefix>    [src|dst] port <n>
+//	tcp  udp  icmp  icmp6  ip  ip6
+//
+// combined with not, and, or and parentheses. "and" may be left out.
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	fp := &filterParser{tokens: tokens}
+	if len(fp.tokens) == 0 {
+		return func(*ipPacket) bool { return true }, nil
+	}
+	f, err := fp.or()
+	if err != nil {
+		return nil, err
+	}
+	if fp.pos < len(fp.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", fp.tokens[fp.pos])
+	}
+	return f, nil
+}
+
+// tokenizeFilter splits a filter into words and parentheses, spelling out
+// the operators !, && and ||. The comparisons of full pcap-filter syntax
+// are not supported; they are rejected here since ! would otherwise turn
+// != into a negation.
+func tokenizeFilter(expr string) ([]string, error) {
+	if strings.ContainsAny(expr, "=<>") {
+		return nil, fmt.Errorf("comparison operators (=, !=, <, >) are not supported in capture filters")
+	}
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " not ", "&&", " and ", "||", " or ").Replace(expr)
+	return strings.Fields(strings.ToLower(expr)), nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (fp *filterParser) peek() string {
+	if fp.pos < len(fp.tokens) {
+		return fp.tokens[fp.pos]
+	}
+	return ""
+}
+
+func (fp *filterParser) take() string {
+	t := fp.peek()
+	fp.pos++
+	return t
+}
+
+func (fp *filterParser) or() (captureFilter, error) {
+	left, err := fp.and()
+	if err != nil {
+		return nil, err
+	}
+	for fp.peek() == "or" {
+		fp.take()
+		right, err := fp.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *ipPacket) bool { return l(p) || right(p) }
+	}
+	return left, nil
+}
+
+func (fp *filterParser) and() (captureFilter, error) {
+	left, err := fp.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch fp.peek() {
+		case "", "or", ")":
+			return left, nil
+		case "and":
+			fp.take()
+		}
+		right, err := fp.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *ipPacket) bool { return l(p) && right(p) }
+	}
+}
+
+func (fp *filterParser) unary() (captureFilter, error) {
+	switch fp.peek() {
+	case "not":
+		fp.take()
+		f, err := fp.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *ipPacket) bool { return !f(p) }, nil
+	case "(":
+		fp.take()
+		f, err := fp.or()
+		if err != nil {
+			return nil, err
+		}
+		if fp.take() != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		return f, nil
+	}
+	return fp.primitive()
+}
+
+func (fp *filterParser) primitive() (captureFilter, error) {
+	tok := fp.take()
+	switch tok {
+	case "tcp":
+		return func(p *ipPacket) bool { return p.proto == protoTCP }, nil
+	case "udp":
+		return func(p *ipPacket) bool { return p.proto == protoUDP }, nil
+	case "icmp":
+		return func(p *ipPacket) bool { return p.proto == protoICMP }, nil
+	case "icmp6":
+		return func(p *ipPacket) bool { return p.proto == protoICMPv6 }, nil
+	case "ip":
+		return func(p *ipPacket) bool { return p.version == 4 }, nil
+	case "ip6":
+		return func(p *ipPacket) bool { return p.version == 6 }, nil
+	case "":
+		return nil, fmt.Errorf("filter ends unexpectedly")
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+		tok = fp.take()
+	case "dst":
+		src = false
+		tok = fp.take()
+	}
+	arg := fp.take()
+	if arg == "" {
+		return nil, fmt.Errorf("%s needs an argument", tok)
+	}
+	either := func(match func(a netip.Addr, port uint16) bool) captureFilter {
+		return func(p *ipPacket) bool {
+			return (src && match(p.src, p.sport)) || (dst && match(p.dst, p.dport))
+		}
+	}
+	switch tok {
+	case "host":
+		addr, err := netip.ParseAddr(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q: %w", arg, err)
+		}
+		return either(func(a netip.Addr, _ uint16) bool { return a == addr }), nil
+	case "net":
+		prefix, err := netip.ParsePrefix(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q: %w", arg, err)
+		}
+		return either(func(a netip.Addr, _ uint16) bool { return prefix.Contains(a) }), nil
+	case "port":
+		n, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		f := either(func(_ netip.Addr, port uint16) bool { return port == uint16(n) })
+		return func(p *ipPacket) bool { return p.hasPorts && f(p) }, nil
+	}
+	return nil, fmt.Errorf("unknown filter primitive %q", tok)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPacket builds an IPv4 or IPv6 packet with a minimal TCP or UDP
+// header, or no transport header for other protocols.
+func testPacket(proto uint8, src, dst string, sport, dport uint16, payload []byte) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	var l4 []byte
+	switch proto {
+	case protoTCP:
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+	case protoUDP:
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[4:6], uint16(8+len(payload)))
+	}
+	if l4 != nil {
+		binary.BigEndian.PutUint16(l4[0:2], sport)
+		binary.BigEndian.PutUint16(l4[2:4], dport)
+	}
+	l4 = append(l4, payload...)
+
+	if s.Is4() {
+		b := make([]byte, 20, 20+len(l4))
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:4], uint16(20+len(l4)))
+		b[8] = 64
+		b[9] = proto
+		copy(b[12:16], s.AsSlice())
+		copy(b[16:20], d.AsSlice())
+		return append(b, l4...)
+	}
+	b := make([]byte, 40, 40+len(l4))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(l4)))
+	b[6] = proto
+	b[7] = 64
+	copy(b[8:24], s.AsSlice())
+	copy(b[24:40], d.AsSlice())
+	return append(b, l4...)
+}
+
+func TestParseIPPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		ok      bool
+		want    ipPacket
+		payload string
+	}{
+		{
+			name:    "ipv4-tcp",
+			data:    testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40000, 443, []byte("hello")),
+			ok:      true,
+			want:    ipPacket{version: 4, proto: protoTCP, src: netip.MustParseAddr("100.64.0.5"), dst: netip.MustParseAddr("203.0.113.9"), sport: 40000, dport: 443, hasPorts: true},
+			payload: "hello",
+		},
+		{
+			name:    "ipv6-udp",
+			data:    testPacket(protoUDP, "fd7a:115c:a1e0::5", "2001:db8::53", 41000, 53, []byte("query")),
+			ok:      true,
+			want:    ipPacket{version: 6, proto: protoUDP, src: netip.MustParseAddr("fd7a:115c:a1e0::5"), dst: netip.MustParseAddr("2001:db8::53"), sport: 41000, dport: 53, hasPorts: true},
+			payload: "query",
+		},
+		{
+			name: "icmp",
+			data: testPacket(protoICMP, "100.64.0.5", "203.0.113.9", 0, 0, []byte{8, 0, 0, 0}),
+			ok:   true,
+			want: ipPacket{version: 4, proto: protoICMP, src: netip.MustParseAddr("100.64.0.5"), dst: netip.MustParseAddr("203.0.113.9")},
+		},
+		{
+			name: "later-fragment",
+			data: func() []byte {
+				b := testPacket(protoUDP, "100.64.0.5", "203.0.113.9", 1, 2, nil)
+				binary.BigEndian.PutUint16(b[6:8], 185)
+				return b
+			}(),
+			ok:   true,
+			want: ipPacket{version: 4, proto: protoUDP, src: netip.MustParseAddr("100.64.0.5"), dst: netip.MustParseAddr("203.0.113.9")},
+		},
+		{name: "empty"},
+		{name: "short-ipv4", data: testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 1, 2, nil)[:19]},
+		{name: "not-ip", data: []byte{0x20, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseIPPacket(tt.data)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if string(got.payload) != tt.payload {
+				t.Errorf("payload %q, want %q", got.payload, tt.payload)
+			}
+			got.payload = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCaptureFilter(t *testing.T) {
+	packets := map[string][]byte{
+		"tcp-out":  testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40000, 443, nil),
+		"tcp-in":   testPacket(protoTCP, "203.0.113.9", "100.64.0.5", 443, 40000, nil),
+		"udp-dns":  testPacket(protoUDP, "100.64.0.5", "198.51.100.53", 41000, 53, nil),
+		"udp6-dns": testPacket(protoUDP, "fd7a:115c:a1e0::5", "2001:db8::53", 41000, 53, nil),
+		"icmp":     testPacket(protoICMP, "100.64.0.5", "203.0.113.9", 0, 0, nil),
+	}
+	tests := []struct {
+		filter string
+		want   string // names of the kept packets, in the order of names
+	}{
+		{"", "tcp-out tcp-in udp-dns udp6-dns icmp"},
+		{"tcp", "tcp-out tcp-in"},
+		{"ip6", "udp6-dns"},
+		{"icmp6", ""},
+		{"host 203.0.113.9", "tcp-out tcp-in icmp"},
+		{"src host 203.0.113.9", "tcp-in"},
+		{"dst net 198.51.100.0/24", "udp-dns"},
+		{"net 2001:db8::/32", "udp6-dns"},
+		{"port 53", "udp-dns udp6-dns"},
+		{"src port 443", "tcp-in"},
+		{"dst port 443", "tcp-out"},
+		// Ports never match packets without them.
+		{"port 0", ""},
+		{"not port 0", "tcp-out tcp-in udp-dns udp6-dns icmp"},
+		{"not tcp", "udp-dns udp6-dns icmp"},
+		{"! tcp", "udp-dns udp6-dns icmp"},
+		// and binds tighter than or, also when it is implied.
+		{"udp or tcp and dst port 443", "tcp-out udp-dns udp6-dns"},
+		{"udp or tcp dst port 443", "tcp-out udp-dns udp6-dns"},
+		{"(udp or tcp) and dst port 443", "tcp-out"},
+		{"udp || tcp && dst port 443", "tcp-out udp-dns udp6-dns"},
+		{"not (tcp or udp)", "icmp"},
+		{"not tcp and not icmp", "udp-dns udp6-dns"},
+		{"not not icmp", "icmp"},
+		{"((ip) and (port 53))", "udp-dns"},
+		{"TCP AND SRC PORT 40000", "tcp-out"},
+	}
+	names := []string{"tcp-out", "tcp-in", "udp-dns", "udp6-dns", "icmp"}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			f, err := parseCaptureFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept []string
+			for _, name := range names {
+				p, ok := parseIPPacket(packets[name])
+				if !ok {
+					t.Fatalf("%s: not parsed", name)
+				}
+				if f(&p) {
+					kept = append(kept, name)
+				}
+			}
+			if got := strings.Join(kept, " "); got != tt.want {
+				t.Errorf("kept %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCaptureFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    string
+	}{
+		{"port != 53", "not supported"},
+		{"tcp[13] = 2", "not supported"},
+		{"len > 100", "not supported"},
+		{"host", "needs an argument"},
+		{"src", "needs an argument"},
+		{"host example.com", "invalid host"},
+		{"net 10.0.0.1", "invalid net"},
+		{"port 70000", "invalid port"},
+		{"port https", "invalid port"},
+		{"ether host 00:11:22:33:44:55", "unknown filter primitive"},
+		{"(tcp", "missing )"},
+		{"tcp)", "unexpected"},
+		{"tcp and", "ends unexpectedly"},
+		{"not", "ends unexpectedly"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			_, err := parseCaptureFilter(tt.filter)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rt "github.com/botherder/go-savetime/runtime"
+	"github.com/google/uuid"
+)
+
+// caseEnv names the environment variable that selects the case directory
+// when --case is not given.
+const caseEnv = "MESH_CASE"
+
+const (
+	caseLogFile     = "case.log"
+	caseCurrentFile = "current"
+)
+
+// Case is the directory holding everything recorded for one analyst
+// session with one device: the session's ADB key and the case log, which
+// ties the MESH peer, the ADB device and the acquisitions together.
+type Case struct {
+	ID  string
+	Dir string
+}
+
+// CaseEvent is one line of the case log. The log is append-only and hash
+// chained: Hash covers every other field including the previous entry's hash,
+// and Sig is the analyst's Ed25519 signature of Hash, so that removing,
+// reordering or editing an entry breaks verification from that entry on.
+type CaseEvent struct {
+	Seq     int             `json:"seq"`
+	Time    time.Time       `json:"time"`
+	Event   string          `json:"event"`
+	Details json.RawMessage `json:"details,omitempty"`
+	Prev    string          `json:"prev"`
+	Hash    string          `json:"hash,omitempty"`
+	Sig     string          `json:"sig,omitempty"`
+}
+
+// eventCaseCreated is always the first entry of a case log. It carries the
+// analyst public key that signs the rest of the log.
+const eventCaseCreated = "case_created"
+
+func casesRoot() string {
+	return filepath.Join(rt.GetExecutableDirectory(), "cases")
+}
+
+// openCase returns the case selected by path, $MESH_CASE or the current
+// case marker, in that order. If none is selected and create is set, a new
+// case is created and becomes the current case; otherwise it returns nil.
+func openCase(path string, create bool) (*Case, error) {
+	if path == "" {
+		path = os.Getenv(caseEnv)
+	}
+	if path == "" {
+		if id, err := os.ReadFile(filepath.Join(casesRoot(), caseCurrentFile)); err == nil {
+			// The marker holds an ID, or an absolute path for cases
+			// kept outside the cases directory.
+			path = strings.TrimSpace(string(id))
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(casesRoot(), path)
+			}
+		}
+	}
+
+	if path != "" {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open case: %w", err)
+		}
+		if !st.IsDir() {
+			return nil, fmt.Errorf("case %s is not a directory", path)
+		}
+		return &Case{ID: filepath.Base(path), Dir: path}, nil
+	}
+
+	if !create {
+		return nil, nil
+	}
+	return newCase("")
+}
+
+// newCase creates a fresh case directory, starts its log and makes it the
+// current case.
+func newCase(label string) (*Case, error) {
+	return createCase(label, true)
+}
+
+// createCase is newCase, but only makes the case current if current is set.
+// Commands that open a case per device, alongside the analyst's current
+// case, leave the current case alone.
+func createCase(label string, current bool) (*Case, error) {
+	id := time.Now().UTC().Format("20060102-150405") + "-" + uuid.New().String()[:8]
+	c := &Case{ID: id, Dir: filepath.Join(casesRoot(), id)}
+	if err := os.MkdirAll(c.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create case directory: %w", err)
+	}
+	if current {
+		if err := os.WriteFile(filepath.Join(casesRoot(), caseCurrentFile), []byte(id+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("unable to mark current case: %w", err)
+		}
+	}
+	hostname, _ := os.Hostname()
+	details := map[string]any{"analyst_host": hostname}
+	if label != "" {
+		details["label"] = label
+	}
+	if err := c.Log(eventCaseCreated, details); err != nil {
+		return nil, fmt.Errorf("unable to start case log: %w", err)
+	}
+	fmt.Printf("Created case %s in %s\n", c.ID, c.Dir)
+	return c, nil
+}
+
+// ADBKeyPath returns where the case's ADB private key is stored.
+func (c *Case) ADBKeyPath() string {
+	return filepath.Join(c.Dir, "adb", "adbkey")
+}
+
+// Log appends a signed event to the case log, starting the log with a
+// case_created entry if it is empty.
+func (c *Case) Log(event string, details map[string]any) error {
+	priv, err := loadAnalystKey()
+	if err != nil {
+		return err
+	}
+
+	// capture, monitor, ioc and the other long-running commands append to
+	// the same case from separate processes. The exclusive lock covers
+	// reading the chain head and appending after it, so that two writers
+	// cannot chain to the same entry.
+	f, err := os.OpenFile(c.logPath(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock case log: %w", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	entries, err := parseCaseLog(f, c.logPath())
+	if err != nil {
+		return err
+	}
+
+	var head *CaseEvent
+	if len(entries) > 0 {
+		head = &entries[len(entries)-1]
+	} else {
+		pub := priv.Public().(ed25519.PublicKey)
+		genesis := map[string]any{
+			"id":                  c.ID,
+			"analyst_key":         base64.StdEncoding.EncodeToString(pub),
+			"analyst_fingerprint": keyFingerprint(pub),
+		}
+		if event == eventCaseCreated {
+			maps.Copy(genesis, details)
+			_, err = appendCaseEvent(f, priv, nil, eventCaseCreated, genesis)
+			return err
+		}
+		head, err = appendCaseEvent(f, priv, nil, eventCaseCreated, genesis)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = appendCaseEvent(f, priv, head, event, details)
+	return err
+}
+
+// Head returns the last entry of the case log, or nil if the log is empty.
+func (c *Case) Head() (*CaseEvent, error) {
+	entries, err := readCaseLog(c.logPath())
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[len(entries)-1], nil
+}
+
+func (c *Case) logPath() string {
+	return filepath.Join(c.Dir, caseLogFile)
+}
+
+func appendCaseEvent(w io.Writer, priv ed25519.PrivateKey, head *CaseEvent, event string, details map[string]any) (*CaseEvent, error) {
+	ev := &CaseEvent{Time: time.Now().UTC(), Event: event}
+	if head != nil {
+		ev.Seq = head.Seq + 1
+		ev.Prev = head.Hash
+	}
+	if details != nil {
+		b, err := json.Marshal(details)
+		if err != nil {
+			return nil, err
+		}
+		ev.Details = b
+	}
+	sum, err := ev.digest()
+	if err != nil {
+		return nil, err
+	}
+	ev.Hash = hex.EncodeToString(sum)
+	ev.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, sum))
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// digest hashes the entry without its Hash and Sig.
+func (e CaseEvent) digest() ([]byte, error) {
+	e.Hash, e.Sig = "", ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+func readCaseLog(path string) ([]CaseEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// A shared lock keeps a concurrent append from being read half
+	// written.
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("unable to lock case log: %w", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return parseCaseLog(f, path)
+}
+
+func parseCaseLog(r io.Reader, path string) ([]CaseEvent, error) {
+	var entries []CaseEvent
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var ev CaseEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, len(entries)+1, err)
+		}
+		entries = append(entries, ev)
+	}
+	return entries, sc.Err()
+}
+
+// stepDetails adds the outcome of a step to details.
+func stepDetails(err error, details map[string]any) map[string]any {
+	if details == nil {
+		details = map[string]any{}
+	}
+	if err != nil {
+		details["status"] = statusFailed
+		details["error"] = err.Error()
+	} else {
+		details["status"] = statusSucceeded
+	}
+	return details
+}
+
+// logCase records an event in c, if there is a case, and only warns when the
+// log cannot be written so that a full disk does not abort device work.
+func logCase(c *Case, event string, details map[string]any) {
+	if c == nil {
+		return
+	}
+	if err := c.Log(event, details); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to write case log: %v\n", err)
+	}
+}
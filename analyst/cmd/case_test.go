@@ -0,0 +1,163 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestMain points the analyst key at a temporary file for the whole test
+// binary, since loadAnalystKey caches the first key it loads.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mesh-analyst")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv(analystKeyEnv, filepath.Join(dir, analystKeyFile))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useTestAnalystKey returns the test binary's analyst key.
+func useTestAnalystKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	priv, err := loadAnalystKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func testCase(t *testing.T) *Case {
+	t.Helper()
+	useTestAnalystKey(t)
+	dir := t.TempDir()
+	return &Case{ID: filepath.Base(dir), Dir: dir}
+}
+
+func TestCaseLogConcurrentAppends(t *testing.T) {
+	c := testCase(t)
+	const writers, events = 8, 25
+
+	// Each append opens the log itself, like separate meshcli processes.
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Go(func() {
+			for i := range events {
+				if err := c.Log("test_event", map[string]any{"writer": w, "i": i}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	v, err := verifyCase(c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Problems) > 0 {
+		t.Errorf("problems: %v", v.Problems)
+	}
+	if got, want := len(v.Entries), writers*events+1; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+}
+
+func TestVerifyCaseAnalyst(t *testing.T) {
+	priv := useTestAnalystKey(t)
+	local := keyFingerprint(priv.Public().(ed25519.PublicKey))
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ours := testCase(t)
+	if err := ours.Log("test_event", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A log rewritten from scratch with another key has an intact chain.
+	rewritten := testCase(t)
+	f, err := os.Create(rewritten.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := other.Public().(ed25519.PublicKey)
+	head, err := appendCaseEvent(f, other, nil, eventCaseCreated, map[string]any{
+		"id":          rewritten.ID,
+		"analyst_key": base64.StdEncoding.EncodeToString(pub),
+	})
+	if err == nil {
+		_, err = appendCaseEvent(f, other, head, "test_event", nil)
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		c       *Case
+		analyst string
+		problem string
+	}{
+		{name: "local-key", c: ours},
+		{name: "flag", c: ours, analyst: local},
+		{name: "flag-mismatch", c: ours, analyst: keyFingerprint(pub), problem: "expected " + keyFingerprint(pub)},
+		{name: "rewritten", c: rewritten, problem: "expected " + local},
+		{name: "rewritten-flag", c: rewritten, analyst: keyFingerprint(pub)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := verifyCase(tt.c, tt.analyst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Join(v.Problems, "; ")
+			if tt.problem == "" && got != "" {
+				t.Errorf("unexpected problems: %s", got)
+			}
+			if tt.problem != "" && !strings.Contains(got, tt.problem) {
+				t.Errorf("problems %q, want one containing %q", got, tt.problem)
+			}
+		})
+	}
+}
+
+func TestCheckCaseHead(t *testing.T) {
+	entries := []CaseEvent{{Seq: 0, Hash: "aa"}, {Seq: 1, Hash: "bb"}, {Seq: 2, Hash: "cc"}}
+	tests := []struct {
+		name    string
+		mc      manifestCase
+		problem string
+	}{
+		{name: "last", mc: manifestCase{Seq: 2, Head: "cc"}},
+		{name: "earlier", mc: manifestCase{Seq: 1, Head: "bb"}},
+		{name: "truncated", mc: manifestCase{Seq: 3, Head: "dd"}, problem: "truncated"},
+		{name: "rewritten", mc: manifestCase{Seq: 1, Head: "xx"}, problem: "rewritten"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkCaseHead(entries, &tt.mc)
+			if tt.problem == "" && got != "" {
+				t.Errorf("unexpected problem: %s", got)
+			}
+			if tt.problem != "" && !strings.Contains(got, tt.problem) {
+				t.Errorf("problem %q, want one containing %q", got, tt.problem)
+			}
+		})
+	}
+}
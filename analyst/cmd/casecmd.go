@@ -0,0 +1,403 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var caseArgs struct {
+	dir     string
+	label   string
+	format  string
+	out     string
+	analyst string
+}
+
+func CaseCmd() *ffcli.Command {
+	newFS := flag.NewFlagSet("case new", flag.ContinueOnError)
+	newFS.StringVar(&caseArgs.label, "label", "", "free-form label recorded in the case log, e.g. an intake reference")
+
+	showFS := flag.NewFlagSet("case show", flag.ContinueOnError)
+	showFS.StringVar(&caseArgs.dir, "case", "", "case directory (default: $"+caseEnv+" or the current case)")
+
+	verifyFS := flag.NewFlagSet("case verify", flag.ContinueOnError)
+	verifyFS.StringVar(&caseArgs.dir, "case", "", "case directory (default: $"+caseEnv+" or the current case)")
+	verifyFS.StringVar(&caseArgs.analyst, "analyst", "", "expected analyst key fingerprint (SHA256:...); default: the local analyst key")
+
+	exportFS := flag.NewFlagSet("case export", flag.ContinueOnError)
+	exportFS.StringVar(&caseArgs.dir, "case", "", "case directory (default: $"+caseEnv+" or the current case)")
+	exportFS.StringVar(&caseArgs.analyst, "analyst", "", "expected analyst key fingerprint (SHA256:...); default: the local analyst key")
+	exportFS.StringVar(&caseArgs.format, "format", "markdown", "report format: markdown or json")
+	exportFS.StringVar(&caseArgs.out, "out", "", "write the report to this file instead of stdout")
+
+	return &ffcli.Command{
+		Name:       "case",
+		ShortUsage: "mesh case <subcommand> [flags]",
+		ShortHelp:  "Manage chain-of-custody case logs",
+		LongHelp: `A case is a directory under ./cases next to meshcli that records one analyst session: which MESH peer was selected (with its node key), pairing and connection results, the ADB serial, every module run, the acquisition hash list, and the adbdisable/adbclean actions.
+
+The case log (` + caseLogFile + `) is append-only JSONL. Each entry includes the hash of the previous one and is signed with the analyst's Ed25519 key (` + analystKeyFile + ` next to meshcli, or $` + analystKeyEnv + `), whose public key is recorded in the first entry. "case verify" detects edited, removed or reordered entries, and compares the key in the first entry with --analyst or the local analyst key, since a log rewritten with another key would otherwise verify. "case export" produces a report for evidence handling that includes the verification result and the final chain hash.
+
+A chain cannot show that entries were cut from its end. Each acquisition manifest records the chain head when it was written, and "mesh verify" checks that the case log still contains it.
+
+adbpair creates a case when none is selected. Other commands use --case, $` + caseEnv + ` or the current case, in that order.
+
+Examples:
+  mesh case new --label "intake 2024-017"
+  mesh case list
+  mesh case use 20240101-120000-1a2b3c4d
+  mesh case verify
+  mesh case export --out report.md
+`,
+		FlagSet: flag.NewFlagSet("case", flag.ContinueOnError),
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "new",
+				ShortUsage: "mesh case new [--label text]",
+				ShortHelp:  "Start a new case and make it current",
+				FlagSet:    newFS,
+				Exec:       runCaseNew,
+			},
+			{
+				Name:       "list",
+				ShortUsage: "mesh case list",
+				ShortHelp:  "List cases",
+				Exec:       runCaseList,
+			},
+			{
+				Name:       "use",
+				ShortUsage: "mesh case use <id|dir>",
+				ShortHelp:  "Make a case current",
+				Exec:       runCaseUse,
+			},
+			{
+				Name:       "show",
+				ShortUsage: "mesh case show [--case dir]",
+				ShortHelp:  "Print a case's event log",
+				FlagSet:    showFS,
+				Exec:       runCaseShow,
+			},
+			{
+				Name:       "verify",
+				ShortUsage: "mesh case verify [--case dir]",
+				ShortHelp:  "Check a case log's hash chain and signatures",
+				FlagSet:    verifyFS,
+				Exec:       runCaseVerify,
+			},
+			{
+				Name:       "export",
+				ShortUsage: "mesh case export [--case dir] [--format markdown|json] [--out file]",
+				ShortHelp:  "Export a case as a report",
+				FlagSet:    exportFS,
+				Exec:       runCaseExport,
+			},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+func runCaseNew(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	_, err := newCase(caseArgs.label)
+	return err
+}
+
+func runCaseList(ctx context.Context, args []string) error {
+	entries, err := os.ReadDir(casesRoot())
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("No cases.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	current, _ := os.ReadFile(filepath.Join(casesRoot(), caseCurrentFile))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tID\tEVENTS\tLAST EVENT")
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		mark := ""
+		if e.Name() == strings.TrimSpace(string(current)) {
+			mark = "*"
+		}
+		evs, _ := readCaseLog(filepath.Join(casesRoot(), e.Name(), caseLogFile))
+		last := "-"
+		if len(evs) > 0 {
+			ev := evs[len(evs)-1]
+			last = ev.Time.Local().Format(time.DateTime) + " " + ev.Event
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", mark, e.Name(), len(evs), last)
+	}
+	return w.Flush()
+}
+
+func runCaseUse(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mesh case use <id|dir>")
+	}
+	c, err := openCase(args[0], false)
+	if err != nil {
+		// Allow the bare ID of a case under the cases directory.
+		c, err = openCase(filepath.Join(casesRoot(), args[0]), false)
+		if err != nil {
+			return err
+		}
+	}
+	ref := c.ID
+	if abs, err := filepath.Abs(c.Dir); err == nil && filepath.Dir(abs) != casesRoot() {
+		ref = abs
+	}
+	if err := os.WriteFile(filepath.Join(casesRoot(), caseCurrentFile), []byte(ref+"\n"), 0o600); err != nil {
+		return fmt.Errorf("unable to mark current case: %w", err)
+	}
+	fmt.Printf("Current case is now %s (%s)\n", c.ID, c.Dir)
+	return nil
+}
+
+func runCaseShow(ctx context.Context, args []string) error {
+	c, err := selectedCase(args)
+	if err != nil {
+		return err
+	}
+	entries, err := readCaseLog(c.logPath())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tEVENT\tDETAILS")
+	for _, ev := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", ev.Seq, ev.Time.Local().Format(time.DateTime), ev.Event, sanitizeForTerminal(string(ev.Details)))
+	}
+	return w.Flush()
+}
+
+func runCaseVerify(ctx context.Context, args []string) error {
+	c, err := selectedCase(args)
+	if err != nil {
+		return err
+	}
+	v, err := verifyCase(c, caseArgs.analyst)
+	if err != nil {
+		return err
+	}
+	for _, w := range v.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	fmt.Printf("Case:        %s\n", c.ID)
+	fmt.Printf("Entries:     %d\n", len(v.Entries))
+	fmt.Printf("Analyst key: %s\n", v.Fingerprint)
+	fmt.Printf("Chain head:  %s\n", v.Head)
+	if len(v.Problems) > 0 {
+		for _, p := range v.Problems {
+			fmt.Printf("  FAIL: %s\n", p)
+		}
+		return fmt.Errorf("case log verification failed with %d problem(s)", len(v.Problems))
+	}
+	fmt.Println("Case log verified: hash chain and signatures are intact.")
+	return nil
+}
+
+func runCaseExport(ctx context.Context, args []string) error {
+	c, err := selectedCase(args)
+	if err != nil {
+		return err
+	}
+	v, err := verifyCase(c, caseArgs.analyst)
+	if err != nil {
+		return err
+	}
+	for _, w := range v.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+
+	var buf bytes.Buffer
+	switch caseArgs.format {
+	case "markdown", "md":
+		writeCaseMarkdown(&buf, c, v)
+	case "json":
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(caseReport{
+			Case:        c.ID,
+			Exported:    time.Now().UTC(),
+			Fingerprint: v.Fingerprint,
+			Verified:    len(v.Problems) == 0,
+			Problems:    v.Problems,
+			Warnings:    v.Warnings,
+			Head:        v.Head,
+			Events:      v.Entries,
+		}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", caseArgs.format)
+	}
+
+	if caseArgs.out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(caseArgs.out, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("unable to write report: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote case report to %s\n", caseArgs.out)
+	logCase(c, "case_exported", map[string]any{"path": caseArgs.out, "format": caseArgs.format, "head": v.Head})
+	return nil
+}
+
+func selectedCase(args []string) (*Case, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", args)
+	}
+	c, err := openCase(caseArgs.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("no case selected; use --case or `mesh case new`")
+	}
+	return c, nil
+}
+
+// caseVerification is the result of checking a case log.
+type caseVerification struct {
+	Entries     []CaseEvent
+	Fingerprint string
+	Head        string
+	Problems    []string
+	Warnings    []string
+}
+
+// verifyCase checks the case log's sequence numbers, hash chain and
+// signatures against the analyst key recorded in its first entry, and that
+// key against the expected fingerprint (see expectedAnalyst). Problems are
+// collected rather than returned so that a report can list them all.
+func verifyCase(c *Case, analyst string) (*caseVerification, error) {
+	entries, err := readCaseLog(c.logPath())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read case log: %w", err)
+	}
+	v := &caseVerification{Entries: entries}
+	if len(entries) == 0 {
+		v.Problems = append(v.Problems, "case log is empty")
+		return v, nil
+	}
+
+	var genesis struct {
+		AnalystKey string `json:"analyst_key"`
+	}
+	var pub ed25519.PublicKey
+	if entries[0].Event != eventCaseCreated {
+		v.Problems = append(v.Problems, "first entry is not "+eventCaseCreated)
+	} else if err := json.Unmarshal(entries[0].Details, &genesis); err != nil {
+		v.Problems = append(v.Problems, "invalid "+eventCaseCreated+" entry: "+err.Error())
+	} else if b, err := base64.StdEncoding.DecodeString(genesis.AnalystKey); err != nil || len(b) != ed25519.PublicKeySize {
+		v.Problems = append(v.Problems, "invalid analyst key in "+eventCaseCreated+" entry")
+	} else {
+		pub = b
+		v.Fingerprint = keyFingerprint(pub)
+	}
+
+	expected, err := expectedAnalyst(analyst)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case expected == "":
+		v.Warnings = append(v.Warnings, "no local analyst key and no --analyst given, the signer is not checked")
+	case v.Fingerprint != "" && v.Fingerprint != expected:
+		v.Problems = append(v.Problems, fmt.Sprintf("case log was signed by %s, expected %s", v.Fingerprint, expected))
+	}
+
+	prev := ""
+	for i, ev := range entries {
+		if ev.Seq != i {
+			v.Problems = append(v.Problems, fmt.Sprintf("entry %d: sequence number %d, entries missing or reordered", i, ev.Seq))
+		}
+		if ev.Prev != prev {
+			v.Problems = append(v.Problems, fmt.Sprintf("entry %d: does not chain to the previous entry", i))
+		}
+		prev = ev.Hash
+
+		sum, err := ev.digest()
+		if err != nil || hex.EncodeToString(sum) != ev.Hash {
+			v.Problems = append(v.Problems, fmt.Sprintf("entry %d (%s): hash mismatch, entry was modified", i, ev.Event))
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(ev.Sig)
+		if pub != nil && (err != nil || !ed25519.Verify(pub, sum, sig)) {
+			v.Problems = append(v.Problems, fmt.Sprintf("entry %d (%s): invalid signature", i, ev.Event))
+		}
+	}
+	v.Head = prev
+	return v, nil
+}
+
+type caseReport struct {
+	Case        string      `json:"case"`
+	Exported    time.Time   `json:"exported"`
+	Fingerprint string      `json:"analyst_fingerprint"`
+	Verified    bool        `json:"verified"`
+	Problems    []string    `json:"problems,omitempty"`
+	Warnings    []string    `json:"warnings,omitempty"`
+	Head        string      `json:"chain_head"`
+	Events      []CaseEvent `json:"events"`
+}
+
+func writeCaseMarkdown(w io.Writer, c *Case, v *caseVerification) {
+	fmt.Fprintf(w, "# MESH case report: %s\n\n", c.ID)
+	fmt.Fprintf(w, "- Exported: %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "- Analyst key: `%s`\n", v.Fingerprint)
+	fmt.Fprintf(w, "- Events: %d\n", len(v.Entries))
+	fmt.Fprintf(w, "- Chain head: `%s`\n", v.Head)
+	for _, warning := range v.Warnings {
+		fmt.Fprintf(w, "- Warning: %s\n", warning)
+	}
+	if len(v.Problems) == 0 {
+		fmt.Fprintf(w, "- Verification: **passed** (hash chain and signatures intact)\n")
+	} else {
+		fmt.Fprintf(w, "- Verification: **FAILED**\n")
+		for _, p := range v.Problems {
+			fmt.Fprintf(w, "  - %s\n", p)
+		}
+	}
+
+	fmt.Fprintf(w, "\n## Timeline\n")
+	for _, ev := range v.Entries {
+		fmt.Fprintf(w, "\n### %d. %s — %s\n\n", ev.Seq, ev.Time.Format(time.RFC3339), ev.Event)
+		if len(ev.Details) > 0 {
+			var details bytes.Buffer
+			if json.Indent(&details, ev.Details, "", "  ") != nil {
+				details.Reset()
+				details.Write(ev.Details)
+			}
+			fmt.Fprintf(w, "```json\n%s\n```\n\n", details.String())
+		}
+		fmt.Fprintf(w, "Hash: `%s`\n", ev.Hash)
+	}
+}
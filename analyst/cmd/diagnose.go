@@ -0,0 +1,378 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+var diagnoseArgs struct {
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+	json     bool
+}
+
+// mtuProbeSizes are the disco ping sizes tried to find the largest packet
+// the path carries. The MESH client refuses disco pings larger than the
+// 1280 byte tunnel MTU, which is all the path needs to carry.
+var mtuProbeSizes = []int{576, 1024, 1200, minTunnelMTU}
+
+// Thresholds above which diagnose calls a path slow or unstable.
+const (
+	slowLatency    = 300 * time.Millisecond
+	highJitter     = 100 * time.Millisecond
+	highLossPct    = 10.0
+	minTunnelMTU   = 1280
+	defaultPingNum = 10
+)
+
+// pingStats summarises a series of pings of one type.
+type pingStats struct {
+	Type    string        `json:"type"`
+	Sent    int           `json:"sent"`
+	Lost    int           `json:"lost"`
+	LossPct float64       `json:"loss_pct"`
+	Min     time.Duration `json:"min_ns,omitempty"`
+	Avg     time.Duration `json:"avg_ns,omitempty"`
+	Max     time.Duration `json:"max_ns,omitempty"`
+	Jitter  time.Duration `json:"jitter_ns,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// diagnosis is the result of meshcli diagnose.
+type diagnosis struct {
+	Peer      string      `json:"peer"`
+	HostName  string      `json:"hostname"`
+	IP        string      `json:"ip"`
+	Online    bool        `json:"online"`
+	Path      string      `json:"path"`
+	Endpoint  string      `json:"endpoint,omitempty"`
+	DERP      string      `json:"derp_region,omitempty"`
+	PeerRelay string      `json:"peer_relay,omitempty"`
+	Pings     []pingStats `json:"pings"`
+	MaxSize   int         `json:"max_probe_size"`
+	Verdict   string      `json:"verdict"`
+	Hints     []string    `json:"hints,omitempty"`
+}
+
+// Verdicts of meshcli diagnose.
+const (
+	verdictHealthy     = "healthy"
+	verdictSlow        = "slow"
+	verdictBroken      = "broken"
+	verdictUnreachable = "unreachable"
+)
+
+func DiagnoseCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	fs.IntVar(&diagnoseArgs.count, "count", defaultPingNum, "pings of each type to send")
+	fs.DurationVar(&diagnoseArgs.interval, "interval", 200*time.Millisecond, "delay between pings")
+	fs.DurationVar(&diagnoseArgs.timeout, "timeout", 3*time.Second, "timeout of each ping")
+	fs.BoolVar(&diagnoseArgs.json, "json", false, "output in JSON format")
+
+	return &ffcli.Command{
+		Name:       "diagnose",
+		ShortUsage: "meshcli diagnose [flags] <peer>",
+		ShortHelp:  "Diagnose the MESH data path to a peer",
+		LongHelp: strings.TrimSpace(`
+Diagnoses the MESH data path to a peer, given by hostname, MagicDNS name or
+MESH IP, before an acquisition is attempted.
+
+diagnose sends a series of disco pings (the WireGuard path between the two
+MESH clients), TSMP pings (the tunnel, through the peer's MESH client) and
+ICMP pings (the peer's operating system), and reports latency, jitter and
+loss for each. It shows whether the path is direct or relayed, and through
+which DERP region or peer relay, and probes increasing packet sizes to find
+the largest one the path carries.
+
+The verdict is one of:
+  healthy      all checks passed
+  slow         the data path works, but is relayed, slow, lossy or limited
+               in packet size
+  broken       the peer answers over MESH but tunnel traffic does not pass
+  unreachable  the peer does not answer at all
+
+Remediation hints are printed for each problem found. diagnose exits with
+an error for broken and unreachable paths.
+`),
+		FlagSet: fs,
+		Exec:    runDiagnose,
+	}
+}
+
+func runDiagnose(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: meshcli diagnose [flags] <peer>")
+	}
+	if diagnoseArgs.count < 1 {
+		return errors.New("--count must be at least 1")
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	ps, err := findPeer(st, args[0])
+	if err != nil {
+		return err
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("peer %s has no MESH address", sanitizeForTerminal(args[0]))
+	}
+	addr := ps.TailscaleIPs[0]
+
+	d := &diagnosis{
+		Peer:     args[0],
+		HostName: ps.HostName,
+		IP:       addr.String(),
+		Online:   ps.Online,
+	}
+	if !diagnoseArgs.json {
+		fmt.Printf("Diagnosing the data path to %s (%s)...\n", sanitizeForTerminal(ps.HostName), addr)
+	}
+
+	var last *ipnstate.PingResult
+	for _, typ := range []tailcfg.PingType{tailcfg.PingDisco, tailcfg.PingTSMP, tailcfg.PingICMP} {
+		stats, res := pingSeries(ctx, addr, typ)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		d.Pings = append(d.Pings, stats)
+		if typ == tailcfg.PingDisco && res != nil {
+			last = res
+		}
+	}
+	describePath(d, ps, last)
+	if d.Pings[0].Lost < d.Pings[0].Sent {
+		d.MaxSize = probeMTU(ctx, addr)
+	}
+	diagnoseVerdict(d)
+
+	if diagnoseArgs.json {
+		j, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", j)
+	} else {
+		printDiagnosis(d)
+	}
+	if d.Verdict == verdictBroken || d.Verdict == verdictUnreachable {
+		return fmt.Errorf("data path to %s is %s", sanitizeForTerminal(ps.HostName), d.Verdict)
+	}
+	return nil
+}
+
+// findPeer finds a peer of any OS by hostname, MagicDNS name or MESH IP,
+// as AndroidPeer.matches does for Android peers.
+func findPeer(st *ipnstate.Status, want string) (*ipnstate.PeerStatus, error) {
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if newAndroidPeer(ps).matches(want) {
+			return ps, nil
+		}
+	}
+	return nil, fmt.Errorf("no MESH peer matches %q", sanitizeForTerminal(want))
+}
+
+// pingSeries sends diagnoseArgs.count pings of one type and returns their
+// statistics with the last successful result.
+func pingSeries(ctx context.Context, addr netip.Addr, typ tailcfg.PingType) (pingStats, *ipnstate.PingResult) {
+	stats := pingStats{Type: string(typ)}
+	var rtts []time.Duration
+	var last *ipnstate.PingResult
+pings:
+	for i := 0; i < diagnoseArgs.count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				break pings
+			case <-time.After(diagnoseArgs.interval):
+			}
+		}
+		stats.Sent++
+		res, err := pingOnce(ctx, addr, typ, 0)
+		if err != nil {
+			stats.Lost++
+			stats.Error = err.Error()
+			continue
+		}
+		last = res
+		rtts = append(rtts, time.Duration(res.LatencySeconds*float64(time.Second)))
+	}
+	stats.LossPct = 100 * float64(stats.Lost) / float64(stats.Sent)
+	if len(rtts) == 0 {
+		return stats, nil
+	}
+	// The last error is only of interest when everything failed.
+	stats.Error = ""
+
+	stats.Min, stats.Max = slices.Min(rtts), slices.Max(rtts)
+	var sum, jitter time.Duration
+	for i, rtt := range rtts {
+		sum += rtt
+		if i > 0 {
+			jitter += time.Duration(math.Abs(float64(rtt - rtts[i-1])))
+		}
+	}
+	stats.Avg = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		stats.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+	return stats, last
+}
+
+func pingOnce(ctx context.Context, addr netip.Addr, typ tailcfg.PingType, size int) (*ipnstate.PingResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, diagnoseArgs.timeout)
+	defer cancel()
+	res, err := localClient.PingWithOpts(ctx, addr, typ, local.PingOpts{Size: size})
+	if err != nil {
+		return nil, err
+	}
+	if res.Err != "" {
+		return nil, errors.New(res.Err)
+	}
+	return res, nil
+}
+
+// probeMTU returns the largest of mtuProbeSizes that a disco ping of that
+// size gets through with, or 0 if none does.
+func probeMTU(ctx context.Context, addr netip.Addr) int {
+	largest := 0
+	for _, size := range mtuProbeSizes {
+		if _, err := pingOnce(ctx, addr, tailcfg.PingDisco, size); err != nil {
+			break
+		}
+		largest = size
+	}
+	return largest
+}
+
+// describePath fills in how traffic reaches the peer, preferring what the
+// last disco ping saw over the status snapshot.
+func describePath(d *diagnosis, ps *ipnstate.PeerStatus, res *ipnstate.PingResult) {
+	switch {
+	case res != nil && res.Endpoint != "":
+		d.Path, d.Endpoint = "direct", res.Endpoint
+	case res != nil && res.PeerRelay != "":
+		d.Path, d.PeerRelay = "peer-relay", res.PeerRelay
+	case res != nil && res.DERPRegionCode != "":
+		d.Path, d.DERP = "derp", res.DERPRegionCode
+	case ps.CurAddr != "":
+		d.Path, d.Endpoint = "direct", ps.CurAddr
+	case ps.PeerRelay != "":
+		d.Path, d.PeerRelay = "peer-relay", ps.PeerRelay
+	case ps.Relay != "":
+		d.Path, d.DERP = "derp", ps.Relay
+	default:
+		d.Path = "unknown"
+	}
+}
+
+func diagnoseVerdict(d *diagnosis) {
+	disco, tsmp, icmp := d.Pings[0], d.Pings[1], d.Pings[2]
+	hint := func(format string, args ...any) {
+		d.Hints = append(d.Hints, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case disco.Lost == disco.Sent:
+		d.Verdict = verdictUnreachable
+		if !d.Online {
+			hint("The peer is offline: open the MESH app on the device, check it is connected and that the device has network access.")
+		} else {
+			hint("The peer is listed as online but does not answer: check that the MESH app is not restricted by battery optimisation, then toggle the VPN in the app.")
+		}
+		hint("Check this machine's own connectivity with 'meshcli netcheck'.")
+		return
+	case tsmp.Lost == tsmp.Sent:
+		d.Verdict = verdictBroken
+		hint("The device answers over MESH but tunnel traffic does not pass: toggle WiFi on the Android device and retry.")
+		hint("If that does not help, reconnect the VPN in the MESH app or restart the app.")
+		return
+	}
+
+	d.Verdict = verdictHealthy
+	slow := func() { d.Verdict = verdictSlow }
+	if d.Path == "derp" {
+		slow()
+		hint("Traffic is relayed through DERP region %s: acquisitions will be slower. A direct path usually needs UDP allowed outbound on both networks; try another network on the device (e.g. mobile data instead of a captive WiFi).", d.DERP)
+	}
+	if d.Path == "peer-relay" {
+		hint("Traffic goes through peer relay %s rather than directly.", d.PeerRelay)
+	}
+	if loss := max(disco.LossPct, tsmp.LossPct); loss > highLossPct {
+		slow()
+		hint("%.0f%% packet loss: the device's link is unstable. Move the device closer to its access point or switch networks; long acquisitions may need --resume.", loss)
+	}
+	if tsmp.Avg > slowLatency {
+		slow()
+		hint("Average tunnel latency is %v: expect a slow acquisition and consider a larger --timeout or a --fast profile.", tsmp.Avg.Round(time.Millisecond))
+	}
+	if tsmp.Jitter > highJitter {
+		slow()
+		hint("Jitter is %v: the path is congested or the device is roaming between networks.", tsmp.Jitter.Round(time.Millisecond))
+	}
+	if d.MaxSize > 0 && d.MaxSize < minTunnelMTU {
+		slow()
+		hint("The path only carries packets up to %d bytes, below the %d byte tunnel MTU: large transfers may stall. Check for a VPN, tethering or PPPoE link on either side.", d.MaxSize, minTunnelMTU)
+	}
+	if icmp.Lost == icmp.Sent {
+		hint("The device does not answer ICMP pings. This is common on Android and does not affect ADB.")
+	}
+}
+
+func printDiagnosis(d *diagnosis) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PING\tSENT\tLOSS\tMIN\tAVG\tMAX\tJITTER")
+	for _, p := range d.Pings {
+		if p.Lost == p.Sent {
+			fmt.Fprintf(w, "%s\t%d\t100%%\t-\t-\t-\t-\n", p.Type, p.Sent)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f%%\t%v\t%v\t%v\t%v\n", p.Type, p.Sent, p.LossPct,
+			p.Min.Round(time.Millisecond), p.Avg.Round(time.Millisecond), p.Max.Round(time.Millisecond), p.Jitter.Round(time.Millisecond))
+	}
+	w.Flush()
+
+	fmt.Printf("\nPath:      %s", d.Path)
+	switch {
+	case d.Endpoint != "":
+		fmt.Printf(" (%s)", d.Endpoint)
+	case d.DERP != "":
+		fmt.Printf(" (DERP region %s)", d.DERP)
+	case d.PeerRelay != "":
+		fmt.Printf(" (%s)", d.PeerRelay)
+	}
+	fmt.Println()
+	if d.MaxSize > 0 {
+		fmt.Printf("Max probe: %d bytes\n", d.MaxSize)
+	}
+	fmt.Printf("Verdict:   %s\n", d.Verdict)
+	for _, h := range d.Hints {
+		fmt.Printf("  - %s\n", h)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	dnsPort            = 53
+	dnsMaxUDPLen       = 4096
+	dnsUpstreamTimeout = 5 * time.Second
+	dnsTCPIdleTimeout  = 10 * time.Second
+	// dnsPeerRefresh is how often the peer list may be refetched to name
+	// a client that is not known yet.
+	dnsPeerRefresh = 10 * time.Second
+)
+
+// dnsFallbackUpstream is used when no usable resolver is configured on the
+// analyst host.
+var dnsFallbackUpstream = netip.MustParseAddrPort("1.1.1.1:53")
+
+var dnsLogArgs struct {
+	listen   string
+	upstream string
+	out      string
+	duration time.Duration
+	caseDir  string
+}
+
+func DNSLogCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("dnslog", flag.ContinueOnError)
+	fs.StringVar(&dnsLogArgs.listen, "listen", "", "address to serve DNS on (default: this node's MESH IPv4 address, port 53)")
+	fs.StringVar(&dnsLogArgs.upstream, "upstream", "", "resolver to forward queries to, as ip or ip:port (default: the host's resolver)")
+	fs.StringVar(&dnsLogArgs.out, "out", "", "JSONL file to write (default: dns-<time>.jsonl in the case)")
+	fs.DurationVar(&dnsLogArgs.duration, "duration", 0, "stop after this long (default: until interrupted)")
+	fs.StringVar(&dnsLogArgs.caseDir, "case", "", "case to record the log in (default: $"+caseEnv+" or the current case)")
+
+	return &ffcli.Command{
+		Name:       "dnslog",
+		ShortUsage: "meshcli dnslog [flags]",
+		ShortHelp:  "Run a DNS forwarder that logs the queries of MESH peers",
+		LongHelp: strings.TrimSpace(`
+Serves DNS on this node's MESH address, forwards every query to an upstream
+resolver and writes one JSON line per query: the time, the peer that asked
+(hostname, node ID and MESH IP), the query name and type, the response code,
+the answers and the upstream latency. UDP and TCP are both served.
+
+To have endpoints use it, run "meshcli monitor start --dns", which points
+the control plane's DNS configuration at this node for the monitoring
+session, and keep dnslog running until "meshcli monitor stop".
+
+The upstream defaults to the first nameserver of the host's resolver
+configuration that is neither loopback nor a MESH address, so that queries
+do not loop back through MESH DNS, and to ` + dnsFallbackUpstream.String() + ` otherwise.
+
+The log goes to the case directory unless --out is given. It is hashed when
+dnslog stops; the SHA-256 is written next to it in <file>.sha256 and
+recorded in the case log. Serving on port 53 needs root or
+CAP_NET_BIND_SERVICE.
+
+Examples:
+  sudo meshcli dnslog
+  sudo meshcli dnslog --upstream 9.9.9.9 --out pixel-7-dns.jsonl
+`),
+		FlagSet: fs,
+		Exec:    runDNSLog,
+	}
+}
+
+// dnsLogEntry is one line of the DNS log.
+type dnsLogEntry struct {
+	Time      time.Time `json:"time"`
+	Peer      string    `json:"peer,omitempty"`
+	NodeID    string    `json:"node_id,omitempty"`
+	Client    string    `json:"client"`
+	Proto     string    `json:"proto"`
+	ID        uint16    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	RCode     string    `json:"rcode,omitempty"`
+	Answers   []string  `json:"answers,omitempty"`
+	Upstream  string    `json:"upstream"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// dnsLogger forwards queries and writes them to the log.
+type dnsLogger struct {
+	upstream netip.AddrPort
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	enc     *json.Encoder
+	queries uint64
+
+	peersMu     sync.Mutex
+	peers       map[netip.Addr]*ipnstate.PeerStatus
+	peersLoaded time.Time
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	upstream, err := dnsUpstream(dnsLogArgs.upstream)
+	if err != nil {
+		return err
+	}
+	listen := dnsLogArgs.listen
+	if listen == "" {
+		st, err := localClient.StatusWithoutPeers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get MESH status: %w", err)
+		}
+		ip, ok := meshIPv4(st)
+		if !ok {
+			return errors.New("this node has no MESH IPv4 address; run \"meshcli up\" first")
+		}
+		listen = netip.AddrPortFrom(ip, dnsPort).String()
+	}
+
+	c, err := openCase(dnsLogArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	out := dnsLogArgs.out
+	if out == "" {
+		if c == nil {
+			return errors.New("no case selected; use --case or --out")
+		}
+		out = filepath.Join(c.Dir, "dns-"+time.Now().UTC().Format("20060102-150405")+".jsonl")
+	}
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create DNS log: %w", err)
+	}
+	l := &dnsLogger{upstream: upstream, w: bufio.NewWriter(f)}
+	l.enc = json.NewEncoder(l.w)
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to serve DNS on %s: %w", listen, err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to serve DNS on %s: %w", listen, err)
+	}
+	defer ln.Close()
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if dnsLogArgs.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsLogArgs.duration)
+		defer cancel()
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+
+	start := time.Now().UTC()
+	logCase(c, "dns_log_started", map[string]any{"listen": listen, "upstream": upstream.String(), "out": out})
+	fmt.Printf("Serving DNS on %s, forwarding to %s, logging to %s. Ctrl-C to stop...\n", listen, upstream, out)
+
+	// wg also tracks the goroutines answering each UDP query and TCP
+	// connection, so that the log is only closed once the last query in
+	// flight has been written.
+	var wg sync.WaitGroup
+	wg.Go(func() { l.serveUDP(ctx, pc, &wg) })
+	wg.Go(func() { l.serveTCP(ctx, ln, &wg) })
+	wg.Wait()
+
+	reason := "interrupted"
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		reason = "duration reached"
+	}
+	l.mu.Lock()
+	err = l.w.Flush()
+	queries := l.queries
+	l.mu.Unlock()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("closing %s: %w", out, err)
+	}
+	sum, size, err := writeChecksum(out)
+	if err != nil {
+		return err
+	}
+	logCase(c, "dns_log_stopped", map[string]any{
+		"reason":  reason,
+		"path":    out,
+		"sha256":  sum,
+		"size":    size,
+		"queries": queries,
+		"start":   start,
+		"end":     time.Now().UTC(),
+	})
+	fmt.Printf("DNS logging stopped (%s): %d queries in %s (SHA-256 %s)\n", reason, queries, out, sum)
+	return nil
+}
+
+func (l *dnsLogger) serveUDP(ctx context.Context, pc net.PacketConn, wg *sync.WaitGroup) {
+	buf := make([]byte, dnsMaxUDPLen)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("DNS UDP listener stopped: %v\n", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		wg.Go(func() {
+			resp := l.handle(ctx, "udp", addr, query)
+			if resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		})
+	}
+}
+
+func (l *dnsLogger) serveTCP(ctx context.Context, ln net.Listener, wg *sync.WaitGroup) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("DNS TCP listener stopped: %v\n", err)
+			}
+			return
+		}
+		wg.Go(func() {
+			defer conn.Close()
+			// Do not wait for an idle client to time out once stopped.
+			defer context.AfterFunc(ctx, func() { conn.Close() })()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := l.handle(ctx, "tcp", conn.RemoteAddr(), query)
+				if resp == nil {
+					return
+				}
+				if err := writeTCPMessage(conn, resp); err != nil {
+					return
+				}
+			}
+		})
+	}
+}
+
+// handle forwards a query over the same protocol it arrived on, logs it
+// and returns the response, or nil if there is none to send.
+func (l *dnsLogger) handle(ctx context.Context, proto string, from net.Addr, query []byte) []byte {
+	e := dnsLogEntry{Time: time.Now().UTC(), Proto: proto, Upstream: l.upstream.String()}
+	client, _ := netip.ParseAddrPort(from.String())
+	e.Client = client.Addr().Unmap().String()
+	if ps := l.peer(ctx, client.Addr().Unmap()); ps != nil {
+		e.Peer, e.NodeID = ps.HostName, string(ps.ID)
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	e.ID = h.ID
+	if q, err := p.Question(); err == nil {
+		e.Name = q.Name.String()
+		e.Type = strings.TrimPrefix(q.Type.String(), "Type")
+	}
+
+	start := time.Now()
+	resp, err := l.forward(ctx, proto, query)
+	e.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		e.Error = err.Error()
+		e.RCode = "ServerFailure"
+		resp = serverFailure(query)
+	} else {
+		e.RCode, e.Answers = describeResponse(resp)
+	}
+	l.write(&e)
+	return resp
+}
+
+func (l *dnsLogger) forward(ctx context.Context, proto string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsUpstreamTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, proto, l.upstream.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if proto == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxUDPLen)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (l *dnsLogger) write(e *dnsLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		fmt.Printf("Failed to write DNS log: %v\n", err)
+		return
+	}
+	// Flush every entry so that the log is complete up to the last query
+	// if meshcli is killed.
+	l.w.Flush()
+	l.queries++
+}
+
+// peer returns the MESH peer with address ip, refetching the peer list at
+// most every dnsPeerRefresh when the address is unknown.
+func (l *dnsLogger) peer(ctx context.Context, ip netip.Addr) *ipnstate.PeerStatus {
+	l.peersMu.Lock()
+	defer l.peersMu.Unlock()
+	if ps, ok := l.peers[ip]; ok || time.Since(l.peersLoaded) < dnsPeerRefresh {
+		return ps
+	}
+	l.peersLoaded = time.Now()
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return nil
+	}
+	l.peers = make(map[netip.Addr]*ipnstate.PeerStatus)
+	for _, ps := range st.Peer {
+		for _, a := range ps.TailscaleIPs {
+			l.peers[a] = ps
+		}
+	}
+	return l.peers[ip]
+}
+
+// describeResponse returns the response code and the answers of a DNS
+// response, formatted as "<type> <value>".
+func describeResponse(msg []byte) (string, []string) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return "", nil
+	}
+	rcode := strings.TrimPrefix(h.RCode.String(), "RCode")
+	if err := p.SkipAllQuestions(); err != nil {
+		return rcode, nil
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return rcode, nil
+	}
+	var out []string
+	for _, a := range answers {
+		typ := strings.TrimPrefix(a.Header.Type.String(), "Type")
+		var v string
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			v = netip.AddrFrom4(b.A).String()
+		case *dnsmessage.AAAAResource:
+			v = netip.AddrFrom16(b.AAAA).String()
+		case *dnsmessage.CNAMEResource:
+			v = b.CNAME.String()
+		case *dnsmessage.PTRResource:
+			v = b.PTR.String()
+		case *dnsmessage.MXResource:
+			v = fmt.Sprintf("%d %s", b.Pref, b.MX)
+		case *dnsmessage.NSResource:
+			v = b.NS.String()
+		case *dnsmessage.TXTResource:
+			v = strings.Join(b.TXT, "")
+		case *dnsmessage.SRVResource:
+			v = fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+		default:
+			v = a.Header.Name.String()
+		}
+		out = append(out, typ+" "+v)
+	}
+	return rcode, out
+}
+
+// serverFailure builds a SERVFAIL response to query, or returns nil if the
+// query cannot be parsed.
+func serverFailure(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	h.Response, h.RCode = true, dnsmessage.RCodeServerFailure
+	msg := dnsmessage.Message{Header: h, Questions: qs}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	b := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// dnsUpstream parses --upstream, or picks the host's resolver when it is
+// empty.
+func dnsUpstream(s string) (netip.AddrPort, error) {
+	if s != "" {
+		if ap, err := netip.ParseAddrPort(s); err == nil {
+			return ap, nil
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid --upstream %q: must be ip or ip:port", s)
+		}
+		return netip.AddrPortFrom(ip, dnsPort), nil
+	}
+	// systemd-resolved's stub listens on loopback; its upstreams are in
+	// the second file.
+	for _, path := range []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for line := range strings.SplitSeq(string(b), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 2 || f[0] != "nameserver" {
+				continue
+			}
+			ip, err := netip.ParseAddr(f[1])
+			if err != nil || ip.IsLoopback() || meshPrefix4.Contains(ip) || meshPrefix6.Contains(ip) {
+				continue
+			}
+			return netip.AddrPortFrom(ip, dnsPort), nil
+		}
+	}
+	return dnsFallbackUpstream, nil
+}
+
+// meshIPv4 returns this node's MESH IPv4 address.
+func meshIPv4(st *ipnstate.Status) (netip.Addr, bool) {
+	if st.Self == nil {
+		return netip.Addr{}, false
+	}
+	for _, ip := range st.Self.TailscaleIPs {
+		if ip.Is4() {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,314 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn/ipnstate"
+)
+
+func testDNSMessage(t *testing.T, h dnsmessage.Header, q dnsmessage.Question, answers ...dnsmessage.Resource) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{Header: h, Questions: []dnsmessage.Question{q}, Answers: answers}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testQuestion(name string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+func testAnswer(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 60},
+		Body:   body,
+	}
+}
+
+// testDNSUpstream serves UDP on loopback, answering every query with an A
+// record for 192.0.2.1 under the query's ID and question.
+func testDNSUpstream(t *testing.T) netip.AddrPort {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, dnsMaxUDPLen)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			h.Response = true
+			msg := dnsmessage.Message{
+				Header:    h,
+				Questions: []dnsmessage.Question{q},
+				Answers:   []dnsmessage.Resource{testAnswer(q.Name.String(), &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})},
+			}
+			resp, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return netip.MustParseAddrPort(pc.LocalAddr().String())
+}
+
+func newTestDNSLogger(upstream netip.AddrPort) (*dnsLogger, *bytes.Buffer) {
+	var out bytes.Buffer
+	client := netip.MustParseAddr("100.64.0.5")
+	l := &dnsLogger{
+		upstream: upstream,
+		w:        bufio.NewWriter(&out),
+		peers: map[netip.Addr]*ipnstate.PeerStatus{
+			client: {ID: "n123", HostName: "pixel", TailscaleIPs: []netip.Addr{client}},
+		},
+		// Keep peer from asking the local MESH daemon.
+		peersLoaded: time.Now().Add(time.Hour),
+	}
+	l.enc = json.NewEncoder(l.w)
+	return l, &out
+}
+
+func readDNSLog(t *testing.T, out *bytes.Buffer) []dnsLogEntry {
+	t.Helper()
+	var entries []dnsLogEntry
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var e dnsLogEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestDNSLoggerHandle(t *testing.T) {
+	l, out := newTestDNSLogger(testDNSUpstream(t))
+	from := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("100.64.0.5:40000"))
+	query := testDNSMessage(t, dnsmessage.Header{ID: 0x1234, RecursionDesired: true}, testQuestion("example.com.", dnsmessage.TypeA))
+
+	resp := l.handle(context.Background(), "udp", from, query)
+	rcode, answers := describeResponse(resp)
+	if rcode != "Success" || !slices.Equal(answers, []string{"A 192.0.2.1"}) {
+		t.Errorf("response %s %q", rcode, answers)
+	}
+
+	entries := readDNSLog(t, out)
+	if len(entries) != 1 {
+		t.Fatalf("%d log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.Peer != "pixel" || e.NodeID != "n123" || e.Client != "100.64.0.5" || e.Proto != "udp" {
+		t.Errorf("client logged as %q %q %q %q", e.Peer, e.NodeID, e.Client, e.Proto)
+	}
+	if e.ID != 0x1234 || e.Name != "example.com." || e.Type != "A" || e.RCode != "Success" || e.Error != "" {
+		t.Errorf("query logged as %d %q %q %q %q", e.ID, e.Name, e.Type, e.RCode, e.Error)
+	}
+	if !slices.Equal(e.Answers, []string{"A 192.0.2.1"}) {
+		t.Errorf("answers logged as %q", e.Answers)
+	}
+}
+
+func TestDNSLoggerHandleUpstreamFailure(t *testing.T) {
+	// A closed port: the connected UDP socket gets the ICMP port
+	// unreachable as a read error.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := netip.MustParseAddrPort(pc.LocalAddr().String())
+	pc.Close()
+
+	l, out := newTestDNSLogger(upstream)
+	from := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("100.64.0.9:40000"))
+	query := testDNSMessage(t, dnsmessage.Header{ID: 7}, testQuestion("example.org.", dnsmessage.TypeAAAA))
+
+	resp := l.handle(context.Background(), "udp", from, query)
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		t.Fatalf("no SERVFAIL response: %v", err)
+	}
+	if h.ID != 7 || h.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("response %d %v", h.ID, h.RCode)
+	}
+
+	entries := readDNSLog(t, out)
+	if len(entries) != 1 {
+		t.Fatalf("%d log entries, want 1", len(entries))
+	}
+	if e := entries[0]; e.Peer != "" || e.Client != "100.64.0.9" || e.RCode != "ServerFailure" || e.Error == "" {
+		t.Errorf("logged as %q %q %q %q", e.Peer, e.Client, e.RCode, e.Error)
+	}
+}
+
+func TestDNSLoggerHandleMalformed(t *testing.T) {
+	l, out := newTestDNSLogger(testDNSUpstream(t))
+	from := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("100.64.0.5:40000"))
+	if resp := l.handle(context.Background(), "udp", from, []byte{1, 2, 3}); resp != nil {
+		t.Errorf("response %x to a malformed query", resp)
+	}
+	if out.Len() != 0 {
+		t.Errorf("malformed query logged: %s", out)
+	}
+}
+
+func TestDescribeResponse(t *testing.T) {
+	h := dnsmessage.Header{Response: true}
+	q := testQuestion("example.com.", dnsmessage.TypeA)
+	tests := []struct {
+		name    string
+		msg     []byte
+		rcode   string
+		answers []string
+	}{
+		{
+			name:  "records",
+			rcode: "Success",
+			msg: testDNSMessage(t, h, q,
+				testAnswer("www.example.com.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("example.com.")}),
+				testAnswer("example.com.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+				testAnswer("example.com.", &dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()}),
+				testAnswer("example.com.", &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx.example.com.")}),
+				testAnswer("example.com.", &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}}),
+				testAnswer("_x._tcp.example.com.", &dnsmessage.SRVResource{Priority: 1, Weight: 2, Port: 443, Target: dnsmessage.MustNewName("srv.example.com.")}),
+			),
+			answers: []string{
+				"CNAME example.com.",
+				"A 192.0.2.1",
+				"AAAA 2001:db8::1",
+				"MX 10 mx.example.com.",
+				"TXT v=spf1 -all",
+				"SRV 1 2 443 srv.example.com.",
+			},
+		},
+		{
+			name:  "nxdomain",
+			rcode: "NameError",
+			msg:   testDNSMessage(t, dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}, q),
+		},
+		{
+			name: "malformed",
+			msg:  []byte{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcode, answers := describeResponse(tt.msg)
+			if rcode != tt.rcode || !slices.Equal(answers, tt.answers) {
+				t.Errorf("got %q %q, want %q %q", rcode, answers, tt.rcode, tt.answers)
+			}
+		})
+	}
+}
+
+func TestServerFailure(t *testing.T) {
+	q := testQuestion("example.com.", dnsmessage.TypeMX)
+	query := testDNSMessage(t, dnsmessage.Header{ID: 42, RecursionDesired: true}, q)
+	var p dnsmessage.Parser
+	h, err := p.Start(serverFailure(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ID != 42 || !h.Response || !h.RecursionDesired || h.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("header %+v", h)
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 || qs[0] != q {
+		t.Errorf("questions %v, %v", qs, err)
+	}
+
+	if b := serverFailure([]byte{1, 2, 3}); b != nil {
+		t.Errorf("SERVFAIL %x for a malformed query", b)
+	}
+}
+
+func TestDNSUpstream(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "9.9.9.9", want: "9.9.9.9:53"},
+		{in: "9.9.9.9:5353", want: "9.9.9.9:5353"},
+		{in: "2620:fe::fe", want: "[2620:fe::fe]:53"},
+		{in: "[2620:fe::fe]:853", want: "[2620:fe::fe]:853"},
+		{in: "dns.example"},
+		{in: "9.9.9.9:dns"},
+	}
+	for _, tt := range tests {
+		got, err := dnsUpstream(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("dnsUpstream(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("dnsUpstream(%q) = %v, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+
+	// The default is never a loopback or MESH address.
+	got, err := dnsUpstream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := got.Addr(); ip.IsLoopback() || meshPrefix4.Contains(ip) || meshPrefix6.Contains(ip) {
+		t.Errorf("default upstream %v", got)
+	}
+}
+
+func TestReadTCPMessage(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 300)} {
+		if err := writeTCPMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := buf.Bytes()[:2]; !bytes.Equal(got, []byte{0, 5}) {
+		t.Errorf("length prefix %x, want 0005", got)
+	}
+	for _, want := range []int{5, 0, 300} {
+		got, err := readTCPMessage(&buf)
+		if err != nil || len(got) != want {
+			t.Errorf("read %d bytes, %v; want %d", len(got), err, want)
+		}
+	}
+	if _, err := readTCPMessage(&buf); err == nil {
+		t.Error("no error at EOF")
+	}
+
+	for _, b := range [][]byte{{0}, {0, 4, 1, 2, 3}} {
+		if got, err := readTCPMessage(bytes.NewReader(b)); err == nil {
+			t.Errorf("read %x from truncated %x", got, b)
+		}
+	}
+}
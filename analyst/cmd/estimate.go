@@ -0,0 +1,201 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+)
+
+// timeoutAuto is the --timeout value that derives the timeout from the
+// estimated duration of the acquisition.
+const timeoutAuto = "auto"
+
+// timeoutValue is a --timeout flag that takes a duration or "auto".
+type timeoutValue struct {
+	d    *time.Duration
+	auto *bool
+}
+
+func (v timeoutValue) String() string {
+	if v.auto != nil && *v.auto {
+		return timeoutAuto
+	}
+	if v.d == nil {
+		return ""
+	}
+	return v.d.String()
+}
+
+func (v timeoutValue) Set(s string) error {
+	if s == timeoutAuto {
+		*v.auto = true
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("must be a duration or %q", timeoutAuto)
+	}
+	*v.d, *v.auto = d, false
+	return nil
+}
+
+const (
+	// probeBytes is how much random data is streamed from the device to
+	// measure throughput.
+	probeBytes = 2 << 20
+
+	// moduleOverhead is the time a module takes besides transferring its
+	// output: shell round trips, dumpsys and the like.
+	moduleOverhead = 10 * time.Second
+	// A derived timeout leaves this much room over the estimate, which
+	// is rough and assumes the link stays as fast as when it was measured.
+	autoTimeoutFactor = 2
+	autoTimeoutSlack  = 10 * time.Minute
+	minAutoTimeout    = 15 * time.Minute
+)
+
+// moduleSizes are rough output sizes of modules, matched by pattern in
+// order. They are typical values for a phone in everyday use; the packages
+// module is sized from the device instead when possible.
+var moduleSizes = []struct {
+	pattern string
+	bytes   int64
+}{
+	{"*backup*", 200 << 20},
+	{"*bugreport*", 40 << 20},
+	{"*packages*", 500 << 20},
+	{"*dumpsys*", 20 << 20},
+	{"*logcat*", 10 << 20},
+	{"*temp*", 10 << 20},
+	{"*files*", 5 << 20},
+	{"*", 1 << 20},
+}
+
+// acquisitionEstimate is the expected size and duration of an acquisition.
+type acquisitionEstimate struct {
+	Bytes      int64         `json:"bytes"`
+	Throughput float64       `json:"throughput_bps"`
+	ETA        time.Duration `json:"eta_ns"`
+	Modules    int           `json:"modules"`
+}
+
+// estimateAcquisition measures the throughput from the device and
+// estimates how long pulling the selected modules will take.
+func estimateAcquisition(mods []string) (*acquisitionEstimate, error) {
+	bps, err := measureThroughput()
+	if err != nil {
+		return nil, fmt.Errorf("unable to measure throughput: %w", err)
+	}
+	e := &acquisitionEstimate{Throughput: bps, Modules: len(mods)}
+	for _, m := range mods {
+		e.Bytes += estimateModuleSize(m)
+	}
+	e.ETA = time.Duration(float64(e.Bytes)/bps*float64(time.Second)) + time.Duration(len(mods))*moduleOverhead
+	return e, nil
+}
+
+// autoTimeout derives an acquisition timeout from an estimate.
+func (e *acquisitionEstimate) autoTimeout() time.Duration {
+	return max(e.ETA*autoTimeoutFactor+autoTimeoutSlack, minAutoTimeout).Round(time.Minute)
+}
+
+// measureThroughput streams random data from the device over the current
+// connection and returns the rate in bytes per second. The data is read
+// from /dev/urandom and never written to the device, whose storage must
+// not change before acquisition.
+func measureThroughput() (float64, error) {
+	checkADBClient()
+	cmd := exec.Command(adb.Client.ExePath, "-s", adb.Client.Serial,
+		"exec-out", "head", "-c", strconv.Itoa(probeBytes), "/dev/urandom")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, stdout)
+	elapsed := time.Since(start)
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < probeBytes/2 || elapsed <= 0 {
+		return 0, errors.New("probe data was not transferred")
+	}
+	return float64(n) / elapsed.Seconds(), nil
+}
+
+func estimateModuleSize(module string) int64 {
+	if matchModule("*packages*", module) {
+		if n, err := installedAPKSize(); err == nil && n > 0 {
+			return n
+		}
+	}
+	return typicalModuleSize(module)
+}
+
+// typicalModuleSize returns the size of the first entry of moduleSizes that
+// matches module.
+func typicalModuleSize(module string) int64 {
+	for _, s := range moduleSizes {
+		if matchModule(s.pattern, module) {
+			return s.bytes
+		}
+	}
+	return 0
+}
+
+// installedAPKSize adds up the size of the APKs of the apps the user has
+// installed.
+func installedAPKSize() (int64, error) {
+	out, err := adb.Client.Shell("pm", "list", "packages", "-f", "-3")
+	if err != nil {
+		return 0, err
+	}
+	var paths []string
+	for line := range strings.SplitSeq(out, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "package:")
+		if i := strings.LastIndex(line, "="); i > 0 {
+			paths = append(paths, line[:i])
+		}
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	out, err = adb.Client.Shell(append([]string{"stat", "-c", "%s"}, paths...)...)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for line := range strings.SplitSeq(out, "\n") {
+		if n, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64); err == nil {
+			total += n
+		}
+	}
+	return total, nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutValue(t *testing.T) {
+	// The flag package calls String on a zero value to print defaults.
+	if got := (timeoutValue{}).String(); got != "" {
+		t.Errorf("zero value String() = %q", got)
+	}
+
+	d, auto := 30*time.Minute, false
+	v := timeoutValue{d: &d, auto: &auto}
+	if got := v.String(); got != "30m0s" {
+		t.Errorf("default String() = %q", got)
+	}
+
+	tests := []struct {
+		in   string
+		d    time.Duration
+		auto bool
+		str  string
+		err  bool
+	}{
+		{in: "90m", d: 90 * time.Minute, str: "1h30m0s"},
+		{in: "auto", d: 90 * time.Minute, auto: true, str: "auto"},
+		// A duration given after auto turns it off again.
+		{in: "2h", d: 2 * time.Hour, str: "2h0m0s"},
+		{in: "0", str: "0s"},
+		{in: "auto", auto: true, str: "auto"},
+		// Invalid values leave the flag as it was.
+		{in: "soon", auto: true, str: "auto", err: true},
+		{in: "AUTO", auto: true, str: "auto", err: true},
+		{in: "", auto: true, str: "auto", err: true},
+	}
+	for _, tt := range tests {
+		err := v.Set(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Set(%q) error = %v, want error %v", tt.in, err, tt.err)
+		}
+		if d != tt.d || auto != tt.auto || v.String() != tt.str {
+			t.Errorf("after Set(%q): %v, auto %v, String() %q; want %v, auto %v, %q", tt.in, d, auto, v.String(), tt.d, tt.auto, tt.str)
+		}
+	}
+}
+
+func TestAutoTimeout(t *testing.T) {
+	tests := []struct {
+		eta  time.Duration
+		want time.Duration
+	}{
+		// Short acquisitions get the minimum.
+		{eta: 0, want: minAutoTimeout},
+		{eta: time.Minute, want: minAutoTimeout},
+		{eta: 150 * time.Second, want: 15 * time.Minute},
+		// Otherwise twice the estimate plus the slack...
+		{eta: 10 * time.Minute, want: 30 * time.Minute},
+		{eta: time.Hour, want: 2*time.Hour + 10*time.Minute},
+		// ...rounded to the minute.
+		{eta: time.Hour + 20*time.Second, want: 2*time.Hour + 11*time.Minute},
+		{eta: time.Hour + 10*time.Second, want: 2*time.Hour + 10*time.Minute},
+	}
+	for _, tt := range tests {
+		e := &acquisitionEstimate{ETA: tt.eta}
+		if got := e.autoTimeout(); got != tt.want {
+			t.Errorf("autoTimeout() for an ETA of %v = %v, want %v", tt.eta, got, tt.want)
+		}
+	}
+}
+
+func TestTypicalModuleSize(t *testing.T) {
+	tests := []struct {
+		module string
+		want   int64
+	}{
+		{"backup", 200 << 20},
+		{"bugreport", 40 << 20},
+		// packages is matched before the catch-all.
+		{"packages", 500 << 20},
+		{"PACKAGES", 500 << 20},
+		{"dumpsys", 20 << 20},
+		{"logcat", 10 << 20},
+		{"temp", 10 << 20},
+		{"files", 5 << 20},
+		{"getprop", 1 << 20},
+		{"settings", 1 << 20},
+		// The first matching pattern wins.
+		{"backup_files", 200 << 20},
+		{"dumpsys_logcat", 20 << 20},
+	}
+	for _, tt := range tests {
+		if got := typicalModuleSize(tt.module); got != tt.want {
+			t.Errorf("typicalModuleSize(%q) = %d, want %d", tt.module, got, tt.want)
+		}
+	}
+	// Modules other than packages are never sized from the device.
+	for _, module := range testModules {
+		if module == "packages" {
+			continue
+		}
+		if got, want := estimateModuleSize(module), typicalModuleSize(module); got != want {
+			t.Errorf("estimateModuleSize(%q) = %d, want %d", module, got, want)
+		}
+	}
+}
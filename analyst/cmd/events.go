@@ -0,0 +1,135 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// eventsVersion is the schema version stamped on every progress event.
+// Fields may be added within a version, but never renamed or removed.
+const eventsVersion = 1
+
+// Progress event names.
+const (
+	eventPairingStep         = "pairing_step"
+	eventAcquisitionEstimate = "acquisition_estimate"
+	eventAcquisitionStarted  = "acquisition_started"
+	eventModuleStarted       = "module_started"
+	eventModuleSkipped       = "module_skipped"
+	eventModuleFinished      = "module_finished"
+	eventAcquisitionComplete = "acquisition_complete"
+	eventAcquisitionFailed   = "acquisition_failed"
+)
+
+// Pairing step and module statuses.
+const (
+	statusStarted     = "started"
+	statusSucceeded   = "succeeded"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+)
+
+// progressEvent is one line of --progress-json output.
+type progressEvent struct {
+	Version    int            `json:"v"`
+	Time       time.Time      `json:"time"`
+	Event      string         `json:"event"`
+	Step       string         `json:"step,omitempty"`
+	Module     string         `json:"module,omitempty"`
+	Index      int            `json:"index,omitempty"`
+	Total      int            `json:"total,omitempty"`
+	Status     string         `json:"status,omitempty"`
+	DurationMS int64          `json:"duration_ms,omitempty"`
+	Bytes      int64          `json:"bytes,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// eventEmitter writes newline-delimited JSON progress events. The zero
+// value discards events.
+type eventEmitter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// events is where commands report progress when --progress-json is set.
+var events = &eventEmitter{}
+
+// openEvents directs progress events to dest: "-" for stdout, any other
+// value for a file that events are appended to. With stdout, the regular
+// human-readable output is moved to stderr so that stdout carries nothing
+// but events. The returned function closes the destination.
+func openEvents(dest string) (func(), error) {
+	switch dest {
+	case "":
+		return func() {}, nil
+	case "-":
+		events.w = os.Stdout
+		os.Stdout = os.Stderr
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	events.w = f
+	return func() { f.Close() }, nil
+}
+
+func (e *eventEmitter) emit(ev progressEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.w == nil {
+		return
+	}
+	ev.Version = eventsVersion
+	ev.Time = time.Now().UTC()
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	e.w.Write(append(b, '\n'))
+}
+
+// startPairingStep reports that an adbpair step has started.
+func (e *eventEmitter) startPairingStep(step string) {
+	e.emit(progressEvent{Event: eventPairingStep, Step: step, Status: statusStarted})
+}
+
+// pairingStep reports the outcome of an adbpair step; err decides between
+// succeeded and failed.
+func (e *eventEmitter) pairingStep(step string, err error, details map[string]any) {
+	ev := progressEvent{Event: eventPairingStep, Step: step, Status: statusSucceeded, Details: details}
+	if err != nil {
+		ev.Status = statusFailed
+		ev.Error = err.Error()
+	}
+	e.emit(ev)
+}
+
+// dirSize returns the total size of the regular files under dir. It is
+// used to report how much a module wrote, so errors simply yield 0.
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,36 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// followPoll is how often a file being followed is checked for new data.
+const followPoll = 250 * time.Millisecond
+
+// followReader reads a file that is still being written, waiting for more
+// data at its end until done is closed; then it reads what is left and
+// ends.
+type followReader struct {
+	f    *os.File
+	done <-chan struct{}
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		select {
+		case <-r.done:
+			return r.f.Read(p)
+		case <-time.After(followPoll):
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	rt "github.com/botherder/go-savetime/runtime"
+)
+
+// analystKeyEnv names the environment variable that points to the analyst's
+// signing key when it is not kept next to the meshcli binary.
+const analystKeyEnv = "MESH_ANALYST_KEY"
+
+// analystKeyFile is the default name of the analyst's signing key.
+const analystKeyFile = "analyst_ed25519.pem"
+
+var analystKey struct {
+	once sync.Once
+	priv ed25519.PrivateKey
+	err  error
+}
+
+func analystKeyPath() string {
+	if p := os.Getenv(analystKeyEnv); p != "" {
+		return p
+	}
+	return filepath.Join(rt.GetExecutableDirectory(), analystKeyFile)
+}
+
+// loadAnalystKey returns the Ed25519 key that identifies the analyst in
+// case logs, generating and saving it on first use.
+func loadAnalystKey() (ed25519.PrivateKey, error) {
+	analystKey.once.Do(func() {
+		analystKey.priv, analystKey.err = readOrCreateAnalystKey(analystKeyPath())
+	})
+	return analystKey.priv, analystKey.err
+}
+
+func readOrCreateAnalystKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("analyst key %s: no PEM data", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("analyst key %s: %w", path, err)
+		}
+		priv, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("analyst key %s is not an Ed25519 key", path)
+		}
+		return priv, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read analyst key: %w", err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to save analyst key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, fmt.Errorf("unable to save analyst key: %w", err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	fmt.Printf("Created analyst signing key %s (%s)\n", path, keyFingerprint(pub))
+	return priv, nil
+}
+
+// keyFingerprint formats a public key the way OpenSSH does, so that
+// analysts can compare it against a fingerprint recorded out of band, or
+// against "ssh-keygen -lf" of the key in OpenSSH format. OpenSSH hashes
+// the key's wire encoding (RFC 8709): the key type and the key, each
+// prefixed with its length.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	var blob []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), pub} {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,26 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	// The key for the seed 00 01 ... 1f; ssh-keygen -lf on
+	//
+	//	ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAOhB7/zzhC+HXDdGOdLwJln5NYwm6UNXx3chmQSVTG4
+	//
+	// prints this fingerprint.
+	const want = "SHA256:lbmsoA0yIEcEiVDRnMWuzm+nV+3ZEEpVIURqFoeSspg"
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if got := keyFingerprint(pub); got != want {
+		t.Errorf("keyFingerprint = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Kinds of network indicators, and of the observations matched against
+// them.
+const (
+	iocDomain = "domain"
+	iocIP     = "ip"
+)
+
+// indicator is a network indicator of compromise from a STIX2 file.
+type indicator struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Threat string `json:"threat,omitempty"` // name of the malware it indicates
+	Source string `json:"source"`
+}
+
+// indicatorSet holds the network indicators loaded from STIX2 files.
+type indicatorSet struct {
+	domains map[string][]*indicator
+	ips     map[netip.Addr][]*indicator
+	count   int
+}
+
+// indicatorFile describes a loaded file, for the case log.
+type indicatorFile struct {
+	Path       string `json:"path"`
+	SHA256     string `json:"sha256"`
+	Indicators int    `json:"indicators"`
+	Skipped    int    `json:"skipped"`
+}
+
+// stixPatternTerm matches the comparisons of a STIX pattern that carry a
+// network indicator, e.g. [domain-name:value = 'example.com'].
+var stixPatternTerm = regexp.MustCompile(`(domain-name|ipv4-addr|ipv6-addr|url):value\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// loadIndicators reads STIX2 bundles, as published for MVT, and keeps
+// their domain, IP and URL indicators. Indicators of other types (app IDs,
+// file hashes, processes and so on) are counted as skipped.
+func loadIndicators(paths []string) (*indicatorSet, []indicatorFile, error) {
+	set := &indicatorSet{
+		domains: make(map[string][]*indicator),
+		ips:     make(map[netip.Addr][]*indicator),
+	}
+	var files []indicatorFile
+	for _, path := range paths {
+		f, err := set.loadSTIX2(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		files = append(files, f)
+	}
+	return set, files, nil
+}
+
+func (set *indicatorSet) loadSTIX2(path string) (indicatorFile, error) {
+	f := indicatorFile{Path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	f.SHA256 = fmt.Sprintf("%x", sha256.Sum256(b))
+	var bundle struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			Type             string `json:"type"`
+			ID               string `json:"id"`
+			Name             string `json:"name"`
+			Pattern          string `json:"pattern"`
+			PatternType      string `json:"pattern_type"`
+			RelationshipType string `json:"relationship_type"`
+			SourceRef        string `json:"source_ref"`
+			TargetRef        string `json:"target_ref"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return f, fmt.Errorf("not a STIX2 bundle: %w", err)
+	}
+	if bundle.Type != "bundle" {
+		return f, fmt.Errorf("not a STIX2 bundle: type is %q", bundle.Type)
+	}
+
+	// MVT's files link each indicator to a malware object that names the
+	// threat.
+	names := make(map[string]string)
+	threats := make(map[string]string)
+	for _, o := range bundle.Objects {
+		if o.Type == "malware" || o.Type == "intrusion-set" || o.Type == "threat-actor" {
+			names[o.ID] = o.Name
+		}
+	}
+	for _, o := range bundle.Objects {
+		if o.Type == "relationship" && o.RelationshipType == "indicates" && names[o.TargetRef] != "" {
+			threats[o.SourceRef] = names[o.TargetRef]
+		}
+	}
+
+	source := filepath.Base(path)
+	for _, o := range bundle.Objects {
+		if o.Type != "indicator" || (o.PatternType != "" && o.PatternType != "stix") {
+			continue
+		}
+		terms := stixPatternTerm.FindAllStringSubmatch(o.Pattern, -1)
+		if len(terms) == 0 {
+			f.Skipped++
+			continue
+		}
+		for _, t := range terms {
+			ind := &indicator{ID: o.ID, Name: o.Name, Threat: threats[o.ID], Source: source}
+			value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(t[2])
+			if !set.add(ind, t[1], value) {
+				f.Skipped++
+				continue
+			}
+			f.Indicators++
+		}
+	}
+	return f, nil
+}
+
+// add indexes an indicator of the given STIX object type, and reports
+// whether its value was usable.
+func (set *indicatorSet) add(ind *indicator, typ, value string) bool {
+	switch typ {
+	case "domain-name":
+		ind.Kind, ind.Value = iocDomain, normalizeDomain(value)
+	case "ipv4-addr", "ipv6-addr":
+		// Indicators sometimes carry a prefix length for a single host.
+		value, _, _ = strings.Cut(value, "/")
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return false
+		}
+		ind.Kind, ind.Value = iocIP, ip.String()
+		set.ips[ip] = append(set.ips[ip], ind)
+		set.count++
+		return true
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil || u.Hostname() == "" {
+			return false
+		}
+		if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+			return set.add(ind, "ipv4-addr", ip.String())
+		}
+		ind.Kind, ind.Value = iocDomain, normalizeDomain(u.Hostname())
+	default:
+		return false
+	}
+	if ind.Value == "" {
+		return false
+	}
+	set.domains[ind.Value] = append(set.domains[ind.Value], ind)
+	set.count++
+	return true
+}
+
+// matchDomain returns the indicators for name or any of its parent
+// domains, so that an indicator for example.com matches
+// www.example.com.
+func (set *indicatorSet) matchDomain(name string) []*indicator {
+	name = normalizeDomain(name)
+	for name != "" {
+		if m := set.domains[name]; len(m) > 0 {
+			return m
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			break
+		}
+		name = parent
+	}
+	return nil
+}
+
+func (set *indicatorSet) matchIP(ip netip.Addr) []*indicator {
+	return set.ips[ip.Unmap()]
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), ".")), "*.")
+}
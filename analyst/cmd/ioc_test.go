@@ -0,0 +1,327 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// testdata/mvt-sample.stix2 follows the layout of the bundles published
+// for MVT: an identity, a malware object, one indicator per observable and
+// "indicates" relationships from the indicators to the malware.
+const mvtSample = "testdata/mvt-sample.stix2"
+
+func TestLoadSTIX2(t *testing.T) {
+	set, files, err := loadIndicators([]string{mvtSample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Indicators != 7 || files[0].Skipped != 3 || len(files[0].SHA256) != 64 {
+		t.Errorf("files = %+v, want 7 indicators and 3 skipped", files)
+	}
+	if set.count != 7 {
+		t.Errorf("count = %d, want 7", set.count)
+	}
+
+	tests := []struct {
+		kind, value string
+		threat      string
+	}{
+		{iocDomain, "free247downloads.com", "Pegasus"},
+		{iocDomain, "urlpush.net", "Pegasus"},
+		{iocDomain, "lnkto.example", ""},
+		{iocDomain, "a.cdn-sync.example", ""},
+		{iocDomain, "b.cdn-sync.example", ""},
+		{iocIP, "198.51.100.23", "Pegasus"},
+		{iocIP, "2001:db8::23", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var m []*indicator
+			if tt.kind == iocIP {
+				m = set.matchIP(netip.MustParseAddr(tt.value))
+			} else {
+				m = set.matchDomain(tt.value)
+			}
+			if len(m) != 1 {
+				t.Fatalf("%d indicators, want 1", len(m))
+			}
+			if m[0].Kind != tt.kind || m[0].Value != tt.value || m[0].Threat != tt.threat || m[0].Source != "mvt-sample.stix2" {
+				t.Errorf("got %+v", m[0])
+			}
+		})
+	}
+}
+
+func TestLoadSTIX2Errors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"not-json.stix2":  "indicators",
+		"not-bundle.json": `{"type":"indicator","pattern":"[domain-name:value='x.example']"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := loadIndicators([]string{path}); err == nil || !strings.Contains(err.Error(), "not a STIX2 bundle") {
+				t.Errorf("got %v, want a not a STIX2 bundle error", err)
+			}
+		})
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	set := &indicatorSet{domains: map[string][]*indicator{}, ips: map[netip.Addr][]*indicator{}}
+	for _, v := range []string{"urlpush.net", "*.wild.example", "c2.deep.example", "net"} {
+		set.add(&indicator{}, "domain-name", v)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"urlpush.net", "urlpush.net"},
+		{"URLPUSH.NET.", "urlpush.net"},
+		{" api.v2.urlpush.net ", "urlpush.net"},
+		{"noturlpush.net", ""},
+		{"urlpush.net.evil.example", ""},
+		{"x.wild.example", "wild.example"},
+		{"wild.example", "wild.example"},
+		{"deep.example", ""},
+		{"a.c2.deep.example", "c2.deep.example"},
+		// A bare TLD indicator would match everything under it.
+		{"other.net", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if m := set.matchDomain(tt.name); len(m) > 0 {
+				got = m[0].Value
+			}
+			if got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// clientHello returns the first TLS record crypto/tls sends for config,
+// which holds its ClientHello.
+func clientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatal(err)
+	}
+	rec := make([]byte, 5+int(binary.BigEndian.Uint16(hdr[3:5])))
+	copy(rec, hdr)
+	if _, err := io.ReadFull(server, rec[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestClientHelloSNI(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *tls.Config
+		want   string
+	}{
+		{name: "tls13", config: &tls.Config{ServerName: "cdn.urlpush.net"}, want: "cdn.urlpush.net"},
+		{name: "tls12", config: &tls.Config{ServerName: "free247downloads.com", MaxVersion: tls.VersionTLS12}, want: "free247downloads.com"},
+		{name: "alpn-session-tickets", config: &tls.Config{ServerName: "a.cdn-sync.example", NextProtos: []string{"h2", "http/1.1"}, ClientSessionCache: tls.NewLRUClientSessionCache(1)}, want: "a.cdn-sync.example"},
+		// crypto/tls sends no SNI for IP addresses.
+		{name: "no-sni", config: &tls.Config{ServerName: "198.51.100.23"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.InsecureSkipVerify = true
+			rec := clientHello(t, tt.config)
+			if got := clientHelloSNI(rec); got != tt.want {
+				t.Errorf("SNI %q, want %q", got, tt.want)
+			}
+			// Truncated records never yield a name or panic.
+			for n := range len(rec) - 1 {
+				if got := clientHelloSNI(rec[:n]); got != "" && got != tt.want {
+					t.Fatalf("truncated to %d bytes: SNI %q", n, got)
+				}
+			}
+		})
+	}
+}
+
+func newTestIOCWatcher(t *testing.T) (*iocWatcher, *bytes.Buffer) {
+	t.Helper()
+	set, _, err := loadIndicators([]string{mvtSample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := &iocWatcher{
+		set: set,
+		peer: &ipnstate.PeerStatus{
+			ID:           "n123",
+			HostName:     "pixel",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.5")},
+		},
+		c:      testCase(t),
+		w:      bufio.NewWriter(&out),
+		hellos: make(map[helloFlow]*partialHello),
+		last:   make(map[string]time.Time),
+		held:   make(map[string]int),
+	}
+	w.enc = json.NewEncoder(w.w)
+	return w, &out
+}
+
+// readAlerts returns the kind and observation of each alert written.
+func readAlerts(t *testing.T, out *bytes.Buffer) []string {
+	t.Helper()
+	var got []string
+	for line := range strings.SplitSeq(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var a iocAlert
+		if err := json.Unmarshal([]byte(line), &a); err != nil {
+			t.Fatal(err)
+		}
+		desc := a.Kind + " " + a.Observed
+		if a.Via != "" {
+			desc += " via " + a.Via
+		}
+		if a.Repeats > 0 {
+			desc += " repeats " + strconv.Itoa(a.Repeats)
+		}
+		got = append(got, desc)
+	}
+	return got
+}
+
+func TestIOCWatcherInspect(t *testing.T) {
+	w, out := newTestIOCWatcher(t)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	query := func(name string) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	hello := clientHello(t, &tls.Config{ServerName: "api.urlpush.net", InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if len(hello) < 300 {
+		t.Fatalf("ClientHello of %d bytes is too short to split", len(hello))
+	}
+
+	packets := []struct {
+		at   time.Duration
+		data []byte
+	}{
+		{0, testPacket(protoUDP, "100.64.0.5", "1.1.1.1", 40000, 53, query("www.free247downloads.com."))},
+		{time.Second, testPacket(protoUDP, "100.64.0.5", "1.1.1.1", 40001, 53, query("example.org."))},
+		{2 * time.Second, testPacket(protoTCP, "100.64.0.5", "198.51.100.23", 40002, 80, nil)},
+		// A ClientHello split across three segments.
+		{3 * time.Second, testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40003, 443, hello[:100])},
+		{3 * time.Second, testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40003, 443, hello[100:250])},
+		{3 * time.Second, testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40003, 443, hello[250:])},
+		// The same query again within iocAlertRepeat is held back, and
+		// counted in the next alert after it.
+		{time.Minute, testPacket(protoUDP, "100.64.0.5", "1.1.1.1", 40004, 53, query("www.free247downloads.com."))},
+		{10 * time.Minute, testPacket(protoUDP, "100.64.0.5", "1.1.1.1", 40005, 53, query("www.free247downloads.com."))},
+	}
+	for _, p := range packets {
+		ip, ok := parseIPPacket(p.data)
+		if !ok {
+			t.Fatal("test packet not parsed")
+		}
+		if err := w.inspect(now.Add(p.at), &ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"dns www.free247downloads.com.",
+		"ip 198.51.100.23",
+		"sni api.urlpush.net",
+		"dns www.free247downloads.com. repeats 1",
+	}
+	if got := readAlerts(t, out); !slices.Equal(got, want) {
+		t.Errorf("alerts:\n got %q\nwant %q", got, want)
+	}
+	if len(w.hellos) != 0 {
+		t.Errorf("%d partial ClientHellos left", len(w.hellos))
+	}
+
+	entries, err := readCaseLog(w.c.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := 0
+	for _, ev := range entries {
+		if ev.Event == "ioc_alert" {
+			logged++
+		}
+	}
+	if logged != len(want) {
+		t.Errorf("%d ioc_alert case entries, want %d", logged, len(want))
+	}
+}
+
+func TestIOCWatcherDNSLog(t *testing.T) {
+	w, out := newTestIOCWatcher(t)
+	var log bytes.Buffer
+	enc := json.NewEncoder(&log)
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, e := range []dnsLogEntry{
+		{Time: now, Client: "100.64.0.5", Proto: "udp", Name: "cdn.urlpush.net.", Type: "A"},
+		{Time: now, Client: "100.64.0.5", Proto: "udp", Name: "example.org.", Type: "A"},
+		// Another peer's query is not matched.
+		{Time: now, Client: "100.64.0.8", Proto: "udp", Name: "free247downloads.com.", Type: "A"},
+		{Time: now.Add(time.Second), Client: "100.64.0.5", Proto: "tcp", Name: "b.cdn-sync.example.", Type: "HTTPS"},
+	} {
+		if err := enc.Encode(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.WriteString("not json\n")
+
+	if err := w.readDNSLog(&log); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"dns cdn.urlpush.net. via dnslog",
+		"dns b.cdn-sync.example. via dnslog",
+	}
+	if got := readAlerts(t, out); !slices.Equal(got, want) {
+		t.Errorf("alerts:\n got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,583 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	// iocAlertRepeat is how long an alert for the same observation is
+	// held back after it was raised.
+	iocAlertRepeat = 5 * time.Minute
+
+	// A TLS ClientHello that does not fit in one segment is reassembled
+	// from the following segments of its connection, within these limits.
+	helloMaxLen   = 16 << 10
+	helloMaxFlows = 1024
+	helloTimeout  = 10 * time.Second
+)
+
+// Kinds of observation matched against indicators.
+const (
+	observedDNS = "dns"
+	observedSNI = "sni"
+	observedIP  = "ip"
+)
+
+var iocArgs struct {
+	indicators string
+	alerts     string
+	dnsLog     string
+	duration   time.Duration
+	caseDir    string
+}
+
+func IOCCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("ioc", flag.ContinueOnError)
+	fs.StringVar(&iocArgs.indicators, "indicators", "", "comma-separated STIX2 files or directories of them (default: MVT's indicators)")
+	fs.StringVar(&iocArgs.alerts, "alerts", "", "JSONL file to write alerts to (default: ioc-alerts-<time>.jsonl in the case)")
+	fs.StringVar(&iocArgs.dnsLog, "dns-log", "", "also match the peer's queries in this log of \"meshcli dnslog\", followed as it grows")
+	fs.DurationVar(&iocArgs.duration, "duration", 0, "stop after this long (default: until interrupted)")
+	fs.StringVar(&iocArgs.caseDir, "case", "", "case to record the alerts in (default: $"+caseEnv+" or the current case)")
+
+	return &ffcli.Command{
+		Name:       "ioc",
+		ShortUsage: "meshcli ioc [flags] <peer>",
+		ShortHelp:  "Match a peer's live traffic against indicators of compromise",
+		LongHelp: strings.TrimSpace(`
+Watches the traffic of a peer, given by hostname, MagicDNS name or MESH IP,
+as seen by the local MESH client, and raises an alert when it matches a
+network indicator of compromise:
+
+  dns  the name in a DNS query sent by the peer
+  sni  the server name in a TLS ClientHello sent by the peer
+  ip   the destination address of a packet sent by the peer
+
+Indicators are read from STIX2 bundles such as those published for MVT
+(Mobile Verification Toolkit). Domain, IPv4, IPv6 and URL indicators are
+used; a domain indicator also matches its subdomains, and a URL indicator
+matches its host. Other indicator types are skipped. Without --indicators,
+the files downloaded by "mvt-android download-iocs" are used.
+
+For the peer's internet traffic to be seen, the analyst node must be its
+exit node (see "meshcli monitor"). DNS queries are only seen in the clear
+when they are not encrypted by the app; HTTP/3 (QUIC) server names are not
+inspected.
+
+DNS queries are matched in UDP packets to port 53. A peer that uses an exit
+node normally sends its MagicDNS queries to the exit node's peerapi as DNS
+over HTTP instead, and those are not seen; this has not been checked on a
+real device. To cover them, run "meshcli monitor start --dns" and "meshcli
+dnslog", and give dnslog's file to --dns-log: the queries it logs for the
+peer are matched too, as dns observations.
+
+Alerts are printed and appended to a JSONL file, and recorded in the case
+log. The same observation raises an alert at most every ` + iocAlertRepeat.String() + `; held
+back repeats are counted in the next alert. When ioc stops, the alert file
+is hashed like the files of "meshcli capture".
+
+Examples:
+  meshcli ioc pixel-7
+  meshcli ioc --indicators pegasus.stix2,predator.stix2 100.64.0.5
+  meshcli ioc --dns-log cases/<id>/dns-20240501-100000.jsonl pixel-7
+`),
+		FlagSet: fs,
+		Exec:    runIOC,
+	}
+}
+
+// iocAlert is one line of the alert file.
+type iocAlert struct {
+	Time       time.Time    `json:"time"`
+	Peer       string       `json:"peer"`
+	NodeID     string       `json:"node_id"`
+	Kind       string       `json:"kind"`
+	Observed   string       `json:"observed"`
+	Src        string       `json:"src"`
+	Dst        string       `json:"dst,omitempty"`
+	DstPort    uint16       `json:"dst_port,omitempty"`
+	Via        string       `json:"via,omitempty"` // "dnslog" for queries read from --dns-log
+	Repeats    int          `json:"repeats,omitempty"`
+	Indicators []*indicator `json:"indicators"`
+}
+
+// iocWatcher matches packets against the indicators and raises alerts.
+type iocWatcher struct {
+	set  *indicatorSet
+	peer *ipnstate.PeerStatus
+	c    *Case
+
+	hellos map[helloFlow]*partialHello
+
+	// mu guards the alert file and counters, which packets and the DNS
+	// log both write to.
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+	// last holds when an observation last raised an alert, and held the
+	// repeats since.
+	last    map[string]time.Time
+	held    map[string]int
+	alerts  int
+	packets uint64
+}
+
+type helloFlow struct {
+	src, dst netip.AddrPort
+}
+
+type partialHello struct {
+	data    []byte
+	need    int
+	started time.Time
+}
+
+func runIOC(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: meshcli ioc [flags] <peer>")
+	}
+	paths, err := indicatorPaths(iocArgs.indicators)
+	if err != nil {
+		return err
+	}
+	set, files, err := loadIndicators(paths)
+	if err != nil {
+		return err
+	}
+	if set.count == 0 {
+		return errors.New("no network indicators found in the indicator files")
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	ps, err := findPeer(st, args[0])
+	if err != nil {
+		return err
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("peer %s has no MESH address", args[0])
+	}
+
+	c, err := openCase(iocArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	out := iocArgs.alerts
+	if out == "" {
+		if c == nil {
+			return errors.New("no case selected; use --case or --alerts")
+		}
+		out = filepath.Join(c.Dir, "ioc-alerts-"+time.Now().UTC().Format("20060102-150405")+".jsonl")
+	}
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create alert file: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if iocArgs.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, iocArgs.duration)
+		defer cancel()
+	}
+	rc, err := localClient.StreamDebugCapture(ctx)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to start capture: %w", err)
+	}
+	defer rc.Close()
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	cr, err := newCaptureReader(rc)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w := &iocWatcher{
+		set:    set,
+		peer:   ps,
+		c:      c,
+		w:      bufio.NewWriter(f),
+		hellos: make(map[helloFlow]*partialHello),
+		last:   make(map[string]time.Time),
+		held:   make(map[string]int),
+	}
+	w.enc = json.NewEncoder(w.w)
+	logCase(c, "ioc_watch_started", map[string]any{
+		"peer":            ps.HostName,
+		"node_id":         string(ps.ID),
+		"indicator_files": files,
+		"alerts":          out,
+		"dns_log":         iocArgs.dnsLog,
+	})
+	for _, f := range files {
+		fmt.Printf("Loaded %d network indicators from %s (%d skipped)\n", f.Indicators, f.Path, f.Skipped)
+	}
+	fmt.Printf("Watching %s for %d indicators, alerts to %s. Ctrl-C to stop...\n", sanitizeForTerminal(ps.HostName), set.count, out)
+
+	var dnsDone chan error
+	if iocArgs.dnsLog != "" {
+		dl, err := os.Open(iocArgs.dnsLog)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("unable to read DNS log: %w", err)
+		}
+		defer dl.Close()
+		fmt.Printf("Matching %s's queries in %s\n", sanitizeForTerminal(ps.HostName), iocArgs.dnsLog)
+		dnsDone = make(chan error, 1)
+		go func() { dnsDone <- w.readDNSLog(&followReader{f: dl, done: ctx.Done()}) }()
+	}
+
+	reason, watchErr := w.run(ctx, cr)
+	if dnsDone != nil {
+		// The capture stream only ends early on its own; stop following
+		// the DNS log then too.
+		stop()
+		if err := <-dnsDone; err != nil && watchErr == nil {
+			watchErr = err
+		}
+	}
+	err = w.w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && watchErr == nil {
+		watchErr = fmt.Errorf("closing %s: %w", out, err)
+	}
+	sum, size, err := writeChecksum(out)
+	if err != nil && watchErr == nil {
+		watchErr = err
+	}
+	logCase(c, "ioc_watch_stopped", stepDetails(watchErr, map[string]any{
+		"reason":  reason,
+		"alerts":  w.alerts,
+		"packets": w.packets,
+		"path":    out,
+		"sha256":  sum,
+		"size":    size,
+	}))
+	fmt.Printf("Stopped watching (%s): %d alert(s) in %d packets\n", reason, w.alerts, w.packets)
+	return watchErr
+}
+
+// indicatorPaths expands the --indicators list, reading directories for
+// their .stix2 and .json files.
+func indicatorPaths(list string) ([]string, error) {
+	var entries []string
+	if list == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.New("no --indicators given")
+		}
+		entries = []string{filepath.Join(home, ".local", "share", "mvt", "indicators")}
+	} else {
+		entries = strings.Split(list, ",")
+	}
+	var paths []string
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		fi, err := os.Stat(e)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read indicators: %w", err)
+		}
+		if !fi.IsDir() {
+			paths = append(paths, e)
+			continue
+		}
+		des, err := os.ReadDir(e)
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range des {
+			if ext := filepath.Ext(de.Name()); !de.IsDir() && (ext == ".stix2" || ext == ".json") {
+				paths = append(paths, filepath.Join(e, de.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no indicator files found")
+	}
+	return paths, nil
+}
+
+// run inspects the packets the peer sends until the stream ends and
+// returns why it stopped.
+func (w *iocWatcher) run(ctx context.Context, cr *captureReader) (string, error) {
+	for {
+		p, err := cr.next()
+		if err != nil {
+			switch {
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				return "duration reached", nil
+			case ctx.Err() != nil:
+				return "interrupted", nil
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				return "capture stream ended", nil
+			}
+			return "error", fmt.Errorf("reading capture stream: %w", err)
+		}
+		if p.Path != pathFromPeer {
+			continue
+		}
+		ip, ok := parseIPPacket(p.Data)
+		if !ok || !slices.Contains(w.peer.TailscaleIPs, ip.src) {
+			continue
+		}
+		w.packets++
+		if err := w.inspect(p.Time, &ip); err != nil {
+			return "error", err
+		}
+	}
+}
+
+func (w *iocWatcher) inspect(t time.Time, ip *ipPacket) error {
+	if m := w.set.matchIP(ip.dst); len(m) > 0 {
+		if err := w.alert(t, observedIP, ip.dst.String(), ip, "", m); err != nil {
+			return err
+		}
+	}
+	if !ip.hasPorts || len(ip.payload) == 0 {
+		return nil
+	}
+	switch {
+	case ip.proto == protoUDP && ip.dport == dnsPort:
+		for _, name := range dnsQueryNames(ip.payload) {
+			if m := w.set.matchDomain(name); len(m) > 0 {
+				if err := w.alert(t, observedDNS, name, ip, "", m); err != nil {
+					return err
+				}
+			}
+		}
+	case ip.proto == protoTCP:
+		if sni := w.serverName(t, ip); sni != "" {
+			if m := w.set.matchDomain(sni); len(m) > 0 {
+				return w.alert(t, observedSNI, sni, ip, "", m)
+			}
+		}
+	}
+	return nil
+}
+
+// alert raises an alert, unless the same observation raised one less than
+// iocAlertRepeat ago. ip is the packet it was seen in; observations from
+// the DNS log have none and name their source in via.
+func (w *iocWatcher) alert(t time.Time, kind, observed string, ip *ipPacket, via string, m []*indicator) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := kind + " " + observed
+	if last, ok := w.last[key]; ok && t.Sub(last) < iocAlertRepeat {
+		w.held[key]++
+		return nil
+	}
+	w.last[key] = t
+	a := iocAlert{
+		Time:       t,
+		Peer:       w.peer.HostName,
+		NodeID:     string(w.peer.ID),
+		Kind:       kind,
+		Observed:   observed,
+		Src:        ip.src.String(),
+		Via:        via,
+		Repeats:    w.held[key],
+		Indicators: m,
+	}
+	if ip.dst.IsValid() {
+		a.Dst, a.DstPort = ip.dst.String(), ip.dport
+	}
+	delete(w.held, key)
+	if err := w.enc.Encode(&a); err != nil {
+		return fmt.Errorf("writing alert: %w", err)
+	}
+	// Alerts are flushed as they come, so that none are lost if meshcli is
+	// killed.
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("writing alert: %w", err)
+	}
+	w.alerts++
+	logCase(w.c, "ioc_alert", map[string]any{"alert": a})
+
+	var threats []string
+	for _, ind := range m {
+		desc := ind.Kind + " " + ind.Value
+		if ind.Threat != "" {
+			desc += ", " + ind.Threat
+		}
+		threats = append(threats, desc+", "+ind.Source)
+	}
+	dst := cmp.Or(via, netip.AddrPortFrom(ip.dst, ip.dport).String())
+	fmt.Printf("ALERT %s %s %s -> %s matches %s\n", t.Local().Format(time.TimeOnly), kind,
+		sanitizeForTerminal(observed), dst, sanitizeForTerminal(strings.Join(threats, "; ")))
+	return nil
+}
+
+// readDNSLog matches the queries of the peer in a log written by
+// "meshcli dnslog" until r ends.
+func (w *iocWatcher) readDNSLog(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var e dnsLogEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || e.Name == "" {
+			continue
+		}
+		client, err := netip.ParseAddr(e.Client)
+		if err != nil || !slices.Contains(w.peer.TailscaleIPs, client) {
+			continue
+		}
+		if m := w.set.matchDomain(e.Name); len(m) > 0 {
+			if err := w.alert(e.Time, observedDNS, e.Name, &ipPacket{src: client}, "dnslog", m); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading DNS log: %w", err)
+	}
+	return nil
+}
+
+// dnsQueryNames returns the names asked for in a DNS query.
+func dnsQueryNames(msg []byte) []string {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Response {
+		return nil
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, q := range qs {
+		names = append(names, q.Name.String())
+	}
+	return names
+}
+
+// serverName returns the SNI of a TLS ClientHello carried by a TCP
+// segment, reassembling ClientHellos that span several segments.
+func (w *iocWatcher) serverName(t time.Time, ip *ipPacket) string {
+	flow := helloFlow{netip.AddrPortFrom(ip.src, ip.sport), netip.AddrPortFrom(ip.dst, ip.dport)}
+	if ph, ok := w.hellos[flow]; ok {
+		ph.data = append(ph.data, ip.payload...)
+		if len(ph.data) < ph.need && len(ph.data) < helloMaxLen {
+			return ""
+		}
+		delete(w.hellos, flow)
+		return clientHelloSNI(ph.data)
+	}
+
+	// A TLS handshake record holding a ClientHello.
+	b := ip.payload
+	if len(b) < 6 || b[0] != 0x16 || b[1] != 3 || b[5] != 1 {
+		return ""
+	}
+	need := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+	if len(b) >= need {
+		return clientHelloSNI(b)
+	}
+	if len(w.hellos) >= helloMaxFlows {
+		for f, ph := range w.hellos {
+			if t.Sub(ph.started) > helloTimeout {
+				delete(w.hellos, f)
+			}
+		}
+		if len(w.hellos) >= helloMaxFlows {
+			return ""
+		}
+	}
+	w.hellos[flow] = &partialHello{data: slices.Clone(b), need: need, started: t}
+	return ""
+}
+
+// clientHelloSNI returns the host name of the server_name extension of a
+// TLS record holding a ClientHello, or "" if there is none.
+func clientHelloSNI(rec []byte) string {
+	// Skip the record header, the handshake header, the client version
+	// and random, then the session ID, cipher suites and compression
+	// methods.
+	if len(rec) < 5+4+2+32 {
+		return ""
+	}
+	b, ok := rec[5+4+2+32:], true
+	for _, lenBytes := range []int{1, 2, 1} {
+		if b, ok = skipVector(b, lenBytes); !ok {
+			return ""
+		}
+	}
+	if len(b) < 2 {
+		return ""
+	}
+	exts := b[2:min(len(b), 2+int(binary.BigEndian.Uint16(b[0:2])))]
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts[0:2])
+		n := int(binary.BigEndian.Uint16(exts[2:4]))
+		if len(exts) < 4+n {
+			return ""
+		}
+		ext := exts[4 : 4+n]
+		exts = exts[4+n:]
+		if typ != 0 || len(ext) < 2 {
+			continue
+		}
+		// server_name: a list of (type, name), where type 0 is a host name.
+		for list := ext[2:]; len(list) >= 3; {
+			nameLen := int(binary.BigEndian.Uint16(list[1:3]))
+			if len(list) < 3+nameLen {
+				return ""
+			}
+			if list[0] == 0 {
+				return string(list[3 : 3+nameLen])
+			}
+			list = list[3+nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// skipVector skips a TLS vector whose length takes lenBytes bytes.
+func skipVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lenBytes+n {
+		return nil, false
+	}
+	return b[lenBytes+n:], true
+}
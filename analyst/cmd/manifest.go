@@ -0,0 +1,248 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+)
+
+// Names of the signed manifest and its detached signature, written to the
+// root of the acquisition folder.
+const (
+	manifestFile    = "mesh_manifest.json"
+	manifestSigFile = manifestFile + ".sig"
+)
+
+const manifestVersion = 1
+
+// acquisitionManifest lists every file of an acquisition with its hash,
+// together with who acquired it from which device. It is signed with the
+// analyst key, so that the acquisition can be shown to be unmodified.
+type acquisitionManifest struct {
+	Version     int             `json:"version"`
+	Acquisition string          `json:"acquisition"`
+	Created     time.Time       `json:"created"`
+	Analyst     manifestAnalyst `json:"analyst"`
+	Device      deviceMetadata  `json:"device"`
+	Case        *manifestCase   `json:"case,omitempty"`
+	Files       []manifestEntry `json:"files"`
+}
+
+// manifestCase records the case log's chain head when the manifest was
+// written. The log can be truncated and re-signed by its own key without
+// breaking its chain, but not without losing this entry.
+type manifestCase struct {
+	ID   string `json:"id"`
+	Seq  int    `json:"seq"`
+	Head string `json:"head"`
+}
+
+type manifestAnalyst struct {
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	Host        string `json:"host"`
+}
+
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// deviceMetadata identifies the acquired device both as a MESH peer and as
+// seen over ADB. MESH fields are empty when the device was not connected
+// over MESH.
+type deviceMetadata struct {
+	Serial       string            `json:"serial"`
+	NodeID       string            `json:"node_id,omitempty"`
+	NodeKey      string            `json:"node_key,omitempty"`
+	TailscaleIPs []string          `json:"tailscale_ips,omitempty"`
+	HostName     string            `json:"hostname,omitempty"`
+	DNSName      string            `json:"dns_name,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	OSVersion    string            `json:"os_version,omitempty"`
+	DeviceModel  string            `json:"device_model,omitempty"`
+	Props        map[string]string `json:"props,omitempty"`
+}
+
+// deviceProps are the ADB properties recorded for the acquired device.
+var deviceProps = []string{
+	"ro.serialno",
+	"ro.product.manufacturer",
+	"ro.product.model",
+	"ro.build.fingerprint",
+	"ro.build.version.release",
+	"ro.build.version.security_patch",
+}
+
+// collectDeviceMetadata describes the device with the given ADB serial,
+// looking it up among the MESH peers by the host part of a wireless serial.
+// Lookups are best effort: whatever cannot be determined is left empty.
+func collectDeviceMetadata(ctx context.Context, serial string) deviceMetadata {
+	md := deviceMetadata{Serial: serial, Props: map[string]string{}}
+	for _, prop := range deviceProps {
+		if out, err := adb.Client.Shell("getprop", prop); err == nil {
+			md.Props[prop] = strings.TrimSpace(out)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(serial)
+	if err != nil {
+		return md
+	}
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return md
+	}
+	for _, k := range st.Peers() {
+		peer := st.Peer[k]
+		var ips []string
+		match := false
+		for _, ip := range peer.TailscaleIPs {
+			ips = append(ips, ip.String())
+			match = match || ip.String() == host
+		}
+		if !match {
+			continue
+		}
+		md.NodeID = string(peer.ID)
+		md.NodeKey = peer.PublicKey.String()
+		md.TailscaleIPs = ips
+		md.HostName = peer.HostName
+		md.DNSName = peer.DNSName
+		md.OS = peer.OS
+		break
+	}
+	// The OS version is only in the peer's Hostinfo.
+	if who, err := localClient.WhoIs(ctx, host); err == nil && who.Node != nil && who.Node.Hostinfo.Valid() {
+		md.OSVersion = who.Node.Hostinfo.OSVersion()
+		md.DeviceModel = who.Node.Hostinfo.DeviceModel()
+	}
+	return md
+}
+
+// writeManifest hashes every file in dir and writes the signed manifest,
+// pinning the head of case c if there is one.
+// It returns the SHA-256 of the manifest for the case log.
+func writeManifest(dir, uuid string, device deviceMetadata, c *Case) (string, error) {
+	priv, err := loadAnalystKey()
+	if err != nil {
+		return "", err
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	hostname, _ := os.Hostname()
+
+	files, err := hashTree(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to hash acquisition: %w", err)
+	}
+	m := acquisitionManifest{
+		Version:     manifestVersion,
+		Acquisition: uuid,
+		Created:     time.Now().UTC(),
+		Analyst: manifestAnalyst{
+			Key:         base64.StdEncoding.EncodeToString(pub),
+			Fingerprint: keyFingerprint(pub),
+			Host:        hostname,
+		},
+		Device: device,
+		Files:  files,
+	}
+	if c != nil {
+		head, err := c.Head()
+		if err != nil {
+			return "", fmt.Errorf("unable to read case log: %w", err)
+		}
+		if head != nil {
+			m.Case = &manifestCase{ID: c.ID, Seq: head.Seq, Head: head.Hash}
+		}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), b, 0o600); err != nil {
+		return "", err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, b))
+	if err := os.WriteFile(filepath.Join(dir, manifestSigFile), []byte(sig+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashTree hashes the regular files under dir, except the manifest and its
+// signature, sorted by their slash-separated relative path.
+func hashTree(dir string) ([]manifestEntry, error) {
+	var files []manifestEntry
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == manifestFile || rel == manifestSigFile {
+			return nil
+		}
+		sum, size, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, manifestEntry{Path: rel, Size: size, SHA256: sum})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// writeChecksum hashes path and writes the SHA-256 next to it in
+// <path>.sha256, in the format of sha256sum.
+func writeChecksum(path string) (string, int64, error) {
+	sum, size, err := hashFile(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing %s: %w", path, err)
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	if err := os.WriteFile(path+".sha256", []byte(line), 0o600); err != nil {
+		return "", 0, err
+	}
+	return sum, size, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAcquisition writes a small acquisition folder, with a signed
+// manifest, and returns it.
+func testAcquisition(t *testing.T) string {
+	t.Helper()
+	useTestAnalystKey(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"command.log":          "androidqf log\n",
+		"hashes.csv":           "getprop.txt,abc\n",
+		"getprop.txt":          "[ro.product.model]: [Pixel 7]\n",
+		"packages/com.app.apk": "apk",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writeManifest(dir, "2c3f5a6e", deviceMetadata{Serial: "100.64.0.5:5555"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestManifestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// change modifies the acquisition after the manifest was written.
+		change   func(t *testing.T, dir string)
+		problems string
+	}{
+		{name: "intact", change: func(*testing.T, string) {}},
+		{
+			name: "tampered",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "getprop.txt"), "[ro.product.model]: [Pixel 8]\n")
+			},
+			problems: "1 problem(s)",
+		},
+		{
+			name: "command-log-appended",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "command.log"), "androidqf log\nmore\n")
+			},
+			problems: "1 problem(s)",
+		},
+		{
+			name: "extra",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "packages", "extra.apk"), "apk")
+			},
+			problems: "1 problem(s)",
+		},
+		{
+			name: "tampered-and-extra",
+			change: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, "packages", "com.app.apk"), "APK")
+				writeTestFile(t, filepath.Join(dir, "extra.txt"), "")
+			},
+			problems: "2 problem(s)",
+		},
+		{
+			name: "missing",
+			change: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, "hashes.csv")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			problems: "1 problem(s)",
+		},
+		{
+			name: "manifest-edited",
+			change: func(t *testing.T, dir string) {
+				path := filepath.Join(dir, manifestFile)
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, path, strings.Replace(string(b), "100.64.0.5:5555", "100.64.0.6:5555", 1))
+			},
+			problems: "1 problem(s)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testAcquisition(t)
+			tt.change(t, dir)
+			err := runVerify(context.Background(), []string{dir})
+			switch {
+			case tt.problems == "" && err != nil:
+				t.Errorf("verify failed: %v", err)
+			case tt.problems != "" && (err == nil || !strings.Contains(err.Error(), tt.problems)):
+				t.Errorf("verify returned %v, want %s", err, tt.problems)
+			}
+		})
+	}
+}
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
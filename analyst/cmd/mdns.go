@@ -0,0 +1,253 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	adbPairingService = "_adb-tls-pairing._tcp.local."
+	adbConnectService = "_adb-tls-connect._tcp.local."
+	// dnsSDServices enumerates a responder's service types (RFC 6763,
+	// section 9). It is asked too so that a responder with other services
+	// answers, which tells silence apart from the absence of ADB services.
+	dnsSDServices = "_services._dns-sd._udp.local."
+
+	mdnsPort         = 5353
+	mdnsTimeout      = 3 * time.Second
+	mdnsQueryPeriod  = 750 * time.Millisecond
+	mdnsMaxPacketLen = 9000
+)
+
+// Android binds the wireless debugging pairing and connect services to
+// ephemeral ports, which the Linux kernel allocates from 32768-60999 by
+// default. The fallback scan is limited to that range and rate limited so
+// that it does not look like a full port sweep of the endpoint.
+const (
+	scanPortFirst = 32768
+	scanPortLast  = 60999
+	scanWorkers   = 64
+	scanRate      = 1000 // dials per second
+)
+
+// adbPorts holds the wireless debugging ports found on a device.
+type adbPorts struct {
+	pair    []int
+	connect []int
+	// answered is set when the device's mDNS responder sent any
+	// response, with or without ADB services.
+	answered bool
+}
+
+// discoverADBPorts finds the wireless debugging ports of the device at ip.
+// It asks the device's mDNS responder first and only falls back to a port
+// scan when nothing is advertised. A scan cannot tell both services apart,
+// so in that case every open port is a candidate for both.
+func discoverADBPorts(ctx context.Context, ip string) (adbPorts, error) {
+	fmt.Println("Discovering wireless debugging services via mDNS...")
+	ports, err := browseADBServices(ctx, ip, mdnsTimeout)
+	if err != nil {
+		fmt.Printf("mDNS discovery failed: %v\n", err)
+	}
+	if len(ports.pair) > 0 || len(ports.connect) > 0 {
+		if len(ports.pair) > 0 {
+			fmt.Printf("Found pairing port(s) via mDNS: %v\n", ports.pair)
+		}
+		if len(ports.connect) > 0 {
+			fmt.Printf("Found debug port(s) via mDNS: %v\n", ports.connect)
+		}
+		return ports, nil
+	}
+
+	fmt.Printf("No wireless debugging services advertised, scanning ports %d-%d (this can take about %ds)...\n",
+		scanPortFirst, scanPortLast, (scanPortLast-scanPortFirst)/scanRate)
+	open, err := scanOpenPorts(ctx, ip)
+	if err != nil {
+		return adbPorts{}, fmt.Errorf("port scan failed: %w", err)
+	}
+	return adbPorts{pair: open, connect: open}, nil
+}
+
+// browseADBServices sends DNS-SD queries for the ADB wireless debugging
+// services to the mDNS responder of the device at ip and returns the ports
+// it advertises. Multicast does not cross the MESH tunnel, so the queries
+// are sent as legacy unicast queries (RFC 6762, section 6.7) to port 5353
+// on the peer, which answers directly to our socket.
+func browseADBServices(ctx context.Context, ip string, timeout time.Duration) (adbPorts, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", net.JoinHostPort(ip, strconv.Itoa(mdnsPort)))
+	if err != nil {
+		return adbPorts{}, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+
+	res := &mdnsResult{
+		instances: make(map[string]string),
+		ports:     make(map[string]int),
+	}
+
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	wg.Go(func() {
+		t := time.NewTicker(mdnsQueryPeriod)
+		defer t.Stop()
+		for {
+			msg, err := res.query()
+			if err == nil {
+				conn.Write(msg)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	})
+
+	buf := make([]byte, mdnsMaxPacketLen)
+	var readErr error
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			// An ICMP port unreachable surfaces as a read error; keep
+			// listening as the responder may still be starting up.
+			readErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		res.add(buf[:n])
+	}
+
+	ports := res.result()
+	if !ports.answered && readErr != nil {
+		return ports, readErr
+	}
+	return ports, nil
+}
+
+// mdnsResult accumulates the service instances seen in mDNS responses.
+type mdnsResult struct {
+	mu        sync.Mutex
+	instances map[string]string // instance name -> service name
+	ports     map[string]int    // instance name -> SRV port
+	responses int
+}
+
+// query builds the next query to send: PTR questions for both services and
+// the service enumeration, and SRV questions for any instance whose port
+// has not been seen yet.
+func (r *mdnsResult) query() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x4d45})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	ask := func(name string, typ dnsmessage.Type) error {
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return err
+		}
+		return b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	}
+	for _, svc := range []string{adbPairingService, adbConnectService, dnsSDServices} {
+		if err := ask(svc, dnsmessage.TypePTR); err != nil {
+			return nil, err
+		}
+	}
+	for inst := range r.instances {
+		if _, ok := r.ports[inst]; ok {
+			continue
+		}
+		if err := ask(inst, dnsmessage.TypeSRV); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// add records the PTR and SRV records of an mDNS response.
+func (r *mdnsResult) add(packet []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(packet); err != nil || !msg.Header.Response {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.responses++
+	for _, rr := range slices.Concat(msg.Answers, msg.Additionals) {
+		name := strings.ToLower(rr.Header.Name.String())
+		switch body := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if svc := adbServiceOf(name); svc != "" {
+				r.instances[strings.ToLower(body.PTR.String())] = svc
+			}
+		case *dnsmessage.SRVResource:
+			if svc := adbServiceOf(name); svc != "" {
+				r.instances[name] = svc
+				r.ports[name] = int(body.Port)
+			}
+		}
+	}
+}
+
+func (r *mdnsResult) result() adbPorts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := adbPorts{answered: r.responses > 0}
+	for inst, port := range r.ports {
+		switch r.instances[inst] {
+		case adbPairingService:
+			out.pair = append(out.pair, port)
+		case adbConnectService:
+			out.connect = append(out.connect, port)
+		}
+	}
+	slices.Sort(out.pair)
+	slices.Sort(out.connect)
+	out.pair = slices.Compact(out.pair)
+	out.connect = slices.Compact(out.connect)
+	return out
+}
+
+// adbServiceOf returns the ADB service that name belongs to, or "" if it is
+// not an ADB wireless debugging service or instance name.
+func adbServiceOf(name string) string {
+	for _, svc := range []string{adbPairingService, adbConnectService} {
+		if name == svc || strings.HasSuffix(name, "."+svc) {
+			return svc
+		}
+	}
+	return ""
+}
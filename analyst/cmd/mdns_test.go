@@ -0,0 +1,143 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestADBServiceOf(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: adbPairingService, want: adbPairingService},
+		{name: adbConnectService, want: adbConnectService},
+		{name: "adb-1a2b3c-x9y8z7." + adbPairingService, want: adbPairingService},
+		{name: "adb-1a2b3c." + adbConnectService, want: adbConnectService},
+		{name: "adb-1a2b3c" + adbConnectService},
+		{name: adbPairingService + "example."},
+		{name: "chromecast._googlecast._tcp.local."},
+		{name: dnsSDServices},
+	}
+	for _, tt := range tests {
+		if got := adbServiceOf(tt.name); got != tt.want {
+			t.Errorf("adbServiceOf(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func testMDNSResponse(t *testing.T, answers []dnsmessage.Resource, additionals ...dnsmessage.Resource) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testPTR(service, instance string) dnsmessage.Resource {
+	return testAnswer(service, &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance)})
+}
+
+func testSRV(instance string, port uint16) dnsmessage.Resource {
+	return testAnswer(instance, &dnsmessage.SRVResource{Port: port, Target: dnsmessage.MustNewName("Android.local.")})
+}
+
+// mdnsQuestions returns the questions of an mDNS query as "<type> <name>".
+func mdnsQuestions(t *testing.T, r *mdnsResult) []string {
+	t.Helper()
+	b, err := r.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Response {
+		t.Error("query sent as a response")
+	}
+	var out []string
+	for _, q := range msg.Questions {
+		out = append(out, q.Type.String()+" "+q.Name.String())
+	}
+	return out
+}
+
+func TestMDNSResult(t *testing.T) {
+	const (
+		pairInst    = "adb-1a2b3c-x9y8z7." + adbPairingService
+		connectInst = "adb-1a2b3c." + adbConnectService
+	)
+	browse := []string{
+		"TypePTR " + adbPairingService,
+		"TypePTR " + adbConnectService,
+		"TypePTR " + dnsSDServices,
+	}
+	r := &mdnsResult{instances: make(map[string]string), ports: make(map[string]int)}
+	if got := mdnsQuestions(t, r); !slices.Equal(got, browse) {
+		t.Errorf("first query asks %q, want %q", got, browse)
+	}
+
+	// Our own query looped back, and garbage, are not responses.
+	q, err := r.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.add(q)
+	r.add([]byte{0xde, 0xad})
+	if got := r.result(); got.answered {
+		t.Errorf("answered without a response: %+v", got)
+	}
+
+	// The device answers the PTR questions, with the SRV record of the
+	// debug instance only. Names are matched case-insensitively.
+	r.add(testMDNSResponse(t,
+		[]dnsmessage.Resource{
+			testPTR(adbPairingService, "ADB-1A2B3C-X9Y8Z7."+adbPairingService),
+			testPTR(adbConnectService, connectInst),
+			testPTR(dnsSDServices, "_googlecast._tcp.local."),
+		},
+		testSRV(connectInst, 41000),
+	))
+	got := r.result()
+	if !got.answered || len(got.pair) != 0 || !slices.Equal(got.connect, []int{41000}) {
+		t.Errorf("after the PTR answers: %+v", got)
+	}
+	if got, want := mdnsQuestions(t, r), append(slices.Clone(browse), "TypeSRV "+pairInst); !slices.Equal(got, want) {
+		t.Errorf("second query asks %q, want %q", got, want)
+	}
+
+	// The SRV answer for the pairing instance, and a second debug
+	// instance on the same port.
+	r.add(testMDNSResponse(t, []dnsmessage.Resource{
+		testSRV(pairInst, 37000),
+		testSRV("adb-other."+adbConnectService, 41000),
+		testSRV("chromecast._googlecast._tcp.local.", 8009),
+	}))
+	got = r.result()
+	if !slices.Equal(got.pair, []int{37000}) || !slices.Equal(got.connect, []int{41000}) {
+		t.Errorf("after the SRV answers: %+v", got)
+	}
+	if got := mdnsQuestions(t, r); !slices.Equal(got, browse) {
+		t.Errorf("query once every port is known asks %q, want %q", got, browse)
+	}
+}
+
+func TestMDNSResultWithoutADB(t *testing.T) {
+	r := &mdnsResult{instances: make(map[string]string), ports: make(map[string]int)}
+	r.add(testMDNSResponse(t, []dnsmessage.Resource{testPTR(dnsSDServices, "_googlecast._tcp.local.")}))
+	if got := r.result(); !got.answered || len(got.pair) != 0 || len(got.connect) != 0 {
+		t.Errorf("result %+v, want an answer without ports", got)
+	}
+}
@@ -0,0 +1,783 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	rt "github.com/botherder/go-savetime/runtime"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+)
+
+// monitorStateFile records every change monitor start made, so that
+// monitor stop can revert them even after a crash.
+const monitorStateFile = "mesh_monitor_state.json"
+
+// headscaleAPIKeyEnv holds the Headscale API key used to approve the exit
+// node routes. It is never written to the state file.
+const headscaleAPIKeyEnv = "MESH_HEADSCALE_API_KEY"
+
+// iptablesComment marks the firewall rules added by monitor start.
+const iptablesComment = "meshcli-monitor"
+
+// MESH address ranges, used to limit forwarding and NAT to MESH traffic.
+var (
+	meshPrefix4 = netip.MustParsePrefix("100.64.0.0/10")
+	meshPrefix6 = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+	exitRoutes  = []string{"0.0.0.0/0", "::/0"}
+)
+
+var monitorArgs struct {
+	state      string
+	wan        string
+	controlURL string
+	caseDir    string
+	dns        bool
+	hsConfig   string
+}
+
+// Kinds of change recorded in the monitor state.
+const (
+	changeSysctl        = "sysctl"
+	changeFirewall      = "firewall"
+	changeAdvertise     = "advertise_exit_node"
+	changeApproveRoutes = "approve_routes"
+	changeDNSConfig     = "dns_config"
+)
+
+// monitorChange is one change made by monitor start, with what is needed
+// to revert it.
+type monitorChange struct {
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+
+	// sysctl
+	Key      string `json:"key,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Value    string `json:"value,omitempty"`
+
+	// firewall
+	Command string   `json:"command,omitempty"`
+	Table   string   `json:"table,omitempty"`
+	Chain   string   `json:"chain,omitempty"`
+	Rule    []string `json:"rule,omitempty"`
+
+	// advertise_exit_node and approve_routes
+	PreviousRoutes []string `json:"previous_routes,omitempty"`
+	ControlURL     string   `json:"control_url,omitempty"`
+	NodeID         string   `json:"node_id,omitempty"`
+
+	// dns_config: the previous content of the file at Path, restored only
+	// while the file still hashes to Written.
+	Path    string `json:"path,omitempty"`
+	Written string `json:"written_sha256,omitempty"`
+}
+
+// monitorState is the content of the state file.
+type monitorState struct {
+	Started       time.Time       `json:"started"`
+	MeshInterface string          `json:"mesh_interface"`
+	WANInterface  string          `json:"wan_interface"`
+	Case          string          `json:"case,omitempty"`
+	Changes       []monitorChange `json:"changes"`
+
+	path string
+}
+
+func MonitorCmd() *ffcli.Command {
+	stopFS := flag.NewFlagSet("monitor stop", flag.ContinueOnError)
+	stopFS.StringVar(&monitorArgs.state, "state", "", "state file (default: "+monitorStateFile+" next to meshcli)")
+	stopFS.StringVar(&monitorArgs.caseDir, "case", "", "case to record the changes in (default: the case recorded by monitor start)")
+
+	startFS := flag.NewFlagSet("monitor start", flag.ContinueOnError)
+	startFS.StringVar(&monitorArgs.state, "state", "", "state file (default: "+monitorStateFile+" next to meshcli)")
+	startFS.StringVar(&monitorArgs.caseDir, "case", "", "case to record the changes in (default: $"+caseEnv+" or the current case)")
+	startFS.StringVar(&monitorArgs.wan, "wan-interface", "", "interface to the internet (default: the one of the default route)")
+	startFS.StringVar(&monitorArgs.controlURL, "control-url", "", "Headscale URL for route approval (default: the MESH client's control URL)")
+	startFS.BoolVar(&monitorArgs.dns, "dns", false, "make this node the MESH nameserver, for meshcli dnslog")
+	startFS.StringVar(&monitorArgs.hsConfig, "headscale-config", "", "Headscale config.yaml to set the nameserver in, with --dns")
+
+	return &ffcli.Command{
+		Name:       "monitor",
+		ShortUsage: "meshcli monitor <start|stop> [flags]",
+		ShortHelp:  "Turn this node into a monitoring exit node, and back",
+		LongHelp: strings.TrimSpace(`
+Turns the analyst node into an exit node for network monitoring, replacing
+the sysctl and iptables steps of the exit node guide, and reverts it.
+
+monitor start (Linux, as root):
+  - enables IPv4 and IPv6 forwarding,
+  - adds FORWARD rules between the MESH interface and the interface to the
+    internet, and NAT for MESH addresses leaving through it, all tagged
+    "` + iptablesComment + `",
+  - advertises this node as an exit node,
+  - approves the exit node routes on Headscale when $` + headscaleAPIKeyEnv + `
+    holds an API key (create one with "headscale apikeys create").
+
+With --dns, the control plane's global nameservers are replaced by this
+node's MESH address, so that "meshcli dnslog" sees the endpoints' queries.
+Headscale only takes DNS settings from its configuration file: give it with
+--headscale-config when it is reachable from this host, and restart
+Headscale after start and after stop. The nameservers are restored on stop
+unless the file was changed in the meantime. The setting applies to every
+node; run dnslog for the whole session.
+
+monitor start does not switch endpoints to this exit node: Headscale cannot
+choose an exit node for a client. Select it in the MESH app on the device,
+or have an MDM set this node's stable ID, which monitor start prints, as the
+app's forced exit node ("ExitNodeID").
+
+Every change is recorded in a state file as it is made, together with the
+previous value, and in the case log. Settings that were already in place
+are left alone and not recorded. monitor stop reverts the recorded changes
+in reverse order and removes the state file; after a crash, run monitor
+stop to recover. monitor start refuses to run while a state file exists.
+
+Capture the traffic with "meshcli capture".
+
+Examples:
+  sudo meshcli monitor start
+  sudo MESH_HEADSCALE_API_KEY=... meshcli monitor start
+  sudo meshcli monitor start --dns --headscale-config /etc/headscale/config.yaml
+  sudo meshcli monitor stop
+`),
+		FlagSet: flag.NewFlagSet("monitor", flag.ContinueOnError),
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "start",
+				ShortUsage: "meshcli monitor start [flags]",
+				ShortHelp:  "Enable forwarding and NAT and advertise this node as an exit node",
+				FlagSet:    startFS,
+				Exec:       runMonitorStart,
+			},
+			{
+				Name:       "stop",
+				ShortUsage: "meshcli monitor stop [flags]",
+				ShortHelp:  "Revert every change made by monitor start",
+				FlagSet:    stopFS,
+				Exec:       runMonitorStop,
+			},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+func monitorStatePath() string {
+	if monitorArgs.state != "" {
+		return monitorArgs.state
+	}
+	return filepath.Join(rt.GetExecutableDirectory(), monitorStateFile)
+}
+
+func loadMonitorState(path string) (*monitorState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &monitorState{path: path}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("invalid monitor state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *monitorState) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// record adds a change and saves the state right away, so that a crash
+// right after a change still leaves it recorded.
+func (s *monitorState) record(c *Case, ch monitorChange) error {
+	ch.Time = time.Now().UTC()
+	s.Changes = append(s.Changes, ch)
+	logCase(c, "monitor_change", map[string]any{"change": ch})
+	if err := s.save(); err != nil {
+		return fmt.Errorf("unable to save monitor state: %w", err)
+	}
+	return nil
+}
+
+func runMonitorStart(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	if runtime.GOOS != "linux" {
+		return errors.New("monitor mode is only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("monitor start must run as root")
+	}
+	path := monitorStatePath()
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("a monitor session is still recorded in %s; run \"meshcli monitor stop\" first", path)
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	if st.Self == nil || len(st.Self.TailscaleIPs) == 0 {
+		return errors.New("this node has no MESH address; run \"meshcli up\" first")
+	}
+	meshIf, err := interfaceWithAddr(st.Self.TailscaleIPs[0])
+	if err != nil {
+		return err
+	}
+	wanIf := monitorArgs.wan
+	if wanIf == "" {
+		if wanIf, err = defaultRouteInterface(); err != nil {
+			return err
+		}
+	}
+	c, err := openCase(monitorArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	s := &monitorState{
+		path:          path,
+		Started:       time.Now().UTC(),
+		MeshInterface: meshIf,
+		WANInterface:  wanIf,
+	}
+	if c != nil {
+		s.Case = c.Dir
+	}
+	if err := s.save(); err != nil {
+		return fmt.Errorf("unable to create monitor state: %w", err)
+	}
+	fmt.Printf("Starting monitor mode: MESH interface %s, internet interface %s\n", meshIf, wanIf)
+	logCase(c, "monitor_started", map[string]any{"mesh_interface": meshIf, "wan_interface": wanIf, "state": path})
+
+	if err := startMonitor(ctx, c, s); err != nil {
+		fmt.Printf("Monitor start failed: %v\nReverting the changes made so far...\n", err)
+		if rerr := stopMonitor(ctx, c, s); rerr != nil {
+			return fmt.Errorf("%w (revert also failed: %v)", err, rerr)
+		}
+		return err
+	}
+
+	if err := localClient.CheckIPForwarding(ctx); err != nil {
+		fmt.Printf("WARNING: the MESH client still reports a forwarding problem: %v\n", err)
+	}
+	fmt.Printf("\nTo route an endpoint through this node, select this node as exit node in the MESH app on the device,\n")
+	fmt.Printf("or set the app's managed \"ExitNodeID\" setting to this node's stable ID: %s\n", st.Self.ID)
+	fmt.Printf("\nMonitor mode is active; run \"meshcli monitor stop\" to revert.\n")
+	return nil
+}
+
+// startMonitor makes the changes for monitor mode, recording each one.
+func startMonitor(ctx context.Context, c *Case, s *monitorState) error {
+	for _, key := range []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding"} {
+		prev, err := readSysctl(key)
+		if err != nil {
+			return err
+		}
+		if prev == "1" {
+			fmt.Printf("%s is already enabled\n", key)
+			continue
+		}
+		if err := writeSysctl(key, "1"); err != nil {
+			return err
+		}
+		fmt.Printf("Enabled %s\n", key)
+		if err := s.record(c, monitorChange{Kind: changeSysctl, Key: key, Previous: prev, Value: "1"}); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range monitorFirewallRules(s.MeshInterface, s.WANInterface) {
+		added, err := r.add()
+		if err != nil {
+			return err
+		}
+		if !added {
+			continue
+		}
+		fmt.Printf("Added %s rule: -t %s -A %s %s\n", r.Command, r.Table, r.Chain, strings.Join(r.Rule, " "))
+		if err := s.record(c, r); err != nil {
+			return err
+		}
+	}
+
+	prefs, err := localClient.GetPrefs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH preferences: %w", err)
+	}
+	controlURL := cmp.Or(monitorArgs.controlURL, prefs.ControlURL)
+	if prefs.AdvertisesExitNode() {
+		fmt.Printf("This node already advertises itself as an exit node\n")
+	} else {
+		var prev []string
+		for _, r := range prefs.AdvertiseRoutes {
+			prev = append(prev, r.String())
+		}
+		np := ipn.Prefs{AdvertiseRoutes: slices.Clone(prefs.AdvertiseRoutes)}
+		np.SetAdvertiseExitNode(true)
+		if _, err := localClient.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: np, AdvertiseRoutesSet: true}); err != nil {
+			return fmt.Errorf("failed to advertise exit node: %w", err)
+		}
+		fmt.Printf("Advertising this node as an exit node\n")
+		if err := s.record(c, monitorChange{Kind: changeAdvertise, PreviousRoutes: prev}); err != nil {
+			return err
+		}
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	if err := approveExitRoutes(ctx, c, s, st.Self.PublicKey.String(), controlURL); err != nil {
+		return err
+	}
+	if monitorArgs.dns {
+		ip, ok := meshIPv4(st)
+		if !ok {
+			return errors.New("this node has no MESH IPv4 address to serve DNS on")
+		}
+		return pushNameserver(c, s, ip)
+	}
+	return nil
+}
+
+// approveExitRoutes approves the exit node routes of this node on
+// Headscale, when an API key is available.
+func approveExitRoutes(ctx context.Context, c *Case, s *monitorState, nodeKey, controlURL string) error {
+	apiKey := os.Getenv(headscaleAPIKeyEnv)
+	if apiKey == "" {
+		fmt.Printf("$%s is not set: approve the exit node routes on the control plane, e.g.\n", headscaleAPIKeyEnv)
+		fmt.Printf("  headscale nodes approve-routes --identifier <id> --routes %s\n", strings.Join(exitRoutes, ","))
+		return nil
+	}
+	hs := &headscaleClient{baseURL: controlURL, apiKey: apiKey}
+	node, err := hs.nodeByKey(ctx, nodeKey)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(exitRoutes, func(r string) bool { return !slices.Contains(node.ApprovedRoutes, r) }) {
+		fmt.Printf("The exit node routes are already approved on %s\n", controlURL)
+		return nil
+	}
+	routes := slices.Clone(node.ApprovedRoutes)
+	for _, r := range exitRoutes {
+		if !slices.Contains(routes, r) {
+			routes = append(routes, r)
+		}
+	}
+	if err := hs.approveRoutes(ctx, node.ID, routes); err != nil {
+		return err
+	}
+	fmt.Printf("Approved the exit node routes for node %s on %s\n", node.ID, controlURL)
+	return s.record(c, monitorChange{Kind: changeApproveRoutes, ControlURL: controlURL, NodeID: node.ID, PreviousRoutes: node.ApprovedRoutes})
+}
+
+// pushNameserver makes ip the only global nameserver in the Headscale
+// configuration, or tells the analyst how to when the file is not given.
+func pushNameserver(c *Case, s *monitorState, ip netip.Addr) error {
+	if monitorArgs.hsConfig == "" {
+		fmt.Printf("--headscale-config is not set: in the Headscale configuration, set\n")
+		fmt.Printf("  dns:\n    nameservers:\n      global:\n        - %s\n", ip)
+		fmt.Printf("and restart Headscale; revert it when monitoring ends.\n")
+		return nil
+	}
+	path := monitorArgs.hsConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read Headscale configuration: %w", err)
+	}
+	updated, prev, err := setGlobalNameservers(string(b), []string{ip.String()})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if updated == string(b) {
+		fmt.Printf("%s is already the global nameserver in %s\n", ip, path)
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(updated), fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("unable to update Headscale configuration: %w", err)
+	}
+	fmt.Printf("Set the global nameserver in %s to %s (was: %s)\n", path, ip, orDash(strings.Join(prev, ", ")))
+	fmt.Printf("Restart Headscale for it to take effect, e.g. \"docker compose restart headscale\", and run \"meshcli dnslog\".\n")
+	return s.record(c, monitorChange{Kind: changeDNSConfig, Path: path, Previous: string(b), Written: fmt.Sprintf("%x", sha256.Sum256([]byte(updated))), PreviousRoutes: prev})
+}
+
+func runMonitorStop(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	s, err := loadMonitorState(monitorStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Monitor mode is not active.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c, err := openCase(cmp.Or(monitorArgs.caseDir, s.Case), false)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stopping monitor mode started %s\n", s.Started.Format(time.RFC3339))
+	return stopMonitor(ctx, c, s)
+}
+
+// stopMonitor reverts the recorded changes, newest first. Changes that
+// cannot be reverted stay in the state file so that stop can be retried.
+func stopMonitor(ctx context.Context, c *Case, s *monitorState) error {
+	var failed []monitorChange
+	for i := len(s.Changes) - 1; i >= 0; i-- {
+		ch := s.Changes[i]
+		err := revertChange(ctx, ch)
+		logCase(c, "monitor_revert", stepDetails(err, map[string]any{"change": ch}))
+		if err != nil {
+			fmt.Printf("FAILED to revert %s: %v\n", ch.Kind, err)
+			failed = append([]monitorChange{ch}, failed...)
+		}
+	}
+	if len(failed) > 0 {
+		s.Changes = failed
+		if err := s.save(); err != nil {
+			return fmt.Errorf("unable to save monitor state: %w", err)
+		}
+		return fmt.Errorf("%d change(s) could not be reverted and remain recorded in %s", len(failed), s.path)
+	}
+	if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	logCase(c, "monitor_stopped", map[string]any{"state": s.path})
+	fmt.Println("Monitor mode stopped, all changes reverted.")
+	return nil
+}
+
+func revertChange(ctx context.Context, ch monitorChange) error {
+	switch ch.Kind {
+	case changeSysctl:
+		if err := writeSysctl(ch.Key, ch.Previous); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s to %s\n", ch.Key, ch.Previous)
+	case changeFirewall:
+		if err := ch.remove(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s rule: -t %s -A %s %s\n", ch.Command, ch.Table, ch.Chain, strings.Join(ch.Rule, " "))
+	case changeAdvertise:
+		var routes []netip.Prefix
+		for _, r := range ch.PreviousRoutes {
+			p, err := netip.ParsePrefix(r)
+			if err != nil {
+				return err
+			}
+			routes = append(routes, p)
+		}
+		if _, err := localClient.EditPrefs(ctx, &ipn.MaskedPrefs{Prefs: ipn.Prefs{AdvertiseRoutes: routes}, AdvertiseRoutesSet: true}); err != nil {
+			return err
+		}
+		fmt.Printf("Stopped advertising this node as an exit node\n")
+	case changeApproveRoutes:
+		apiKey := os.Getenv(headscaleAPIKeyEnv)
+		if apiKey == "" {
+			return fmt.Errorf("$%s is needed to restore the approved routes of node %s", headscaleAPIKeyEnv, ch.NodeID)
+		}
+		hs := &headscaleClient{baseURL: ch.ControlURL, apiKey: apiKey}
+		if err := hs.approveRoutes(ctx, ch.NodeID, ch.PreviousRoutes); err != nil {
+			return err
+		}
+		fmt.Printf("Restored the approved routes of node %s on %s\n", ch.NodeID, ch.ControlURL)
+	case changeDNSConfig:
+		b, err := os.ReadFile(ch.Path)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(b)) != ch.Written {
+			return fmt.Errorf("%s was changed since monitor start; restore the global nameservers (%s) by hand", ch.Path, strings.Join(ch.PreviousRoutes, ", "))
+		}
+		fi, err := os.Stat(ch.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(ch.Path, []byte(ch.Previous), fi.Mode().Perm()); err != nil {
+			return err
+		}
+		fmt.Printf("Restored the global nameservers in %s; restart Headscale for it to take effect\n", ch.Path)
+	default:
+		return fmt.Errorf("unknown change %q", ch.Kind)
+	}
+	return nil
+}
+
+func sysctlPath(key string) string {
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+func readSysctl(key string) (string, error) {
+	b, err := os.ReadFile(sysctlPath(key))
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func writeSysctl(key, value string) error {
+	if err := os.WriteFile(sysctlPath(key), []byte(value+"\n"), 0o644); err != nil {
+		return fmt.Errorf("unable to set %s: %w", key, err)
+	}
+	return nil
+}
+
+// monitorFirewallRules are the forwarding and NAT rules of the exit node
+// guide, limited to MESH addresses and tagged with iptablesComment.
+func monitorFirewallRules(meshIf, wanIf string) []monitorChange {
+	tag := []string{"-m", "comment", "--comment", iptablesComment}
+	var rules []monitorChange
+	for _, fam := range []struct {
+		command string
+		prefix  netip.Prefix
+	}{
+		{"iptables", meshPrefix4},
+		{"ip6tables", meshPrefix6},
+	} {
+		rule := func(table, chain string, args ...string) monitorChange {
+			return monitorChange{Kind: changeFirewall, Command: fam.command, Table: table, Chain: chain, Rule: append(args, tag...)}
+		}
+		rules = append(rules,
+			rule("filter", "FORWARD", "-i", meshIf, "-o", wanIf, "-s", fam.prefix.String(), "-j", "ACCEPT"),
+			rule("filter", "FORWARD", "-i", wanIf, "-o", meshIf, "-d", fam.prefix.String(), "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"),
+			rule("nat", "POSTROUTING", "-o", wanIf, "-s", fam.prefix.String(), "-j", "MASQUERADE"),
+		)
+	}
+	return rules
+}
+
+// add inserts the rule unless it is already there, and reports whether it
+// did.
+func (r monitorChange) add() (bool, error) {
+	if r.iptables("-C") == nil {
+		return false, nil
+	}
+	if err := r.iptables("-A"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r monitorChange) remove() error {
+	return r.iptables("-D")
+}
+
+func (r monitorChange) iptables(op string) error {
+	args := append([]string{"-t", r.Table, op, r.Chain}, r.Rule...)
+	out, err := exec.Command(r.Command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", r.Command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// interfaceWithAddr returns the name of the interface holding addr.
+func interfaceWithAddr(addr netip.Addr) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil && p.Addr() == addr {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface holds the MESH address %s", addr)
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route.
+func defaultRouteInterface() (string, error) {
+	out, err := exec.Command("ip", "route", "show", "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to find the default route, use --wan-interface: %w", err)
+	}
+	f := strings.Fields(string(out))
+	if i := slices.Index(f, "dev"); i != -1 && i+1 < len(f) {
+		return f[i+1], nil
+	}
+	return "", errors.New("no default route found, use --wan-interface")
+}
+
+// headscaleClient talks to the Headscale REST API.
+type headscaleClient struct {
+	baseURL string
+	apiKey  string
+}
+
+type headscaleNode struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	NodeKey        string   `json:"nodeKey"`
+	ApprovedRoutes []string `json:"approvedRoutes"`
+}
+
+func (h *headscaleClient) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(h.baseURL, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("headscale %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// nodeByKey finds the Headscale node with the given node key.
+func (h *headscaleClient) nodeByKey(ctx context.Context, nodeKey string) (*headscaleNode, error) {
+	var resp struct {
+		Nodes []headscaleNode `json:"nodes"`
+	}
+	if err := h.do(ctx, http.MethodGet, "/api/v1/node", nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, n := range resp.Nodes {
+		if n.NodeKey == nodeKey {
+			return &n, nil
+		}
+	}
+	return nil, fmt.Errorf("this node (%s) is not registered on %s", nodeKey, h.baseURL)
+}
+
+// approveRoutes sets the routes approved for a node, replacing the
+// previous list.
+func (h *headscaleClient) approveRoutes(ctx context.Context, nodeID string, routes []string) error {
+	if routes == nil {
+		routes = []string{}
+	}
+	return h.do(ctx, http.MethodPost, "/api/v1/node/"+nodeID+"/approve_routes", map[string]any{"routes": routes}, nil)
+}
+
+// setGlobalNameservers replaces the dns.nameservers.global list of a
+// Headscale configuration with servers, keeping the rest of the file and
+// its comments as they are. It returns the new content and the previous
+// list.
+func setGlobalNameservers(config string, servers []string) (string, []string, error) {
+	lines := strings.Split(config, "\n")
+	indent := func(l string) int { return len(l) - len(strings.TrimLeft(l, " ")) }
+	key := func(l string) string {
+		k, _, _ := strings.Cut(strings.TrimSpace(l), ":")
+		return k
+	}
+	skip := func(l string) bool {
+		t := strings.TrimSpace(l)
+		return t == "" || strings.HasPrefix(t, "#")
+	}
+
+	// Find dns:, then nameservers: and global: nested under it.
+	path := []string{"dns", "nameservers", "global"}
+	at, level := -1, -1
+	for i := 0; i < len(lines) && len(path) > 0; i++ {
+		l := lines[i]
+		if skip(l) {
+			continue
+		}
+		if at >= 0 && indent(l) <= level {
+			break
+		}
+		if key(l) == path[0] && (at < 0 && indent(l) == 0 || at >= 0 && indent(l) > level) {
+			at, level, path = i, indent(l), path[1:]
+		}
+	}
+	if len(path) > 0 {
+		return "", nil, errors.New("no dns.nameservers.global setting found")
+	}
+
+	var prev []string
+	itemIndent := strings.Repeat(" ", level+2)
+	end := at + 1
+	for ; end < len(lines); end++ {
+		l := lines[end]
+		if skip(l) {
+			continue
+		}
+		if indent(l) < level || !strings.HasPrefix(strings.TrimSpace(l), "- ") {
+			break
+		}
+		itemIndent = strings.Repeat(" ", indent(l))
+		prev = append(prev, strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(l), "- ")), `"'`))
+	}
+	// An inline list, as in "global: [1.1.1.1]".
+	if _, v, _ := strings.Cut(lines[at], ":"); strings.HasPrefix(strings.TrimSpace(v), "[") {
+		v, _, _ = strings.Cut(strings.TrimSpace(v), "#")
+		for item := range strings.SplitSeq(strings.Trim(strings.TrimSpace(v), "[]"), ",") {
+			if item = strings.Trim(strings.TrimSpace(item), `"'`); item != "" {
+				prev = append(prev, item)
+			}
+		}
+	}
+
+	var out []string
+	out = append(out, lines[:at]...)
+	out = append(out, strings.Repeat(" ", level)+"global:")
+	for _, srv := range servers {
+		out = append(out, itemIndent+"- "+srv)
+	}
+	for _, l := range lines[at+1 : end] {
+		if skip(l) {
+			out = append(out, l)
+		}
+	}
+	out = append(out, lines[end:]...)
+	return strings.Join(out, "\n"), prev, nil
+}
@@ -0,0 +1,112 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSetGlobalNameserversExample(t *testing.T) {
+	b, err := os.ReadFile("../../control-plane/headscale/config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := string(b)
+	servers := []string{"100.64.0.1", "fd7a:115c:a1e0::1"}
+	got, prev, err := setGlobalNameservers(config, servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"}; !slices.Equal(prev, want) {
+		t.Errorf("previous nameservers %q, want %q", prev, want)
+	}
+	if want := "  nameservers:\n    global:\n      - 100.64.0.1\n      - fd7a:115c:a1e0::1\n\n      # NextDNS"; !strings.Contains(got, want) {
+		t.Errorf("nameservers not replaced in place:\n%s", got)
+	}
+	if n := strings.Count(got, "\n"); n != strings.Count(config, "\n")-2 {
+		t.Errorf("%d lines, want %d", n, strings.Count(config, "\n")-2)
+	}
+
+	// Setting the previous list again restores the file.
+	restored, now, err := setGlobalNameservers(got, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(now, servers) {
+		t.Errorf("read back %q, want %q", now, servers)
+	}
+	if restored != config {
+		t.Error("restoring the previous nameservers changed the file")
+	}
+}
+
+func TestSetGlobalNameservers(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+		prev   []string
+	}{
+		{
+			name:   "inline",
+			config: "dns:\n  magic_dns: true\n  nameservers:\n    global: [1.1.1.1, \"8.8.8.8\"] # upstreams\n    split: {}\nlog:\n  level: info\n",
+			want:   "dns:\n  magic_dns: true\n  nameservers:\n    global:\n      - 100.64.0.1\n    split: {}\nlog:\n  level: info\n",
+			prev:   []string{"1.1.1.1", "8.8.8.8"},
+		},
+		{
+			name:   "inline-empty",
+			config: "dns:\n  nameservers:\n    global: []\n",
+			want:   "dns:\n  nameservers:\n    global:\n      - 100.64.0.1\n",
+		},
+		{
+			name:   "empty",
+			config: "dns:\n  nameservers:\n    global:\n    split:\n      corp.example:\n        - 10.0.0.53\n",
+			want:   "dns:\n  nameservers:\n    global:\n      - 100.64.0.1\n    split:\n      corp.example:\n        - 10.0.0.53\n",
+		},
+		{
+			name:   "quoted-at-key-indent",
+			config: "dns:\n  nameservers:\n    global:\n    - '9.9.9.9'\n    # - 1.1.1.1\n    - \"149.112.112.112\"\nderp: {}\n",
+			want:   "dns:\n  nameservers:\n    global:\n    - 100.64.0.1\n    # - 1.1.1.1\nderp: {}\n",
+			prev:   []string{"9.9.9.9", "149.112.112.112"},
+		},
+		{
+			// global under another key, and nameservers outside dns, are
+			// left alone.
+			name:   "nested-elsewhere",
+			config: "other:\n  nameservers:\n    global: [1.1.1.1]\ndns:\n  extra:\n    global: [2.2.2.2]\n  nameservers:\n    global:\n      - 3.3.3.3\n",
+			want:   "other:\n  nameservers:\n    global: [1.1.1.1]\ndns:\n  extra:\n    global: [2.2.2.2]\n  nameservers:\n    global:\n      - 100.64.0.1\n",
+			prev:   []string{"3.3.3.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, prev, err := setGlobalNameservers(tt.config, []string{"100.64.0.1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if !slices.Equal(prev, tt.prev) {
+				t.Errorf("previous nameservers %q, want %q", prev, tt.prev)
+			}
+		})
+	}
+}
+
+func TestSetGlobalNameserversMissing(t *testing.T) {
+	for _, config := range []string{
+		"",
+		"server_url: https://hs.example\n",
+		"dns:\n  magic_dns: true\nnameservers:\n  global: [1.1.1.1]\n",
+		"other:\n  dns:\n    nameservers:\n      global: [1.1.1.1]\n",
+	} {
+		if _, _, err := setGlobalNameservers(config, []string{"100.64.0.1"}); err == nil {
+			t.Errorf("no error for %q", config)
+		}
+	}
+}
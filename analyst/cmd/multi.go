@@ -0,0 +1,282 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BARGHEST-ngo/androidqf_mesh/adb"
+	rt "github.com/botherder/go-savetime/runtime"
+)
+
+// defaultParallel is how many devices are acquired at once by default.
+// Acquisitions are mostly bound by each device's MESH link, but they share
+// the analyst's uplink and the adb server.
+const defaultParallel = 2
+
+// peerDevice is one Android peer taking part in a multi-device acquisition.
+type peerDevice struct {
+	peer   AndroidPeer
+	serial string
+	key    string
+	c      *Case
+	output string
+	err    error
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// runAllPeers acquires every selected Android MESH peer. Devices that are
+// not connected over ADB yet are paired one after the other, since each
+// needs the analyst at its pairing dialog; then the adb server is restarted
+// once with every device's key and the acquisitions run in parallel.
+//
+// androidqf keeps the ADB client in a package-level variable that every
+// module uses, so each acquisition runs in its own meshcli adbcollect
+// process with its own serial, output folder, log and progress events.
+func runAllPeers(ctx context.Context, opts acquisitionOptions) error {
+	peers, err := getAndroidPeers(ctx)
+	if err != nil {
+		return err
+	}
+	if want := splitList(adbcollectArgs.peers); len(want) > 0 {
+		if peers, err = selectPeers(peers, want); err != nil {
+			return err
+		}
+	}
+	if len(peers) == 0 {
+		return errors.New("unable to find any connected Android clients")
+	}
+
+	adbClient, err := adb.New()
+	if err != nil {
+		return fmt.Errorf("impossible to initialize ADB: %w", err)
+	}
+	adb.Client = adbClient
+	connected, err := adb.Client.Devices()
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %w", err)
+	}
+
+	var devices []*peerDevice
+	var newKeys []string
+	for _, p := range peers {
+		d := &peerDevice{peer: p}
+		devices = append(devices, d)
+		for _, serial := range connected {
+			if host, _, err := net.SplitHostPort(serial); err == nil && host == p.IP {
+				d.serial = serial
+			}
+		}
+		if d.serial == "" && adbcollectArgs.noPair {
+			d.err = errors.New("not connected over ADB")
+			continue
+		}
+
+		// Every device gets its own case, as it belongs to a
+		// different person. None of them becomes the current case.
+		d.c, err = createCase("", false)
+		if err != nil {
+			return err
+		}
+		logCase(d.c, "peer_selected", map[string]any{
+			"ip":       p.IP,
+			"hostname": p.HostName,
+			"dns_name": p.DNSName,
+			"node_id":  p.NodeID,
+			"node_key": p.NodeKey,
+			"batch":    true,
+		})
+		if d.serial != "" {
+			fmt.Printf("%s (%s) is already connected as %s\n", p.HostName, p.IP, d.serial)
+			continue
+		}
+
+		fmt.Printf("\n=== Pairing %s (%s) ===\n", p.HostName, p.IP)
+		var args PairingArgs
+		if err := pairPeer(ctx, d.c, &d.peer, &args, ""); err != nil {
+			fmt.Printf("Pairing %s failed: %v\n", p.HostName, err)
+			d.err = err
+			continue
+		}
+		d.serial = net.JoinHostPort(args.Host, strconv.Itoa(args.DebugPort))
+		d.key = args.KeyPath
+		newKeys = append(newKeys, d.key)
+	}
+
+	if len(newKeys) > 0 {
+		// Restarting the server drops the connections that were already
+		// up, so reconnect to every device; previously connected devices
+		// keep working if their key is the default one or already listed.
+		keys := append(newKeys, filepath.SplitList(os.Getenv("ADB_VENDOR_KEYS"))...)
+		if err := useADBKeys(keys...); err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.err != nil {
+				continue
+			}
+			out, err := adb.Client.Exec("connect", d.serial)
+			logCase(d.c, "adb_connected", stepDetails(err, map[string]any{"serial": d.serial}))
+			if err != nil {
+				d.err = fmt.Errorf("ADB connect failed: %w\nOutput: %s", err, string(out))
+			}
+		}
+	}
+
+	base := opts.Output
+	if base == "" {
+		base = filepath.Join(rt.GetExecutableDirectory(), "acquisitions-"+time.Now().UTC().Format("20060102-150405"))
+	}
+	if err := os.MkdirAll(base, 0o700); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	parallel := adbcollectArgs.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	fmt.Printf("\nAcquiring %d device(s), %d at a time, into %s\n", countReady(devices), parallel, base)
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		if d.err != nil {
+			continue
+		}
+		if err := checkSerialMatchesPeer(ctx, d.serial, &d.peer); err != nil {
+			logCase(d.c, "adb_validated", stepDetails(err, map[string]any{"serial": d.serial}))
+			d.err = err
+			continue
+		}
+		d.output = filepath.Join(base, unsafePathChars.ReplaceAllString(d.peer.HostName+"_"+d.peer.IP, "_"))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			d.err = collectPeer(ctx, d, opts)
+		}()
+	}
+	wg.Wait()
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tSERIAL\tRESULT\tOUTPUT")
+	var failed int
+	for _, d := range devices {
+		result := "ok"
+		if d.err != nil {
+			failed++
+			result = "FAILED: " + d.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.peer.HostName, d.serial, sanitizeForTerminal(result), d.output)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d device(s) failed", failed, len(devices))
+	}
+	return nil
+}
+
+// childInterruptGrace is how long an interrupted child adbcollect gets to
+// record the interruption before it is killed.
+const childInterruptGrace = 10 * time.Second
+
+// collectPeer runs one device's acquisition in a child adbcollect process.
+// Its output goes to <output>.log and its progress events to
+// <output>.events.jsonl, next to the acquisition folder.
+func collectPeer(ctx context.Context, d *peerDevice, opts acquisitionOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"adbcollect",
+		"--serial", d.serial,
+		"--output", d.output,
+		"--modules", strings.Join(opts.Modules, ","),
+		"--timeout", timeoutValue{&opts.Timeout, &opts.AutoTimeout}.String(),
+		"--progress-json", d.output + ".events.jsonl",
+		"--case", d.c.Dir,
+	}
+	if opts.Fast {
+		args = append(args, "--fast")
+	}
+	if opts.NoEstimate {
+		args = append(args, "--no-estimate")
+	}
+	if opts.AllowMismatch {
+		args = append(args, "--allow-identity-mismatch")
+	}
+
+	logFile, err := os.OpenFile(d.output+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	fmt.Printf("[%s] started, log: %s\n", d.peer.HostName, logFile.Name())
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Interrupt rather than kill the child, so that it records the
+	// interruption and stays resumable.
+	cmd.Cancel = func() error {
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = childInterruptGrace
+	err = cmd.Run()
+	if err != nil {
+		fmt.Printf("[%s] failed: %v\n", d.peer.HostName, err)
+		return fmt.Errorf("acquisition failed (see %s): %w", logFile.Name(), err)
+	}
+	fmt.Printf("[%s] completed\n", d.peer.HostName)
+	return nil
+}
+
+// selectPeers returns the peers matching the names in want, in the order
+// they are named. A peer named more than once, for example by hostname and
+// by MESH IP, is selected once.
+func selectPeers(peers []AndroidPeer, want []string) ([]AndroidPeer, error) {
+	var selected []AndroidPeer
+	seen := make(map[string]bool)
+	for _, w := range want {
+		i := slices.IndexFunc(peers, func(p AndroidPeer) bool { return p.matches(w) })
+		if i < 0 {
+			return nil, fmt.Errorf("no Android client matches %q", w)
+		}
+		if p := peers[i]; !seen[p.NodeID] {
+			seen[p.NodeID] = true
+			selected = append(selected, p)
+		}
+	}
+	return selected, nil
+}
+
+func countReady(devices []*peerDevice) int {
+	n := 0
+	for _, d := range devices {
+		if d.err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,49 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSelectPeers(t *testing.T) {
+	peers := []AndroidPeer{
+		{IP: "100.64.0.5", HostName: "pixel-7", DNSName: "pixel-7.mesh.example.", NodeID: "n1", TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.5"), netip.MustParseAddr("fd7a:115c:a1e0::5")}},
+		{IP: "100.64.0.6", HostName: "galaxy", DNSName: "galaxy.mesh.example.", NodeID: "n2"},
+	}
+	tests := []struct {
+		name string
+		want []string
+		ids  []string
+		err  bool
+	}{
+		{name: "order", want: []string{"galaxy", "pixel-7"}, ids: []string{"n2", "n1"}},
+		{name: "same-peer-twice", want: []string{"pixel-7", "100.64.0.5", "fd7a:115c:a1e0::5", "pixel-7.mesh.example"}, ids: []string{"n1"}},
+		{name: "duplicate-among-others", want: []string{"PIXEL-7", "galaxy", "100.64.0.5"}, ids: []string{"n1", "n2"}},
+		{name: "unknown", want: []string{"pixel-7", "oneplus"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPeers(peers, tt.want)
+			if tt.err {
+				if err == nil {
+					t.Errorf("selected %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, p := range got {
+				ids = append(ids, p.NodeID)
+			}
+			if !slices.Equal(ids, tt.ids) {
+				t.Errorf("selected %q, want %q", ids, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// Capture stream of the MESH client (tailscaled's debug capture): a pcap
+// file with link type USER0, where every packet starts with a header
+// giving the path the packet took and, for NATed packets, the original
+// source and destination addresses.
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+)
+
+// Paths of a captured packet.
+const (
+	pathFromLocal          = 0
+	pathFromPeer           = 1
+	pathSynthesizedToLocal = 2
+	pathSynthesizedToPeer  = 3
+	pathDisco              = 254
+)
+
+// capturedPacket is a packet from the capture stream.
+type capturedPacket struct {
+	Time    time.Time
+	Path    uint16
+	Data    []byte // the IP packet
+	OrigLen int
+}
+
+// captureReader reads packets from the MESH client's capture stream.
+type captureReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	nanos bool
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	cr := &captureReader{r: bufio.NewReader(r)}
+	var hdr [24]byte
+	if _, err := io.ReadFull(cr.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading capture header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagicMicros:
+			cr.order = order
+		case pcapMagicNanos:
+			cr.order, cr.nanos = order, true
+		}
+	}
+	if cr.order == nil {
+		return nil, errors.New("capture stream is not in pcap format")
+	}
+	return cr, nil
+}
+
+// next returns the next packet, or io.EOF at the end of the stream.
+func (cr *captureReader) next() (*capturedPacket, error) {
+	var rec [16]byte
+	if _, err := io.ReadFull(cr.r, rec[:]); err != nil {
+		return nil, err
+	}
+	sec, frac := cr.order.Uint32(rec[0:4]), cr.order.Uint32(rec[4:8])
+	inclLen, origLen := cr.order.Uint32(rec[8:12]), cr.order.Uint32(rec[12:16])
+	if inclLen > 1<<20 {
+		return nil, fmt.Errorf("capture record of %d bytes is too large", inclLen)
+	}
+	buf := make([]byte, inclLen)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return nil, err
+	}
+	if !cr.nanos {
+		frac *= 1000
+	}
+
+	// The MESH header: path, then the length and value of the original
+	// source and destination addresses, all little endian.
+	if len(buf) < 6 {
+		return nil, errors.New("capture record too short")
+	}
+	p := &capturedPacket{Time: time.Unix(int64(sec), int64(frac)).UTC(), Path: binary.LittleEndian.Uint16(buf[0:2])}
+	off := 2
+	for range 2 {
+		if len(buf) < off+2 {
+			return nil, errors.New("capture record too short")
+		}
+		off += 2 + int(binary.LittleEndian.Uint16(buf[off:off+2]))
+	}
+	if off > len(buf) {
+		return nil, errors.New("capture record too short")
+	}
+	p.Data = buf[off:]
+	p.OrigLen = int(origLen) - off
+	return p, nil
+}
+
+// pcapng block types and options used by pcapngWriter.
+const (
+	pcapngSHB = 0x0a0d0d0a
+	pcapngIDB = 0x00000001
+	pcapngISB = 0x00000005
+	pcapngEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	linkTypeRaw          = 101
+	captureSnapLen       = 65535
+
+	optComment    = 1
+	shbOS         = 3
+	shbUserAppl   = 4
+	ifName        = 2
+	ifTsResol     = 9
+	epbFlags      = 2
+	isbStartTime  = 2
+	isbEndTime    = 3
+	isbIfRecv     = 4
+	epbInbound    = 1
+	epbOutbound   = 2
+	tsResolMicros = 6
+)
+
+// pcapngWriter writes raw IP packets to a pcapng file with one interface.
+type pcapngWriter struct {
+	w       io.Writer
+	packets uint64
+	bytes   int64
+	first   time.Time
+	last    time.Time
+}
+
+// newPcapngWriter writes the section header, carrying comments, and the
+// interface description.
+func newPcapngWriter(w io.Writer, comments []string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+	var opts []byte
+	for _, c := range comments {
+		opts = appendOption(opts, optComment, []byte(c))
+	}
+	opts = appendOption(opts, shbOS, []byte(runtime.GOOS))
+	opts = appendOption(opts, shbUserAppl, []byte("meshcli capture"))
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	binary.LittleEndian.PutUint64(body[8:16], ^uint64(0)) // section length unknown
+	if err := pw.block(pcapngSHB, append(body, endOptions(opts)...)); err != nil {
+		return nil, err
+	}
+
+	body = make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], linkTypeRaw)
+	binary.LittleEndian.PutUint32(body[4:8], captureSnapLen)
+	opts = appendOption(nil, ifName, []byte("mesh"))
+	opts = appendOption(opts, ifTsResol, []byte{tsResolMicros})
+	if err := pw.block(pcapngIDB, append(body, endOptions(opts)...)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// writePacket writes an enhanced packet block. inbound tells whether the
+// packet came from the peer.
+func (pw *pcapngWriter) writePacket(p *capturedPacket, inbound bool) error {
+	data := p.Data
+	if len(data) > captureSnapLen {
+		data = data[:captureSnapLen]
+	}
+	ts := uint64(p.Time.UnixMicro())
+	body := make([]byte, 20, 20+len(data)+16)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(max(p.OrigLen, len(data))))
+	body = append(body, pad4(data)...)
+	flags := uint32(epbOutbound)
+	if inbound {
+		flags = epbInbound
+	}
+	var f [4]byte
+	binary.LittleEndian.PutUint32(f[:], flags)
+	body = append(body, endOptions(appendOption(nil, epbFlags, f[:]))...)
+	if err := pw.block(pcapngEPB, body); err != nil {
+		return err
+	}
+	if pw.packets == 0 {
+		pw.first = p.Time
+	}
+	pw.last = p.Time
+	pw.packets++
+	return nil
+}
+
+// close writes interface statistics with the capture's start and end and
+// a closing comment. It does not close the underlying writer.
+func (pw *pcapngWriter) close(start, end time.Time, comment string) error {
+	body := make([]byte, 12)
+	ts := uint64(end.UnixMicro())
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ts))
+	opts := appendOption(nil, optComment, []byte(comment))
+	for _, o := range []struct {
+		code uint16
+		v    uint64
+	}{
+		{isbStartTime, uint64(start.UnixMicro())},
+		{isbEndTime, uint64(end.UnixMicro())},
+		{isbIfRecv, pw.packets},
+	} {
+		var v [8]byte
+		if o.code == isbIfRecv {
+			binary.LittleEndian.PutUint64(v[:], o.v)
+		} else {
+			binary.LittleEndian.PutUint32(v[0:4], uint32(o.v>>32))
+			binary.LittleEndian.PutUint32(v[4:8], uint32(o.v))
+		}
+		opts = appendOption(opts, o.code, v[:])
+	}
+	return pw.block(pcapngISB, append(body, endOptions(opts)...))
+}
+
+func (pw *pcapngWriter) block(typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	n, err := pw.w.Write(b)
+	pw.bytes += int64(n)
+	return err
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, pad4(value)...)
+}
+
+func endOptions(b []byte) []byte {
+	return append(b, 0, 0, 0, 0)
+}
+
+func pad4(b []byte) []byte {
+	if n := len(b) % 4; n != 0 {
+		return append(b[:len(b):len(b)], make([]byte, 4-n)...)
+	}
+	return b
+}
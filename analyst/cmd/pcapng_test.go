@@ -0,0 +1,304 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCaptureStream builds a capture stream as the MESH client writes it:
+// a pcap header with link type USER0, then one record per packet whose
+// data starts with the path and the SNAT and DNAT addresses.
+func testCaptureStream(order binary.AppendByteOrder, nanos bool, records ...[]byte) []byte {
+	var b []byte
+	magic := uint32(pcapMagicMicros)
+	if nanos {
+		magic = pcapMagicNanos
+	}
+	b = order.AppendUint32(b, magic)
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint16(b, 4)
+	b = order.AppendUint32(b, 0)
+	b = order.AppendUint32(b, 0)
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, 147) // LINKTYPE_USER0
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	return b
+}
+
+// testCaptureRecord builds one record of a capture stream. The MESH header
+// is always little endian, whatever the byte order of the pcap framing.
+func testCaptureRecord(order binary.AppendByteOrder, sec, frac uint32, path uint16, snat, dnat, packet []byte) []byte {
+	data := binary.LittleEndian.AppendUint16(nil, path)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(snat)))
+	data = append(data, snat...)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(dnat)))
+	data = append(data, dnat...)
+	data = append(data, packet...)
+
+	var b []byte
+	b = order.AppendUint32(b, sec)
+	b = order.AppendUint32(b, frac)
+	b = order.AppendUint32(b, uint32(len(data)))
+	b = order.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func TestCaptureReader(t *testing.T) {
+	packet := testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40000, 443, []byte("hello"))
+	snat := []byte{100, 64, 0, 5}
+	dnat := bytes.Repeat([]byte{0xfd}, 16)
+	tests := []struct {
+		name       string
+		order      binary.AppendByteOrder
+		nanos      bool
+		path       uint16
+		snat, dnat []byte
+		frac       uint32
+		want       time.Time
+	}{
+		{name: "plain", order: binary.LittleEndian, path: pathFromPeer, frac: 250000, want: time.Unix(1700000000, 250000000)},
+		{name: "snat", order: binary.LittleEndian, path: pathFromLocal, snat: snat, frac: 1, want: time.Unix(1700000000, 1000)},
+		{name: "snat-dnat", order: binary.LittleEndian, path: pathSynthesizedToPeer, snat: snat, dnat: dnat, want: time.Unix(1700000000, 0)},
+		{name: "dnat-only", order: binary.LittleEndian, path: pathSynthesizedToLocal, dnat: dnat, want: time.Unix(1700000000, 0)},
+		{name: "big-endian-nanos", order: binary.BigEndian, nanos: true, path: pathFromPeer, snat: snat, frac: 123456789, want: time.Unix(1700000000, 123456789)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := testCaptureStream(tt.order, tt.nanos,
+				testCaptureRecord(tt.order, 1700000000, tt.frac, tt.path, tt.snat, tt.dnat, packet),
+				testCaptureRecord(tt.order, 1700000001, 0, pathDisco, nil, nil, []byte{1, 2, 3}))
+			cr, err := newCaptureReader(bytes.NewReader(stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := cr.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Path != tt.path {
+				t.Errorf("path %d, want %d", p.Path, tt.path)
+			}
+			if !p.Time.Equal(tt.want) {
+				t.Errorf("time %v, want %v", p.Time, tt.want)
+			}
+			if !bytes.Equal(p.Data, packet) {
+				t.Errorf("data %x, want %x", p.Data, packet)
+			}
+			if p.OrigLen != len(packet) {
+				t.Errorf("original length %d, want %d", p.OrigLen, len(packet))
+			}
+
+			p, err = cr.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Path != pathDisco || !bytes.Equal(p.Data, []byte{1, 2, 3}) {
+				t.Errorf("second packet: path %d, data %x", p.Path, p.Data)
+			}
+			if _, err := cr.next(); !errors.Is(err, io.EOF) {
+				t.Errorf("after the last packet: %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestCaptureReaderErrors(t *testing.T) {
+	le := binary.LittleEndian
+	record := func(data []byte) []byte {
+		b := le.AppendUint32(nil, 0)
+		b = le.AppendUint32(b, 0)
+		b = le.AppendUint32(b, uint32(len(data)))
+		b = le.AppendUint32(b, uint32(len(data)))
+		return append(b, data...)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{name: "short-record", stream: testCaptureStream(le, false, record([]byte{1, 0, 0, 0})), err: "too short"},
+		{name: "snat-overrun", stream: testCaptureStream(le, false, record([]byte{1, 0, 8, 0, 1, 2, 3, 4, 0, 0})), err: "too short"},
+		{name: "dnat-overrun", stream: testCaptureStream(le, false, record([]byte{1, 0, 0, 0, 4, 0, 1, 2})), err: "too short"},
+		{name: "truncated", stream: testCaptureStream(le, false, record([]byte{1, 0, 0, 0, 0, 0, 0x45})[:20]), err: "unexpected EOF"},
+		{name: "too-large", stream: testCaptureStream(le, false, le.AppendUint32(le.AppendUint32(make([]byte, 8), 2<<20), 2<<20)), err: "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr, err := newCaptureReader(bytes.NewReader(tt.stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cr.next()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want error containing %q", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := newCaptureReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Error("stream without pcap magic accepted")
+	}
+}
+
+// pcapngBlock is a block read back by readPcapng.
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readPcapng splits a little-endian pcapng file into blocks, checking the
+// framing: lengths repeated after each block and 32-bit alignment.
+func readPcapng(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("%d trailing bytes", len(b))
+		}
+		typ, total := binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint32(b[4:8])
+		if total%4 != 0 || total < 12 || int(total) > len(b) {
+			t.Fatalf("block %#x: bad length %d", typ, total)
+		}
+		if trailer := binary.LittleEndian.Uint32(b[total-4 : total]); trailer != total {
+			t.Fatalf("block %#x: trailing length %d, want %d", typ, trailer, total)
+		}
+		blocks = append(blocks, pcapngBlock{typ: typ, body: b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+// pcapngOptions parses an option list that must end with opt_endofopt.
+func pcapngOptions(t *testing.T, b []byte) map[uint16][][]byte {
+	t.Helper()
+	opts := make(map[uint16][][]byte)
+	for {
+		if len(b) < 4 {
+			t.Fatalf("options end without opt_endofopt")
+		}
+		code, n := binary.LittleEndian.Uint16(b[0:2]), int(binary.LittleEndian.Uint16(b[2:4]))
+		if code == 0 {
+			if n != 0 || len(b) != 4 {
+				t.Fatalf("%d bytes after opt_endofopt", len(b)-4)
+			}
+			return opts
+		}
+		padded := (n + 3) &^ 3
+		if len(b) < 4+padded {
+			t.Fatalf("option %d overruns its block", code)
+		}
+		opts[code] = append(opts[code], b[4:4+n])
+		b = b[4+padded:]
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	packets := []struct {
+		p       capturedPacket
+		inbound bool
+	}{
+		{capturedPacket{Time: start.Add(1500 * time.Microsecond), Data: testPacket(protoTCP, "100.64.0.5", "203.0.113.9", 40000, 443, []byte("abc"))}, false},
+		{capturedPacket{Time: start.Add(2 * time.Second), Data: testPacket(protoUDP, "198.51.100.53", "100.64.0.5", 53, 41000, []byte("reply")), OrigLen: 1400}, true},
+	}
+	end := start.Add(3 * time.Second)
+
+	var buf bytes.Buffer
+	pw, err := newPcapngWriter(&buf, []string{"peer pixel", "node n123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		if err := pw.writePacket(&p.p, p.inbound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.close(start, end, "stopped"); err != nil {
+		t.Fatal(err)
+	}
+	if pw.bytes != int64(buf.Len()) || pw.packets != 2 {
+		t.Errorf("writer counted %d bytes and %d packets, wrote %d bytes", pw.bytes, pw.packets, buf.Len())
+	}
+
+	blocks := readPcapng(t, buf.Bytes())
+	var types []uint32
+	for _, b := range blocks {
+		types = append(types, b.typ)
+	}
+	if want := []uint32{0x0a0d0d0a, 1, 6, 6, 5}; !slices.Equal(types, want) {
+		t.Fatalf("block types %#x, want %#x", types, want)
+	}
+
+	shb := blocks[0].body
+	if magic := binary.LittleEndian.Uint32(shb[0:4]); magic != 0x1a2b3c4d {
+		t.Errorf("byte-order magic %#x", magic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(shb[4:6]), binary.LittleEndian.Uint16(shb[6:8]); major != 1 || minor != 0 {
+		t.Errorf("version %d.%d, want 1.0", major, minor)
+	}
+	opts := pcapngOptions(t, shb[16:])
+	if got := opts[1]; len(got) != 2 || string(got[0]) != "peer pixel" || string(got[1]) != "node n123" {
+		t.Errorf("section comments %q", got)
+	}
+
+	idb := blocks[1].body
+	if lt := binary.LittleEndian.Uint16(idb[0:2]); lt != 101 {
+		t.Errorf("link type %d, want 101 (raw IP)", lt)
+	}
+	opts = pcapngOptions(t, idb[8:])
+	if got := opts[9]; len(got) != 1 || !bytes.Equal(got[0], []byte{6}) {
+		t.Errorf("if_tsresol %x, want microseconds", got)
+	}
+
+	for i, p := range packets {
+		epb := blocks[2+i].body
+		if iface := binary.LittleEndian.Uint32(epb[0:4]); iface != 0 {
+			t.Errorf("packet %d: interface %d", i, iface)
+		}
+		ts := uint64(binary.LittleEndian.Uint32(epb[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:12]))
+		if got := time.UnixMicro(int64(ts)).UTC(); !got.Equal(p.p.Time) {
+			t.Errorf("packet %d: time %v, want %v", i, got, p.p.Time)
+		}
+		capLen, origLen := int(binary.LittleEndian.Uint32(epb[12:16])), int(binary.LittleEndian.Uint32(epb[16:20]))
+		if capLen != len(p.p.Data) || origLen != max(p.p.OrigLen, len(p.p.Data)) {
+			t.Errorf("packet %d: lengths %d/%d", i, capLen, origLen)
+		}
+		if !bytes.Equal(epb[20:20+capLen], p.p.Data) {
+			t.Errorf("packet %d: data differs", i)
+		}
+		opts = pcapngOptions(t, epb[20+(capLen+3)&^3:])
+		flags := binary.LittleEndian.Uint32(opts[2][0]) & 3
+		if want := map[bool]uint32{true: 1, false: 2}[p.inbound]; flags != want {
+			t.Errorf("packet %d: direction flags %d, want %d", i, flags, want)
+		}
+	}
+
+	isb := blocks[4].body
+	opts = pcapngOptions(t, isb[12:])
+	ts := func(b []byte) time.Time {
+		return time.UnixMicro(int64(uint64(binary.LittleEndian.Uint32(b[0:4]))<<32 | uint64(binary.LittleEndian.Uint32(b[4:8])))).UTC()
+	}
+	if got := ts(opts[2][0]); !got.Equal(start) {
+		t.Errorf("isb_starttime %v, want %v", got, start)
+	}
+	if got := ts(opts[3][0]); !got.Equal(end) {
+		t.Errorf("isb_endtime %v, want %v", got, end)
+	}
+	if got := binary.LittleEndian.Uint64(opts[4][0]); got != 2 {
+		t.Errorf("isb_ifrecv %d, want 2", got)
+	}
+	if got := opts[1]; len(got) != 1 || string(got[0]) != "stopped" {
+		t.Errorf("statistics comment %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	rt "github.com/botherder/go-savetime/runtime"
+)
+
+// profilesFile is the default location of user-defined module profiles,
+// next to the meshcli binary.
+const profilesFile = "adbcollect-profiles.json"
+
+// moduleProfile is a named module selection. Include and Exclude entries
+// are module names or glob patterns, matched case-insensitively.
+type moduleProfile struct {
+	Description string   `json:"description"`
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	Fast        bool     `json:"fast"`
+}
+
+// builtinProfiles are always available; a profiles file can override them.
+var builtinProfiles = map[string]moduleProfile{
+	"full": {
+		Description: "all modules",
+		Include:     []string{"*"},
+	},
+	"no-backup": {
+		Description: "all modules except the (large) backup",
+		Include:     []string{"*"},
+		Exclude:     []string{"*backup*"},
+	},
+	"triage": {
+		Description: "quick pass for bad links: no backup or bugreport, fast mode",
+		Include:     []string{"*"},
+		Exclude:     []string{"*backup*", "*bugreport*"},
+		Fast:        true,
+	},
+}
+
+// loadProfiles returns the built-in profiles merged with those defined in
+// path. If path is empty, the default profiles file is used if present.
+func loadProfiles(path string) (map[string]moduleProfile, error) {
+	profiles := make(map[string]moduleProfile, len(builtinProfiles))
+	for name, p := range builtinProfiles {
+		profiles[name] = p
+	}
+
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(rt.GetExecutableDirectory(), profilesFile)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return profiles, nil
+		}
+		return nil, fmt.Errorf("unable to read profiles: %w", err)
+	}
+
+	var custom map[string]moduleProfile
+	if err := json.Unmarshal(b, &custom); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+	for name, p := range custom {
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// selectModules returns the modules from available, in their original order,
+// that match an include entry and no exclude entry. An include entry that
+// matches no module is an error, so that typos are caught before the
+// acquisition starts; an exclude entry that matches nothing only warns.
+func selectModules(available, include, exclude []string) ([]string, error) {
+	if len(include) == 0 {
+		include = []string{"*"}
+	}
+
+	for _, pattern := range include {
+		if err := checkPattern(pattern); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(available, func(m string) bool { return matchModule(pattern, m) }) {
+			return nil, fmt.Errorf("unknown module %q (available: %s)", pattern, strings.Join(available, ", "))
+		}
+	}
+	for _, pattern := range exclude {
+		if err := checkPattern(pattern); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(available, func(m string) bool { return matchModule(pattern, m) }) {
+			fmt.Fprintf(os.Stderr, "warning: exclude %q matches no module\n", pattern)
+		}
+	}
+
+	var out []string
+	for _, m := range available {
+		included := slices.ContainsFunc(include, func(p string) bool { return matchModule(p, m) })
+		excluded := slices.ContainsFunc(exclude, func(p string) bool { return matchModule(p, m) })
+		if included && !excluded {
+			out = append(out, m)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("module selection is empty")
+	}
+	return out, nil
+}
+
+func matchModule(pattern, name string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+	return ok
+}
+
+func checkPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid module pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for v := range strings.SplitSeq(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func sortedProfileNames(profiles map[string]moduleProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
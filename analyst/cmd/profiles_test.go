@@ -0,0 +1,183 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	rt "github.com/botherder/go-savetime/runtime"
+)
+
+// testModules are androidqf's module names, in its order.
+var testModules = []string{"backup", "bugreport", "dumpsys", "getprop", "logcat", "packages", "processes", "settings"}
+
+func TestSelectModules(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude []string
+		want             []string
+		err              bool
+	}{
+		{name: "default-all", want: testModules},
+		{name: "names-in-module-order", include: []string{"settings", "getprop"}, want: []string{"getprop", "settings"}},
+		{name: "case-insensitive", include: []string{"GetProp", "PACK*"}, want: []string{"getprop", "packages"}},
+		{name: "glob", include: []string{"p*"}, want: []string{"packages", "processes"}},
+		{name: "exclude-glob", exclude: []string{"*backup*", "bug*"}, want: []string{"dumpsys", "getprop", "logcat", "packages", "processes", "settings"}},
+		// An exclude entry wins over an include entry naming the same
+		// module.
+		{name: "exclude-wins", include: []string{"backup", "getprop"}, exclude: []string{"backup"}, want: []string{"getprop"}},
+		{name: "exclude-wins-over-glob", include: []string{"*"}, exclude: []string{"p*"}, want: []string{"backup", "bugreport", "dumpsys", "getprop", "logcat", "settings"}},
+		{name: "exclude-unmatched", include: []string{"getprop"}, exclude: []string{"nothing"}, want: []string{"getprop"}},
+		{name: "everything-excluded", include: []string{"backup"}, exclude: []string{"*"}, err: true},
+		{name: "unknown-include", include: []string{"getprop", "getprops"}, err: true},
+		{name: "invalid-include", include: []string{"[get"}, err: true},
+		{name: "invalid-exclude", exclude: []string{"get["}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectModules(testModules, tt.include, tt.exclude)
+			if tt.err {
+				if err == nil {
+					t.Errorf("selected %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinProfiles(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    []string
+	}{
+		{profile: "full", want: testModules},
+		{profile: "no-backup", want: []string{"bugreport", "dumpsys", "getprop", "logcat", "packages", "processes", "settings"}},
+		{profile: "triage", want: []string{"dumpsys", "getprop", "logcat", "packages", "processes", "settings"}},
+	}
+	for _, tt := range tests {
+		p := builtinProfiles[tt.profile]
+		got, err := selectModules(testModules, p.Include, p.Exclude)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("profile %s selects %q, %v; want %q", tt.profile, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchModule(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"getprop", "getprop", true},
+		{"GETPROP", "getprop", true},
+		{"getprop", "GetProp", true},
+		{"get*", "getprop", true},
+		{"*backup*", "backup", true},
+		{"*backup*", "backups-tar", true},
+		{"get?rop", "getprop", true},
+		{"get", "getprop", false},
+		{"prop", "getprop", false},
+		{"[gs]*", "settings", true},
+		{"[", "getprop", false},
+	}
+	for _, tt := range tests {
+		if got := matchModule(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchModule(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	for _, pattern := range []string{"getprop", "*", "*backup*", "get?rop", "[a-z]*"} {
+		if err := checkPattern(pattern); err != nil {
+			t.Errorf("checkPattern(%q): %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"[", "get[", "[a-", `get\`} {
+		if err := checkPattern(pattern); err == nil {
+			t.Errorf("checkPattern(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, profilesFile)
+	writeTestFile(t, path, `{
+  "quick": {
+    "description": "settings and packages only",
+    "include": ["settings", "packages"],
+    "exclude": [],
+    "fast": true
+  },
+  "triage": {
+    "description": "triage without logcat",
+    "include": ["*"],
+    "exclude": ["*backup*", "*bugreport*", "logcat"]
+  }
+}`)
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quick, ok := profiles["quick"]
+	if !ok {
+		t.Fatal("custom profile not loaded")
+	}
+	if quick.Description != "settings and packages only" || !quick.Fast ||
+		!slices.Equal(quick.Include, []string{"settings", "packages"}) || len(quick.Exclude) != 0 {
+		t.Errorf("quick parsed as %+v", quick)
+	}
+	// A custom profile replaces the built-in one of the same name as a
+	// whole: fast is not inherited.
+	if triage := profiles["triage"]; triage.Fast || !slices.Equal(triage.Exclude, []string{"*backup*", "*bugreport*", "logcat"}) {
+		t.Errorf("triage parsed as %+v", triage)
+	}
+	if _, ok := profiles["full"]; !ok {
+		t.Error("built-in profiles dropped")
+	}
+	if builtinProfiles["triage"].Description == "triage without logcat" {
+		t.Error("loading profiles modified the built-in ones")
+	}
+
+	got, err := selectModules(testModules, quick.Include, quick.Exclude)
+	if err != nil || !slices.Equal(got, []string{"packages", "settings"}) {
+		t.Errorf("quick selects %q, %v", got, err)
+	}
+}
+
+func TestLoadProfilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	writeTestFile(t, invalid, `{"quick": {"include": "settings"}}`)
+	if _, err := loadProfiles(invalid); err == nil {
+		t.Error("loaded a profile with an invalid include list")
+	}
+	if _, err := loadProfiles(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("no error for a missing profiles file given explicitly")
+	}
+
+	// Without a file next to the binary, the built-in profiles are used.
+	if _, err := os.Stat(filepath.Join(rt.GetExecutableDirectory(), profilesFile)); err == nil {
+		t.Skip("a default profiles file exists")
+	}
+	profiles, err := loadProfiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != len(builtinProfiles) {
+		t.Errorf("%d profiles, want the %d built-in ones", len(profiles), len(builtinProfiles))
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// progressFile is the name of the progress manifest kept in the acquisition
+// folder so that an interrupted acquisition can be resumed.
+const progressFile = "mesh_progress.json"
+
+const (
+	modulePending     = "pending"
+	moduleRunning     = "running"
+	moduleCompleted   = "completed"
+	moduleFailed      = "failed"
+	moduleInterrupted = "interrupted"
+)
+
+// acquisitionProgress records which modules of an acquisition have run.
+// It is rewritten after every state change, so a module still marked as
+// running after a crash or a dropped MESH link was interrupted.
+type acquisitionProgress struct {
+	path string
+
+	Serial    string            `json:"serial"`
+	Started   time.Time         `json:"started"`
+	Updated   time.Time         `json:"updated"`
+	Completed bool              `json:"completed"`
+	Fast      bool              `json:"fast"`
+	Modules   []*moduleProgress `json:"modules"`
+}
+
+type moduleProgress struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newProgress(dir, serial string, modules []string) *acquisitionProgress {
+	p := &acquisitionProgress{
+		path:    filepath.Join(dir, progressFile),
+		Serial:  serial,
+		Started: time.Now().UTC(),
+	}
+	for _, name := range modules {
+		p.Modules = append(p.Modules, &moduleProgress{Name: name, Status: modulePending})
+	}
+	return p
+}
+
+func loadProgress(dir string) (*acquisitionProgress, error) {
+	path := filepath.Join(dir, progressFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &acquisitionProgress{path: path}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("invalid progress manifest %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// save writes the manifest atomically, so that an interruption while
+// saving never leaves a truncated manifest behind.
+func (p *acquisitionProgress) save() error {
+	p.Updated = time.Now().UTC()
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+func (p *acquisitionProgress) module(name string) *moduleProgress {
+	for _, m := range p.Modules {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (p *acquisitionProgress) start(m *moduleProgress) error {
+	m.Status = moduleRunning
+	m.Attempts++
+	m.Started = time.Now().UTC()
+	m.Finished = time.Time{}
+	m.Error = ""
+	return p.save()
+}
+
+func (p *acquisitionProgress) finish(m *moduleProgress, err error) error {
+	m.Finished = time.Now().UTC()
+	switch {
+	case errors.Is(err, context.Canceled):
+		m.Status = moduleInterrupted
+		m.Error = err.Error()
+	case err != nil:
+		m.Status = moduleFailed
+		m.Error = err.Error()
+	default:
+		m.Status = moduleCompleted
+	}
+	return p.save()
+}
+
+// remaining returns the modules that have not completed yet.
+func (p *acquisitionProgress) remaining() []string {
+	var out []string
+	for _, m := range p.Modules {
+		if m.Status != moduleCompleted {
+			out = append(out, m.Name)
+		}
+	}
+	return out
+}
@@ -9,15 +9,20 @@
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/toqueteos/webbrowser"
 	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/netmon"
 )
 
@@ -29,6 +34,11 @@
 	peers   bool
 	listen  string
 	browser bool
+	watch   bool
+	columns string
+	os      string
+	online  bool
+	tag     string
 }
 
 var localClient local.Client
@@ -48,10 +58,15 @@ func StatusCmd() *ffcli.Command {
 	fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
 	fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode")
 	fs.BoolVar(&statusArgs.browser, "browser", true, "open a browser in web mode")
+	fs.StringVar(&statusArgs.columns, "columns", "", "comma-separated extra columns: "+strings.Join(statusColumnNames(), ", ")+", or all")
+	fs.StringVar(&statusArgs.os, "os", "", "filter output to peers running this OS (e.g. android)")
+	fs.BoolVar(&statusArgs.online, "online", false, "filter output to peers that are online")
+	fs.StringVar(&statusArgs.tag, "tag", "", "filter output to peers with one of these comma-separated tags (e.g. tag:device)")
+	fs.BoolVar(&statusArgs.watch, "watch", false, "keep running and report peers joining, leaving, going on- or offline and changing path")
 
 	return &ffcli.Command{
 		Name:       "status",
-		ShortUsage: "meshcli status [--active] [--web] [--json]",
+		ShortUsage: "meshcli status [--active] [--online] [--os os] [--tag tags] [--columns cols] [--web] [--json] [--watch]",
 		ShortHelp:  "Show state of MESH network and its connections",
 		LongHelp: strings.TrimSpace(`
 Shows the current status of the MESH daemon and its connections.
@@ -59,7 +74,19 @@ func StatusCmd() *ffcli.Command {
 By default, shows a human-readable summary of the current state.
 Use --json for machine-readable output.
 Use --web to start a local web server showing the status.
-Use --active to show only peers with active sessions.
+Use --active to show only peers with active sessions, --online to show
+only peers that are online, --os to show only peers running that OS and
+--tag to show only peers with one of the given tags. Filters also apply
+to --json output.
+Use --columns to add columns to the table: handshake (last WireGuard
+handshake), rx and tx (bytes), path (direct, peer-relay or derp),
+endpoint (the direct address), online, expiry (node key expiry) and tags,
+or all of them.
+Use --watch to follow the MESH client and report, with timestamps, every
+peer that joins or leaves, goes online or offline, or switches between a
+direct and a relayed path. On a terminal the table is redrawn with the
+latest events below it; with --json, or when the output is not a terminal,
+one event is written per line.
 `),
 		FlagSet: fs,
 		Exec:    runStatus,
@@ -71,6 +98,17 @@ func runStatus(ctx context.Context, args []string) error {
 		return errors.New("unexpected non-flag arguments to 'meshcli status'")
 	}
 
+	if statusArgs.watch {
+		if statusArgs.web {
+			return errors.New("--watch cannot be combined with --web")
+		}
+		columns, err := selectStatusColumns(statusArgs.columns)
+		if err != nil {
+			return err
+		}
+		return watchStatus(ctx, columns)
+	}
+
 	getStatus := localClient.Status
 	if !statusArgs.peers {
 		getStatus = localClient.StatusWithoutPeers
@@ -80,12 +118,15 @@ func runStatus(ctx context.Context, args []string) error {
 		return fmt.Errorf("failed to get status: %w", err)
 	}
 
+	columns, err := selectStatusColumns(statusArgs.columns)
+	if err != nil {
+		return err
+	}
+
 	if statusArgs.json {
-		if statusArgs.active {
-			for peer, ps := range st.Peer {
-				if !ps.Active {
-					delete(st.Peer, peer)
-				}
+		for peer, ps := range st.Peer {
+			if !peerMatchesFilters(ps) {
+				delete(st.Peer, peer)
 			}
 		}
 		j, err := json.MarshalIndent(st, "", "  ")
@@ -129,30 +170,44 @@ func runStatus(ctx context.Context, args []string) error {
 		return err
 	}
 
+	writeStatusTable(os.Stdout, st, columns)
+	return nil
+}
+
+// writeStatusTable writes the health warnings and the peer table.
+func writeStatusTable(out io.Writer, st *ipnstate.Status, columns []statusColumn) {
 	if len(st.Health) > 0 {
-		fmt.Fprintf(os.Stdout, "# Health check:\n")
+		fmt.Fprintf(out, "# Health check:\n")
 		for _, m := range st.Health {
-			fmt.Fprintf(os.Stdout, "#     - %s\n", m)
+			fmt.Fprintf(out, "#     - %s\n", m)
 		}
-		fmt.Fprintf(os.Stdout, "\n")
+		fmt.Fprintf(out, "\n")
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "IP\tDNS Name\tOS\tRelay\tHostname\n")
+	w := tabwriter.NewWriter(out, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "IP\tDNS Name\tOS\tRelay\tHostname")
+	for _, c := range columns {
+		fmt.Fprintf(w, "\t%s", c.title)
+	}
+	fmt.Fprintf(w, "\n")
 
 	if statusArgs.self && st.Self != nil {
 		ip := ""
 		if len(st.Self.TailscaleIPs) > 0 {
 			ip = st.Self.TailscaleIPs[0].String()
 		}
-		fmt.Fprintf(w, "*%s\t%s\t%s\t%s\t%s\n",
+		fmt.Fprintf(w, "*%s\t%s\t%s\t%s\t%s",
 			ip, st.Self.DNSName, "-", "-", sanitizeForTerminal(st.Self.HostName))
+		for range columns {
+			fmt.Fprintf(w, "\t-")
+		}
+		fmt.Fprintf(w, "\n")
 	}
 
 	if statusArgs.peers {
 		for _, peerKey := range st.Peers() {
 			peer := st.Peer[peerKey]
-			if statusArgs.active && !peer.Active {
+			if !peerMatchesFilters(peer) {
 				continue
 			}
 
@@ -166,11 +221,122 @@ func runStatus(ctx context.Context, args []string) error {
 				relay = peer.Relay
 			}
 
-			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s",
 				ip, peer.DNSName, sanitizeForTerminal(peer.OS), relay, sanitizeForTerminal(peer.HostName))
+			for _, c := range columns {
+				fmt.Fprintf(w, "\t%s", c.value(peer))
+			}
+			fmt.Fprintf(w, "\n")
 		}
 		w.Flush()
 	}
+}
 
-	return nil
+// peerMatchesFilters reports whether a peer passes the --active, --online,
+// --os and --tag filters.
+func peerMatchesFilters(ps *ipnstate.PeerStatus) bool {
+	if statusArgs.active && !ps.Active {
+		return false
+	}
+	if statusArgs.online && !ps.Online {
+		return false
+	}
+	return peerMatchesSelection(ps)
+}
+
+// peerMatchesSelection reports whether a peer passes the --os and --tag
+// filters, which unlike --active and --online do not change over time.
+func peerMatchesSelection(ps *ipnstate.PeerStatus) bool {
+	if statusArgs.os != "" && !strings.EqualFold(ps.OS, statusArgs.os) {
+		return false
+	}
+	if want := splitList(statusArgs.tag); len(want) > 0 {
+		if ps.Tags == nil {
+			return false
+		}
+		return slices.ContainsFunc(ps.Tags.AsSlice(), func(t string) bool {
+			return slices.Contains(want, t) || slices.Contains(want, "tag:"+t) || slices.Contains(want, strings.TrimPrefix(t, "tag:"))
+		})
+	}
+	return true
+}
+
+// statusColumn is an optional column of the status table.
+type statusColumn struct {
+	name  string
+	title string
+	value func(ps *ipnstate.PeerStatus) string
+}
+
+var statusColumns = []statusColumn{
+	{"handshake", "Last Handshake", func(ps *ipnstate.PeerStatus) string { return formatStatusTime(ps.LastHandshake) }},
+	{"rx", "Rx Bytes", func(ps *ipnstate.PeerStatus) string { return strconv.FormatInt(ps.RxBytes, 10) }},
+	{"tx", "Tx Bytes", func(ps *ipnstate.PeerStatus) string { return strconv.FormatInt(ps.TxBytes, 10) }},
+	{"path", "Path", func(ps *ipnstate.PeerStatus) string {
+		kind, _, _ := strings.Cut(peerPath(ps), " ")
+		return orDash(kind)
+	}},
+	{"endpoint", "Endpoint", func(ps *ipnstate.PeerStatus) string { return orDash(ps.CurAddr) }},
+	{"online", "Online", func(ps *ipnstate.PeerStatus) string {
+		if ps.Online {
+			return "yes"
+		}
+		return "no"
+	}},
+	{"expiry", "Key Expiry", func(ps *ipnstate.PeerStatus) string {
+		if ps.KeyExpiry == nil {
+			return "-"
+		}
+		return formatStatusTime(*ps.KeyExpiry)
+	}},
+	{"tags", "Tags", func(ps *ipnstate.PeerStatus) string {
+		if ps.Tags == nil || ps.Tags.Len() == 0 {
+			return "-"
+		}
+		return sanitizeForTerminal(strings.Join(ps.Tags.AsSlice(), ","))
+	}},
+}
+
+func statusColumnNames() []string {
+	var names []string
+	for _, c := range statusColumns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// selectStatusColumns returns the columns named in list, in the order given,
+// or every column if list names "all". Every name is checked either way.
+func selectStatusColumns(list string) ([]statusColumn, error) {
+	var out []statusColumn
+	all := false
+	for _, name := range splitList(list) {
+		if name == "all" {
+			all = true
+			continue
+		}
+		i := slices.IndexFunc(statusColumns, func(c statusColumn) bool { return c.name == name })
+		if i == -1 {
+			return nil, fmt.Errorf("unknown column %q, known columns: %s", name, strings.Join(statusColumnNames(), ", "))
+		}
+		out = append(out, statusColumns[i])
+	}
+	if all {
+		return statusColumns, nil
+	}
+	return out, nil
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05Z")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
@@ -0,0 +1,93 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+)
+
+func testPeerWithTags(os string, tags ...string) *ipnstate.PeerStatus {
+	ps := &ipnstate.PeerStatus{OS: os}
+	if tags != nil {
+		v := views.SliceOf(tags)
+		ps.Tags = &v
+	}
+	return ps
+}
+
+func TestPeerMatchesSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		os, tag string
+		peer    *ipnstate.PeerStatus
+		want    bool
+	}{
+		{name: "no-filter", peer: testPeerWithTags("linux"), want: true},
+		{name: "os", os: "android", peer: testPeerWithTags("android"), want: true},
+		{name: "os-case", os: "Android", peer: testPeerWithTags("android"), want: true},
+		{name: "os-other", os: "android", peer: testPeerWithTags("linux")},
+		// Tags are given with or without the "tag:" prefix, and
+		// matched against peer tags with or without it.
+		{name: "tag-prefixed", tag: "tag:endpoint", peer: testPeerWithTags("android", "tag:endpoint"), want: true},
+		{name: "tag-bare", tag: "endpoint", peer: testPeerWithTags("android", "tag:endpoint"), want: true},
+		{name: "tag-prefixed-bare-peer", tag: "tag:endpoint", peer: testPeerWithTags("android", "endpoint"), want: true},
+		{name: "tag-one-of", tag: "analyst, endpoint", peer: testPeerWithTags("android", "tag:other", "tag:endpoint"), want: true},
+		{name: "tag-other", tag: "endpoint", peer: testPeerWithTags("android", "tag:analyst")},
+		{name: "tag-substring", tag: "end", peer: testPeerWithTags("android", "tag:endpoint")},
+		{name: "tag-untagged", tag: "endpoint", peer: testPeerWithTags("android")},
+		{name: "tag-and-os", os: "linux", tag: "endpoint", peer: testPeerWithTags("android", "tag:endpoint")},
+	}
+	saved := statusArgs
+	defer func() { statusArgs = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusArgs.os, statusArgs.tag = tt.os, tt.tag
+			if got := peerMatchesSelection(tt.peer); got != tt.want {
+				t.Errorf("peerMatchesSelection = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectStatusColumns(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{list: "", want: nil},
+		{list: "rx,tx", want: []string{"rx", "tx"}},
+		{list: " path , handshake ", want: []string{"path", "handshake"}},
+		{list: "all", want: statusColumnNames()},
+		{list: "rx,all", want: statusColumnNames()},
+		{list: "all,rx", want: statusColumnNames()},
+		{list: "rx,bogus", err: true},
+		{list: "all,bogus", err: true},
+		{list: "bogus,all", err: true},
+	}
+	for _, tt := range tests {
+		cols, err := selectStatusColumns(tt.list)
+		if tt.err {
+			if err == nil {
+				t.Errorf("selectStatusColumns(%q) succeeded, want error", tt.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("selectStatusColumns(%q): %v", tt.list, err)
+			continue
+		}
+		var names []string
+		for _, c := range cols {
+			names = append(names, c.name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("selectStatusColumns(%q) = %q, want %q", tt.list, names, tt.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// watchLogSize is how many transitions status --watch keeps on screen.
+const watchLogSize = 20
+
+// Peer transitions reported by status --watch.
+const (
+	peerJoined      = "joined"
+	peerLeft        = "left"
+	peerOnline      = "online"
+	peerOffline     = "offline"
+	peerPathChanged = "path_changed"
+)
+
+// peerTransition is a change in a peer's state between two status snapshots.
+type peerTransition struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	NodeID   string    `json:"node_id"`
+	HostName string    `json:"hostname"`
+	IP       string    `json:"ip,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+}
+
+// peerSnapshot is what status --watch compares between snapshots.
+type peerSnapshot struct {
+	hostName string
+	ip       string
+	online   bool
+	path     string
+}
+
+// peerPath describes how traffic reaches a peer: its direct endpoint, or
+// the peer relay or DERP region it is relayed through.
+func peerPath(ps *ipnstate.PeerStatus) string {
+	switch {
+	case ps.CurAddr != "":
+		return "direct " + ps.CurAddr
+	case ps.PeerRelay != "":
+		return "peer-relay " + ps.PeerRelay
+	case ps.Relay != "":
+		return "derp " + ps.Relay
+	}
+	return ""
+}
+
+// pathNone stands for a peer without a path in path_changed transitions.
+const pathNone = "none"
+
+func snapshotPeers(st *ipnstate.Status) map[string]peerSnapshot {
+	snap := make(map[string]peerSnapshot)
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if !peerMatchesSelection(ps) {
+			continue
+		}
+		s := peerSnapshot{
+			hostName: ps.HostName,
+			online:   ps.Online,
+			path:     peerPath(ps),
+		}
+		if len(ps.TailscaleIPs) > 0 {
+			s.ip = ps.TailscaleIPs[0].String()
+		}
+		snap[string(ps.ID)] = s
+	}
+	return snap
+}
+
+// diffPeers lists the transitions from prev to cur.
+func diffPeers(prev, cur map[string]peerSnapshot, now time.Time) []peerTransition {
+	var out []peerTransition
+	add := func(event, id string, s peerSnapshot, from, to string) {
+		out = append(out, peerTransition{Time: now, Event: event, NodeID: id, HostName: s.hostName, IP: s.ip, From: from, To: to})
+	}
+	for id, c := range cur {
+		p, ok := prev[id]
+		switch {
+		case !ok:
+			add(peerJoined, id, c, "", c.path)
+		case !p.online && c.online:
+			add(peerOnline, id, c, "", c.path)
+		case p.online && !c.online:
+			add(peerOffline, id, c, "", "")
+		case p.path != c.path:
+			// Losing every path (or regaining one) while still online
+			// is reported too.
+			add(peerPathChanged, id, c, cmp.Or(p.path, pathNone), cmp.Or(c.path, pathNone))
+		}
+	}
+	for id, p := range prev {
+		if _, ok := cur[id]; !ok {
+			add(peerLeft, id, p, "", "")
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].HostName < out[j].HostName })
+	return out
+}
+
+// watchStatus follows the local IPN notification bus and reports every
+// peer transition. On a terminal the status table is redrawn together with
+// the latest transitions; otherwise, and with --json, only the transitions
+// are written, one per line.
+func watchStatus(ctx context.Context, columns []statusColumn) error {
+	w, err := localClient.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyWatchEngineUpdates|ipn.NotifyRateLimit)
+	if err != nil {
+		return fmt.Errorf("failed to watch the MESH client: %w", err)
+	}
+	defer w.Close()
+
+	redraw := !statusArgs.json && isatty.IsTerminal(os.Stdout.Fd())
+	enc := json.NewEncoder(os.Stdout)
+	var prev map[string]peerSnapshot
+	var history []peerTransition
+	for {
+		if _, err := w.Next(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("watching the MESH client: %w", err)
+		}
+		// Notifications carry network map and engine changes but not the
+		// per-peer status, so take a fresh snapshot on each one.
+		st, err := localClient.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get status: %w", err)
+		}
+		cur := snapshotPeers(st)
+		var changes []peerTransition
+		if prev != nil {
+			changes = diffPeers(prev, cur, time.Now())
+		}
+		prev = cur
+
+		if !redraw {
+			for _, t := range changes {
+				if statusArgs.json {
+					if err := enc.Encode(t); err != nil {
+						return err
+					}
+					continue
+				}
+				fmt.Println(formatTransition(t))
+			}
+			continue
+		}
+
+		history = append(history, changes...)
+		if len(history) > watchLogSize {
+			history = history[len(history)-watchLogSize:]
+		}
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("MESH status, watching for changes (Ctrl-C to stop)\n\n")
+		writeStatusTable(os.Stdout, st, columns)
+		fmt.Printf("\n# Events:\n")
+		for _, t := range history {
+			fmt.Println(formatTransition(t))
+		}
+	}
+}
+
+func formatTransition(t peerTransition) string {
+	s := fmt.Sprintf("%s  %-12s %s %s", t.Time.Format("2006-01-02 15:04:05"), t.Event, sanitizeForTerminal(t.HostName), t.IP)
+	switch {
+	case t.From != "":
+		s += fmt.Sprintf(" (%s -> %s)", t.From, t.To)
+	case t.To != "":
+		s += fmt.Sprintf(" (%s)", t.To)
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffPeers(t *testing.T) {
+	direct := peerSnapshot{hostName: "pixel", ip: "100.64.0.5", online: true, path: "direct 192.0.2.10:41641"}
+	derp := peerSnapshot{hostName: "pixel", ip: "100.64.0.5", online: true, path: "derp fra"}
+	noPath := peerSnapshot{hostName: "pixel", ip: "100.64.0.5", online: true}
+	offline := peerSnapshot{hostName: "pixel", ip: "100.64.0.5"}
+	other := peerSnapshot{hostName: "galaxy", ip: "100.64.0.6", online: true, path: "derp ams"}
+
+	tests := []struct {
+		name      string
+		prev, cur map[string]peerSnapshot
+		want      []peerTransition
+	}{
+		{
+			name: "unchanged",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{"n1": direct},
+		},
+		{
+			name: "joined",
+			cur:  map[string]peerSnapshot{"n1": direct},
+			want: []peerTransition{{Event: peerJoined, NodeID: "n1", To: direct.path}},
+		},
+		{
+			name: "left",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{},
+			want: []peerTransition{{Event: peerLeft, NodeID: "n1"}},
+		},
+		{
+			name: "online",
+			prev: map[string]peerSnapshot{"n1": offline},
+			cur:  map[string]peerSnapshot{"n1": derp},
+			want: []peerTransition{{Event: peerOnline, NodeID: "n1", To: derp.path}},
+		},
+		{
+			name: "offline",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{"n1": offline},
+			want: []peerTransition{{Event: peerOffline, NodeID: "n1"}},
+		},
+		{
+			name: "path-changed",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{"n1": derp},
+			want: []peerTransition{{Event: peerPathChanged, NodeID: "n1", From: direct.path, To: derp.path}},
+		},
+		{
+			name: "path-lost",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{"n1": noPath},
+			want: []peerTransition{{Event: peerPathChanged, NodeID: "n1", From: direct.path, To: pathNone}},
+		},
+		{
+			name: "path-regained",
+			prev: map[string]peerSnapshot{"n1": noPath},
+			cur:  map[string]peerSnapshot{"n1": direct},
+			want: []peerTransition{{Event: peerPathChanged, NodeID: "n1", From: pathNone, To: direct.path}},
+		},
+		{
+			name: "sorted-by-hostname",
+			prev: map[string]peerSnapshot{"n1": direct},
+			cur:  map[string]peerSnapshot{"n2": other},
+			want: []peerTransition{
+				{Event: peerJoined, NodeID: "n2", To: other.path},
+				{Event: peerLeft, NodeID: "n1"},
+			},
+		},
+	}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffPeers(tt.prev, tt.cur, now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i, g := range got {
+				w := tt.want[i]
+				snap := tt.cur[w.NodeID]
+				if w.Event == peerLeft {
+					snap = tt.prev[w.NodeID]
+				}
+				w.Time, w.HostName, w.IP = now, snap.hostName, snap.ip
+				if g != w {
+					t.Errorf("transition %d: got %+v, want %+v", i, g, w)
+				}
+			}
+		})
+	}
+}
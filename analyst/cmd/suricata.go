@@ -0,0 +1,495 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	// eveStartTimeout is how long a started Suricata gets to create its
+	// EVE file.
+	eveStartTimeout = time.Minute
+	eveMaxLine      = 1 << 20
+	eveFile         = "eve.json"
+)
+
+var suricataArgs struct {
+	bin        string
+	config     string
+	rules      string
+	eve        string
+	eveSocket  string
+	follow     bool
+	eventTypes string
+	out        string
+	duration   time.Duration
+	caseDir    string
+}
+
+func SuricataCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("suricata", flag.ContinueOnError)
+	fs.StringVar(&suricataArgs.bin, "suricata", "suricata", "Suricata binary to run")
+	fs.StringVar(&suricataArgs.config, "config", "", "Suricata configuration (default: Suricata's own)")
+	fs.StringVar(&suricataArgs.rules, "rules", "", "rules file to use instead of the configured rules")
+	fs.StringVar(&suricataArgs.eve, "eve", "", "read events from this EVE JSON file instead of running Suricata")
+	fs.BoolVar(&suricataArgs.follow, "follow", false, "with --eve, keep reading events appended to the file")
+	fs.StringVar(&suricataArgs.eveSocket, "eve-socket", "", "receive events from a Suricata writing EVE to this unix socket instead of running Suricata")
+	fs.StringVar(&suricataArgs.eventTypes, "event-types", "alert", "comma-separated EVE event types to keep, e.g. alert,dns,tls")
+	fs.StringVar(&suricataArgs.out, "out", "", "JSONL file to write the tagged events to (default: suricata-events-<time>.jsonl in the case)")
+	fs.DurationVar(&suricataArgs.duration, "duration", 0, "stop after this long (default: until interrupted)")
+	fs.StringVar(&suricataArgs.caseDir, "case", "", "case to record the alerts in (default: $"+caseEnv+" or the current case)")
+
+	return &ffcli.Command{
+		Name:       "suricata",
+		ShortUsage: "meshcli suricata [flags] <peer>",
+		ShortHelp:  "Run Suricata on a peer's traffic and record its alerts",
+		LongHelp: strings.TrimSpace(`
+Runs Suricata on the MESH interface, limited by a BPF filter to the traffic
+of one peer, given by hostname, MagicDNS name or MESH IP, and follows its
+EVE JSON output. Each event is tagged with the peer's MESH identity
+(hostname, node ID, node key, OS) and whether it was sent by the peer or to
+it, printed, and written to a JSONL file; alerts are also recorded in the
+case log. For the peer's internet traffic to be seen, the analyst node must
+be its exit node (see "meshcli monitor"). Running Suricata needs root.
+
+Suricata writes its logs to suricata-<time>/ in the case directory. When it
+stops, its log files and the tagged event file are hashed like the files of
+"meshcli capture", and the hashes recorded in the case log.
+
+Instead of running Suricata, events can be taken from:
+
+  --eve-socket  a Suricata that is already running, with an eve-log output
+                of filetype unix_stream pointed at this socket path; meshcli
+                listens on it
+  --eve         an EVE file, for instance from running Suricata on a capture
+                afterwards; with --follow, events appended later are read too
+
+In both cases only events to or from the peer's MESH addresses are kept.
+
+Examples:
+  sudo meshcli suricata pixel-7
+  sudo meshcli suricata --rules forensic.rules --event-types alert,dns,tls pixel-7
+  meshcli suricata --eve-socket /run/suricata/mesh-eve.sock pixel-7
+  meshcli suricata --eve /var/log/suricata/eve.json 100.64.0.5
+`),
+		FlagSet: fs,
+		Exec:    runSuricata,
+	}
+}
+
+// eveEvent holds the fields of an EVE event that meshcli looks at.
+type eveEvent struct {
+	Timestamp string `json:"timestamp"`
+	EventType string `json:"event_type"`
+	SrcIP     string `json:"src_ip"`
+	SrcPort   int    `json:"src_port"`
+	DestIP    string `json:"dest_ip"`
+	DestPort  int    `json:"dest_port"`
+	Proto     string `json:"proto"`
+	AppProto  string `json:"app_proto"`
+	Alert     *struct {
+		Action      string `json:"action"`
+		GID         int    `json:"gid"`
+		SignatureID int    `json:"signature_id"`
+		Rev         int    `json:"rev"`
+		Signature   string `json:"signature"`
+		Category    string `json:"category"`
+		Severity    int    `json:"severity"`
+	} `json:"alert"`
+}
+
+// taggedEvent is one line of the event file: an EVE event with the MESH
+// identity of the peer it belongs to.
+type taggedEvent struct {
+	Peer      string          `json:"peer"`
+	NodeID    string          `json:"node_id"`
+	NodeKey   string          `json:"node_key"`
+	OS        string          `json:"os"`
+	Direction string          `json:"direction"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// suricataSession tags the events of one peer and records them.
+type suricataSession struct {
+	peer  *ipnstate.PeerStatus
+	types []string
+	c     *Case
+
+	mu     sync.Mutex
+	w      *bufio.Writer
+	events int
+	alerts int
+}
+
+func runSuricata(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: meshcli suricata [flags] <peer>")
+	}
+	if suricataArgs.eve != "" && suricataArgs.eveSocket != "" {
+		return errors.New("--eve and --eve-socket cannot be combined")
+	}
+	if suricataArgs.follow && suricataArgs.eve == "" {
+		return errors.New("--follow needs --eve")
+	}
+
+	st, err := localClient.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get MESH status: %w", err)
+	}
+	ps, err := findPeer(st, args[0])
+	if err != nil {
+		return err
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("peer %s has no MESH address", args[0])
+	}
+
+	c, err := openCase(suricataArgs.caseDir, false)
+	if err != nil {
+		return err
+	}
+	stamp := time.Now().UTC().Format("20060102-150405")
+	out := suricataArgs.out
+	if out == "" {
+		if c == nil {
+			return errors.New("no case selected; use --case or --out")
+		}
+		out = filepath.Join(c.Dir, "suricata-events-"+stamp+".jsonl")
+	}
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create event file: %w", err)
+	}
+	s := &suricataSession{peer: ps, c: c, w: bufio.NewWriter(f)}
+	for t := range strings.SplitSeq(suricataArgs.eventTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s.types = append(s.types, t)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if suricataArgs.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, suricataArgs.duration)
+		defer cancel()
+	}
+
+	details := map[string]any{
+		"peer":        ps.HostName,
+		"node_id":     string(ps.ID),
+		"event_types": s.types,
+		"out":         out,
+	}
+	var (
+		logDir  string
+		readErr error
+	)
+	switch {
+	case suricataArgs.eve != "":
+		details["eve"] = suricataArgs.eve
+		logCase(c, "suricata_started", details)
+		readErr = s.readFile(ctx, suricataArgs.eve, suricataArgs.follow)
+	case suricataArgs.eveSocket != "":
+		details["eve_socket"] = suricataArgs.eveSocket
+		logCase(c, "suricata_started", details)
+		readErr = s.serveSocket(ctx, suricataArgs.eveSocket)
+	default:
+		logDir = filepath.Join(filepath.Dir(out), "suricata-"+stamp)
+		readErr = s.runManaged(ctx, st, logDir, details)
+	}
+
+	reason := "interrupted"
+	switch {
+	case readErr != nil:
+		reason = "error"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		reason = "duration reached"
+	case ctx.Err() == nil:
+		reason = "end of events"
+	}
+	s.mu.Lock()
+	err = s.w.Flush()
+	s.mu.Unlock()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && readErr == nil {
+		readErr = fmt.Errorf("closing %s: %w", out, err)
+	}
+
+	files := []string{out}
+	if logDir != "" {
+		if des, err := os.ReadDir(logDir); err == nil {
+			for _, de := range des {
+				if !de.IsDir() && filepath.Ext(de.Name()) != ".sha256" {
+					files = append(files, filepath.Join(logDir, de.Name()))
+				}
+			}
+		}
+	}
+	hashes := make(map[string]string)
+	for _, path := range files {
+		sum, _, err := writeChecksum(path)
+		if err != nil {
+			if readErr == nil {
+				readErr = err
+			}
+			continue
+		}
+		hashes[path] = sum
+	}
+	logCase(c, "suricata_stopped", stepDetails(readErr, map[string]any{
+		"reason": reason,
+		"events": s.events,
+		"alerts": s.alerts,
+		"files":  hashes,
+	}))
+	fmt.Printf("Suricata monitoring stopped (%s): %d alert(s), %d event(s) written to %s\n", reason, s.alerts, s.events, out)
+	return readErr
+}
+
+// runManaged runs Suricata on the MESH interface, filtered to the peer,
+// and follows its EVE file until ctx is done.
+func (s *suricataSession) runManaged(ctx context.Context, st *ipnstate.Status, logDir string, details map[string]any) error {
+	if st.Self == nil || len(st.Self.TailscaleIPs) == 0 {
+		return errors.New("this node has no MESH address; run \"meshcli up\" first")
+	}
+	iface, err := interfaceWithAddr(st.Self.TailscaleIPs[0])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(logDir, 0o700); err != nil {
+		return err
+	}
+	var hosts []string
+	for _, ip := range s.peer.TailscaleIPs {
+		hosts = append(hosts, "host "+ip.String())
+	}
+	// Checksums are not verified: packets on the MESH interface may carry
+	// checksums left to offloading.
+	args := []string{"-i", iface, "-l", logDir, "-k", "none"}
+	if suricataArgs.config != "" {
+		args = append(args, "-c", suricataArgs.config)
+	}
+	if suricataArgs.rules != "" {
+		args = append(args, "-S", suricataArgs.rules)
+	}
+	args = append(args, strings.Join(hosts, " or "))
+
+	console, err := os.Create(filepath.Join(logDir, "console.log"))
+	if err != nil {
+		return err
+	}
+	defer console.Close()
+	// Suricata is stopped with SIGTERM rather than killed, so that it
+	// flushes its logs.
+	cmd := exec.Command(suricataArgs.bin, args...)
+	cmd.Stdout, cmd.Stderr = console, console
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start Suricata: %w", err)
+	}
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(syscall.SIGTERM)
+		case <-exited:
+		}
+	}()
+
+	details["interface"] = iface
+	details["log_dir"] = logDir
+	details["command"] = append([]string{suricataArgs.bin}, args...)
+	logCase(s.c, "suricata_started", details)
+	fmt.Printf("Running Suricata on %s for %s (%s), logs in %s. Ctrl-C to stop...\n",
+		iface, sanitizeForTerminal(s.peer.HostName), strings.Join(hosts, " or "), logDir)
+
+	eve := filepath.Join(logDir, eveFile)
+	deadline := time.Now().Add(eveStartTimeout)
+	for {
+		if _, err := os.Stat(eve); err == nil {
+			break
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("suricata exited (%v) before writing events; see %s", waitErr, console.Name())
+		case <-ctx.Done():
+			<-exited
+			return nil
+		case <-time.After(followPoll):
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Signal(syscall.SIGTERM)
+			<-exited
+			return fmt.Errorf("suricata did not create %s; check that its eve-log output is enabled", eve)
+		}
+	}
+	ef, err := os.Open(eve)
+	if err != nil {
+		return err
+	}
+	defer ef.Close()
+	if err := s.read(&followReader{f: ef, done: exited}); err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("suricata exited: %v; see %s", waitErr, console.Name())
+	}
+	return nil
+}
+
+// readFile reads the events of an EVE file; with follow, it keeps reading
+// what is appended until ctx is done.
+func (s *suricataSession) readFile(ctx context.Context, path string, follow bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Printf("Reading events for %s from %s...\n", sanitizeForTerminal(s.peer.HostName), path)
+	if follow {
+		return s.read(&followReader{f: f, done: ctx.Done()})
+	}
+	return s.read(f)
+}
+
+// serveSocket listens on a unix socket for a Suricata eve-log output of
+// filetype unix_stream, which connects to it and reconnects as needed.
+func (s *suricataSession) serveSocket(ctx context.Context, path string) error {
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	fmt.Printf("Waiting for Suricata events for %s on %s. Ctrl-C to stop...\n", sanitizeForTerminal(s.peer.HostName), path)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+			if err := s.read(conn); err != nil && ctx.Err() == nil {
+				fmt.Printf("Reading from Suricata: %v\n", err)
+			}
+		}()
+	}
+}
+
+// read handles EVE events, one per line, until r ends.
+func (s *suricataSession) read(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), eveMaxLine)
+	for sc.Scan() {
+		if err := s.handle(sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// handle tags and records an event that belongs to the peer and is of a
+// kept type. Lines that are not EVE events are ignored.
+func (s *suricataSession) handle(line []byte) error {
+	var e eveEvent
+	if err := json.Unmarshal(line, &e); err != nil || !slices.Contains(s.types, e.EventType) {
+		return nil
+	}
+	direction := ""
+	switch {
+	case s.isPeer(e.SrcIP):
+		direction = "from_peer"
+	case s.isPeer(e.DestIP):
+		direction = "to_peer"
+	default:
+		return nil
+	}
+	t := taggedEvent{
+		Peer:      s.peer.HostName,
+		NodeID:    string(s.peer.ID),
+		NodeKey:   s.peer.PublicKey.String(),
+		OS:        s.peer.OS,
+		Direction: direction,
+		Event:     json.RawMessage(slices.Clone(line)),
+	}
+	b, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("writing event: %w", err)
+	}
+	s.events++
+	if e.Alert == nil {
+		return nil
+	}
+	s.alerts++
+	logCase(s.c, "suricata_alert", map[string]any{"alert": t})
+	fmt.Printf("ALERT %s [%d:%d:%d] %s (%s, severity %d) %s:%d -> %s:%d %s\n",
+		e.Timestamp, e.Alert.GID, e.Alert.SignatureID, e.Alert.Rev,
+		sanitizeForTerminal(e.Alert.Signature), sanitizeForTerminal(orDash(e.Alert.Category)), e.Alert.Severity,
+		e.SrcIP, e.SrcPort, e.DestIP, e.DestPort, orDash(e.AppProto))
+	return nil
+}
+
+func (s *suricataSession) isPeer(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	return err == nil && slices.Contains(s.peer.TailscaleIPs, ip.Unmap())
+}
@@ -0,0 +1,193 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// cannedEVE is an EVE stream as Suricata writes it, with the peer at
+// 100.64.0.5 and fd7a:115c:a1e0::5.
+var cannedEVE = strings.Join([]string{
+	`{"timestamp":"2024-05-01T10:00:00.000000+0000","event_type":"alert","src_ip":"100.64.0.5","src_port":40000,"dest_ip":"203.0.113.9","dest_port":443,"proto":"TCP","app_proto":"tls","alert":{"action":"allowed","gid":1,"signature_id":2000001,"rev":3,"signature":"ET MALWARE Test C2","category":"A Network Trojan was detected","severity":1}}`,
+	`{"timestamp":"2024-05-01T10:00:01.000000+0000","event_type":"dns","src_ip":"198.51.100.53","src_port":53,"dest_ip":"100.64.0.5","dest_port":41000,"proto":"UDP","dns":{"type":"answer","rrname":"example.com"}}`,
+	`{"timestamp":"2024-05-01T10:00:02.000000+0000","event_type":"flow","src_ip":"100.64.0.5","src_port":40000,"dest_ip":"203.0.113.9","dest_port":443,"proto":"TCP"}`,
+	`{"timestamp":"2024-05-01T10:00:03.000000+0000","event_type":"alert","src_ip":"100.64.0.8","src_port":40001,"dest_ip":"203.0.113.9","dest_port":80,"proto":"TCP","alert":{"gid":1,"signature_id":2000002,"rev":1,"signature":"Other peer","severity":2}}`,
+	`not an EVE event`,
+	`{"timestamp":"2024-05-01T10:00:04.000000+0000","event_type":"stats","stats":{"uptime":10}}`,
+	`{"timestamp":"2024-05-01T10:00:05.000000+0000","event_type":"alert","src_ip":"198.51.100.7","src_port":443,"dest_ip":"fd7a:115c:a1e0::5","dest_port":50000,"proto":"TCP","alert":{"gid":1,"signature_id":2000003,"rev":1,"signature":"Inbound to peer","severity":2}}`,
+}, "\n") + "\n"
+
+// cannedWant is the direction and signature or type of each event of
+// cannedEVE that belongs to the peer and is of a kept type.
+var cannedWant = []string{
+	"from_peer alert 2000001",
+	"to_peer dns",
+	"to_peer alert 2000003",
+}
+
+func newTestSuricataSession(t *testing.T) (*suricataSession, *bytes.Buffer) {
+	t.Helper()
+	var out bytes.Buffer
+	s := &suricataSession{
+		peer: &ipnstate.PeerStatus{
+			ID:           "n123",
+			HostName:     "pixel",
+			OS:           "android",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.5"), netip.MustParseAddr("fd7a:115c:a1e0::5")},
+		},
+		types: []string{"alert", "dns"},
+		c:     testCase(t),
+		w:     bufio.NewWriter(&out),
+	}
+	return s, &out
+}
+
+// checkSuricataOutput compares the tagged events and the case log with
+// cannedWant.
+func checkSuricataOutput(t *testing.T, s *suricataSession, out *bytes.Buffer) {
+	t.Helper()
+	var got []string
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var te taggedEvent
+		if err := json.Unmarshal(sc.Bytes(), &te); err != nil {
+			t.Fatalf("invalid tagged event %q: %v", sc.Text(), err)
+		}
+		if te.Peer != "pixel" || te.NodeID != "n123" || te.OS != "android" {
+			t.Errorf("event tagged with %q %q %q", te.Peer, te.NodeID, te.OS)
+		}
+		var e eveEvent
+		if err := json.Unmarshal(te.Event, &e); err != nil {
+			t.Fatal(err)
+		}
+		desc := te.Direction + " " + e.EventType
+		if e.Alert != nil {
+			desc += " " + strconv.Itoa(e.Alert.SignatureID)
+		}
+		got = append(got, desc)
+	}
+	if !slices.Equal(got, cannedWant) {
+		t.Errorf("events:\n got %q\nwant %q", got, cannedWant)
+	}
+	if s.events != 3 || s.alerts != 2 {
+		t.Errorf("counted %d events, %d alerts; want 3, 2", s.events, s.alerts)
+	}
+
+	entries, err := readCaseLog(s.c.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	for _, ev := range entries {
+		if ev.Event != "suricata_alert" {
+			continue
+		}
+		var d struct {
+			Alert taggedEvent `json:"alert"`
+		}
+		if err := json.Unmarshal(ev.Details, &d); err != nil {
+			t.Fatal(err)
+		}
+		var e eveEvent
+		if err := json.Unmarshal(d.Alert.Event, &e); err != nil {
+			t.Fatal(err)
+		}
+		logged = append(logged, d.Alert.Direction+" "+e.EventType+" "+strconv.Itoa(e.Alert.SignatureID))
+	}
+	if want := []string{cannedWant[0], cannedWant[2]}; !slices.Equal(logged, want) {
+		t.Errorf("case log alerts:\n got %q\nwant %q", logged, want)
+	}
+}
+
+func TestSuricataReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eve.json")
+	if err := os.WriteFile(path, []byte(cannedEVE), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, follow := range []bool{false, true} {
+		name := "once"
+		if follow {
+			name = "follow"
+		}
+		t.Run(name, func(t *testing.T) {
+			s, out := newTestSuricataSession(t)
+			// With follow, a cancelled context reads what is left and ends.
+			ctx, cancel := context.WithCancel(context.Background())
+			if follow {
+				cancel()
+			}
+			defer cancel()
+			if err := s.readFile(ctx, path, follow); err != nil {
+				t.Fatal(err)
+			}
+			checkSuricataOutput(t, s, out)
+		})
+	}
+}
+
+func TestSuricataServeSocket(t *testing.T) {
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir
+	// can exceed.
+	dir, err := os.MkdirTemp("", "eve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "eve.sock")
+
+	s, out := newTestSuricataSession(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- s.serveSocket(ctx, path) }()
+
+	var conn net.Conn
+	for range 100 {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Suricata writes events in pieces that need not end at a line.
+	half := len(cannedEVE) / 2
+	for _, part := range []string{cannedEVE[:half], cannedEVE[half:]} {
+		if _, err := conn.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	for range 100 {
+		s.mu.Lock()
+		n := s.events
+		s.mu.Unlock()
+		if n == len(cannedWant) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	checkSuricataOutput(t, s, out)
+}
@@ -0,0 +1,415 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/mattn/go-isatty"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+)
+
+var tuiArgs struct {
+	caseDir string
+	acq     acquisitionFlags
+}
+
+// Workflow stages of the console, in the order they are suggested.
+const (
+	stagePair    = "pair"
+	stageCollect = "collect"
+	stageClean   = "clean"
+	stageDisable = "disable"
+)
+
+var tuiStages = []string{stagePair, stageCollect, stageClean, stageDisable}
+
+// tuiPeer is an Android peer as listed by the console.
+type tuiPeer struct {
+	AndroidPeer
+	online bool
+	conn   string
+}
+
+// console is the state of a tui session. The peer list and health
+// warnings are refreshed from the IPN bus; everything else changes only
+// when the analyst runs a step.
+type console struct {
+	mu     sync.Mutex
+	peers  []tuiPeer
+	health []string
+	err    error
+	// busy is set while a step runs, so that bus updates do not redraw
+	// over its output.
+	busy bool
+
+	selected *AndroidPeer
+	c        *Case
+	// cases holds the case of each device paired in this session, by
+	// node ID, since every device gets its own case.
+	cases   map[string]*Case
+	serial  string
+	binding *deviceBinding
+	done    map[string]error
+	message string
+}
+
+func TuiCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	fs.StringVar(&tuiArgs.caseDir, "case", "", "case directory (default: $"+caseEnv+", the current case, or a new case)")
+	tuiArgs.acq.register(fs)
+
+	return &ffcli.Command{
+		Name:       "tui",
+		ShortUsage: "meshcli tui [flags]",
+		ShortHelp:  "Interactive console for the analyst workflow",
+		LongHelp: `The tui command is an interactive console for acquiring one Android device over MESH. It lists the Android peers live from the MESH client, with the client's health warnings, and walks through the steps of the analyst workflow on the selected device:
+
+  pair     pair over wireless debugging, connect and bind the device to the peer (as adbpair)
+  collect  run the acquisition (as adbcollect), with the acquisition flags given to tui
+  clean    clear logs and telemetry, and revoke the case's ADB key (as adbclean)
+  disable  turn off wireless debugging and check its ports are closed (as adbdisable)
+
+clean runs before disable because disabling ADB ends the connection clean needs. Each step is recorded in the case log like the command it stands for.
+
+Commands at the prompt: a peer's number selects it, p/c/x/d run pair, collect, clean and disable, n runs the next step, r refreshes the peer list and q (or end of input) quits.
+
+Every device gets its own case: the first device paired uses --case, $` + caseEnv + ` or the current case, and each other device selected in the same session starts a new one, which does not become the current case.
+
+Examples:
+  meshcli tui
+  meshcli tui --profile triage --output /cases
+`,
+		FlagSet: fs,
+		Exec:    runTui,
+	}
+}
+
+func runTui(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	if !(isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd())) {
+		return errors.New("tui needs an interactive terminal")
+	}
+	// Check the acquisition flags before the analyst starts pairing.
+	if _, err := tuiArgs.acq.options(""); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	t := &console{done: map[string]error{}, cases: map[string]*Case{}}
+	t.refresh(ctx)
+	go t.watch(ctx)
+
+	for {
+		t.draw()
+		line, err := readLine("> ")
+		if errors.Is(err, io.EOF) {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read command: %w", err)
+		}
+		line = strings.ToLower(line)
+		switch {
+		case line == "q":
+			return nil
+		case line == "r" || line == "":
+			t.refresh(ctx)
+		case line == "p":
+			t.run(ctx, stagePair)
+		case line == "c":
+			t.run(ctx, stageCollect)
+		case line == "x":
+			t.run(ctx, stageClean)
+		case line == "d":
+			t.run(ctx, stageDisable)
+		case line == "n":
+			t.run(ctx, t.nextStage())
+		default:
+			t.selectPeer(line)
+		}
+	}
+}
+
+// watch refreshes the peer list whenever the MESH client reports a change.
+// The bus carries network map and health updates but not peer status, so
+// each notification triggers a status query.
+func (t *console) watch(ctx context.Context) {
+	w, err := localClient.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyInitialHealthState|ipn.NotifyRateLimit)
+	if err != nil {
+		t.setMessage(fmt.Sprintf("Live updates unavailable (%v), press r to refresh", err))
+		return
+	}
+	defer w.Close()
+	for {
+		if _, err := w.Next(); err != nil {
+			if ctx.Err() == nil {
+				t.setMessage(fmt.Sprintf("Live updates stopped (%v), press r to refresh", err))
+			}
+			return
+		}
+		t.refresh(ctx)
+		t.mu.Lock()
+		busy := t.busy
+		t.mu.Unlock()
+		if !busy {
+			t.draw()
+			fmt.Print("> ")
+		}
+	}
+}
+
+func (t *console) refresh(ctx context.Context) {
+	st, err := localClient.Status(ctx)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+	if err != nil {
+		return
+	}
+	t.health = st.Health
+	t.peers = t.peers[:0]
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if ps.OS != "android" || len(ps.TailscaleIPs) == 0 {
+			continue
+		}
+		conn := ps.CurAddr
+		if conn == "" && ps.Relay != "" {
+			conn = "relay " + ps.Relay
+		}
+		t.peers = append(t.peers, tuiPeer{
+			AndroidPeer: newAndroidPeer(ps),
+			online:      ps.Online,
+			conn:        conn,
+		})
+	}
+}
+
+func (t *console) setMessage(msg string) {
+	t.mu.Lock()
+	t.message = msg
+	t.mu.Unlock()
+}
+
+func (t *console) draw() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("MESH analyst console")
+	if t.c != nil {
+		fmt.Printf(" - case %s", t.c.ID)
+	}
+	fmt.Printf("\n\n")
+	if t.err != nil {
+		fmt.Printf("! MESH client unavailable: %v\n\n", t.err)
+	}
+	for _, h := range t.health {
+		fmt.Printf("! %s\n", sanitizeForTerminal(h))
+	}
+	if len(t.health) > 0 {
+		fmt.Println()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, " #\tHOSTNAME\tIP\tSTATUS\tCONNECTION")
+	for i, p := range t.peers {
+		mark := " "
+		if t.selected != nil && t.selected.NodeID == p.NodeID {
+			mark = "*"
+		}
+		status := "offline"
+		if p.online {
+			status = "online"
+		}
+		fmt.Fprintf(w, "%s%d\t%s\t%s\t%s\t%s\n", mark, i+1, p.HostName, p.IP, status, p.conn)
+	}
+	w.Flush()
+	if len(t.peers) == 0 {
+		fmt.Println("  (no Android peers)")
+	}
+
+	fmt.Println()
+	if t.selected != nil {
+		fmt.Printf("Device: %s (%s)", t.selected.HostName, t.selected.IP)
+		if t.serial != "" {
+			fmt.Printf(", ADB %s", t.serial)
+		}
+		fmt.Println()
+		for _, s := range tuiStages {
+			mark := "[ ]"
+			if err, ok := t.done[s]; ok {
+				mark = "[x]"
+				if err != nil {
+					mark = "[!]"
+				}
+			}
+			fmt.Printf("  %s %s\n", mark, s)
+		}
+	} else {
+		fmt.Println("No device selected.")
+	}
+	if t.message != "" {
+		fmt.Printf("\n%s\n", t.message)
+	}
+	fmt.Printf("\n<number> select  p pair  c collect  x clean  d disable  n next  r refresh  q quit\n")
+}
+
+func (t *console) selectPeer(input string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i, err := strconv.Atoi(input)
+	if err != nil || i < 1 || i > len(t.peers) {
+		t.message = fmt.Sprintf("Unknown command %q", input)
+		return
+	}
+	p := t.peers[i-1].AndroidPeer
+	if t.selected != nil && t.selected.NodeID == p.NodeID {
+		return
+	}
+	t.selected = &p
+	t.c = t.cases[p.NodeID]
+	t.serial = ""
+	t.binding = nil
+	t.done = map[string]error{}
+	t.message = ""
+}
+
+// nextStage is the first stage that has not succeeded yet.
+func (t *console) nextStage() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range tuiStages {
+		if err, ok := t.done[s]; !ok || err != nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// run runs a workflow stage on the selected device with the same functions
+// as the corresponding subcommand, then waits for the analyst to read its
+// output.
+func (t *console) run(ctx context.Context, stage string) {
+	t.mu.Lock()
+	switch {
+	case stage == "":
+		t.message = "All steps are done."
+	case t.selected == nil:
+		t.message = "Select a device first."
+	case stage != stagePair && t.serial == "":
+		t.message = "Pair with the device first."
+	default:
+		t.busy = true
+	}
+	busy := t.busy
+	t.mu.Unlock()
+	if !busy {
+		return
+	}
+
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("=== %s %s ===\n\n", stage, t.selected.HostName)
+	var err error
+	switch stage {
+	case stagePair:
+		err = t.pair(ctx)
+	case stageCollect:
+		err = t.collect(ctx)
+	case stageClean:
+		adbcleanArgs.serial = t.serial
+		adbcleanArgs.caseDir = t.c.Dir
+		err = runcleanCmd(ctx, nil)
+	case stageDisable:
+		adbdisableArgs.serial = t.serial
+		adbdisableArgs.caseDir = t.c.Dir
+		err = runadbdisable(ctx, nil)
+	}
+
+	t.mu.Lock()
+	t.done[stage] = err
+	if err != nil {
+		t.message = fmt.Sprintf("%s failed: %v", stage, err)
+	} else {
+		t.message = stage + " completed."
+	}
+	t.mu.Unlock()
+
+	fmt.Println()
+	if err != nil {
+		fmt.Printf("%s failed: %v\n", stage, err)
+	}
+	// The console stays busy until the analyst has read the output, so
+	// that live updates do not redraw over it.
+	ReadString("Press Enter to return to the console...")
+	t.mu.Lock()
+	t.busy = false
+	t.mu.Unlock()
+	t.refresh(ctx)
+}
+
+func (t *console) pair(ctx context.Context) error {
+	if t.c == nil {
+		// The selected or current case is for the first device; any
+		// other device starts a case of its own.
+		var c *Case
+		var err error
+		if len(t.cases) == 0 {
+			c, err = openCase(tuiArgs.caseDir, true)
+		} else {
+			c, err = createCase("", false)
+		}
+		if err != nil {
+			return err
+		}
+		t.c = c
+		t.cases[t.selected.NodeID] = c
+	}
+	peer := t.selected
+	logCase(t.c, "peer_selected", map[string]any{
+		"ip":       peer.IP,
+		"hostname": peer.HostName,
+		"dns_name": peer.DNSName,
+		"node_id":  peer.NodeID,
+		"node_key": peer.NodeKey,
+	})
+	var args PairingArgs
+	if err := pairPeer(ctx, t.c, peer, &args, ""); err != nil {
+		return err
+	}
+	serial, binding, err := connectPeer(ctx, t.c, peer, &args, tuiArgs.acq.allowMismatch)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.serial, t.binding = serial, binding
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *console) collect(ctx context.Context) error {
+	opts, err := tuiArgs.acq.options(t.serial)
+	if err != nil {
+		return err
+	}
+	opts.Case = t.c
+	opts.Binding = t.binding
+	return runAcquisition(ctx, opts)
+}
@@ -4,6 +4,7 @@
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
@@ -13,6 +14,19 @@
 	"github.com/mattn/go-isatty"
 )
 
+// nonInteractive is set by commands that must never prompt the analyst.
+var nonInteractive bool
+
+// ExitError carries the process exit code to use for a failed command.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string { return e.Err.Error() }
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
 func checkADBClient() {
 	if adb.Client == nil {
 		panic("ADB client not initialized")
@@ -22,16 +36,26 @@ func checkADBClient() {
 // ReadString prompts the user for input with the given message and returns the trimmed response.
 // If there is no TTY on both Stdin and Stdout, returns an empty string.
 func ReadString(msg string) string {
-	if !(isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd())) {
+	resp, err := readLine(msg)
+	if err != nil {
 		return ""
 	}
+	return resp
+}
+
+// readLine is ReadString for callers that must tell an empty line from the
+// end of input: it returns io.EOF when stdin is closed or is not a TTY.
+func readLine(msg string) (string, error) {
+	if !(isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd())) {
+		return "", io.EOF
+	}
 	fmt.Print(msg)
 	reader := bufio.NewReader(os.Stdin)
 	resp, err := reader.ReadString('\n')
 	if err != nil {
-		return ""
+		return "", err
 	}
-	return strings.TrimSpace(resp)
+	return strings.TrimSpace(resp), nil
 }
 
 // ValidationFunc is a function that validates input and returns an error if invalid.
@@ -70,6 +94,21 @@ func validatePairingCode(code string) error {
 	return nil
 }
 
+// useADBKeys restarts the adb server with the given private keys as its only
+// extra identities, so that subsequent connections authenticate with the keys
+// used for pairing instead of the shared key in ~/.android. Restarting drops
+// every existing adb connection.
+func useADBKeys(paths ...string) error {
+	if err := os.Setenv("ADB_VENDOR_KEYS", strings.Join(paths, string(os.PathListSeparator))); err != nil {
+		return err
+	}
+	fmt.Printf("Restarting ADB server with session key...\n")
+	// kill-server fails if no server is running, which is fine: the next
+	// adb command starts one with the new environment either way.
+	exec.Command(adb.Client.ExePath, "kill-server").Run()
+	return nil
+}
+
 func disconnect(serial string) error {
 	if serial == "" {
 		fmt.Printf("Disconnecting all devices...\n")
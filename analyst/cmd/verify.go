@@ -0,0 +1,182 @@
+// Copyright (c) BARGHEST
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package cmd
+
+import (
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+var verifyArgs struct {
+	analyst string
+	caseDir string
+}
+
+func VerifyCmd() *ffcli.Command {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.StringVar(&verifyArgs.analyst, "analyst", "", "expected analyst key fingerprint (SHA256:...); default: the local analyst key")
+	fs.StringVar(&verifyArgs.caseDir, "case", "", "case directory whose log must contain the chain head recorded in the manifest (default: the case of that ID under ./cases)")
+
+	return &ffcli.Command{
+		Name:       "verify",
+		ShortUsage: "mesh verify [flags] <acquisition>",
+		ShortHelp:  "Verify an acquisition's signed manifest",
+		LongHelp: `The verify command checks an acquisition folder against the signed manifest (` + manifestFile + `) that adbcollect writes before the acquisition is encrypted: the Ed25519 signature over the manifest, and the size and SHA-256 of every file it lists. Files that are missing, modified or not listed are reported.
+
+The manifest carries the public key it was signed with, so a valid signature alone only shows the manifest is intact. The key is also compared with --analyst, or with the local analyst key when --analyst is not given, to show who signed it.
+
+When the acquisition was made in a case, the manifest also records the case log's chain head at that time. The case log must still contain that entry, which detects a log that was truncated or rewritten after the acquisition.
+
+Encrypted acquisitions must be decrypted first.
+
+Examples:
+  mesh verify ./2c3f5a6e-...
+  mesh verify --analyst SHA256:Xz... ./2c3f5a6e-...
+`,
+		FlagSet: fs,
+		Exec:    runVerify,
+	}
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mesh verify [flags] <acquisition>")
+	}
+	dir := args[0]
+
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return fmt.Errorf("unable to read manifest: %w", err)
+	}
+	sigText, err := os.ReadFile(filepath.Join(dir, manifestSigFile))
+	if err != nil {
+		return fmt.Errorf("unable to read manifest signature: %w", err)
+	}
+	var m acquisitionManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	var problems []string
+	pub, err := base64.StdEncoding.DecodeString(m.Analyst.Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid analyst key in manifest")
+	}
+	fingerprint := keyFingerprint(pub)
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(pub, b, sig) {
+		problems = append(problems, "manifest signature is invalid")
+	}
+
+	expected, err := expectedAnalyst(verifyArgs.analyst)
+	if err != nil {
+		return err
+	}
+	switch {
+	case expected == "":
+		fmt.Printf("warning: no local analyst key and no --analyst given, the signer is not checked\n")
+	case expected != fingerprint:
+		problems = append(problems, fmt.Sprintf("manifest was signed by %s, expected %s", fingerprint, expected))
+	}
+
+	if m.Case != nil {
+		caseDir := cmp.Or(verifyArgs.caseDir, filepath.Join(casesRoot(), filepath.Base(m.Case.ID)))
+		entries, err := readCaseLog(filepath.Join(caseDir, caseLogFile))
+		if err != nil {
+			fmt.Printf("warning: unable to read the log of case %s, its chain head is not checked: %v\n", m.Case.ID, err)
+		} else if p := checkCaseHead(entries, m.Case); p != "" {
+			problems = append(problems, p)
+		}
+	}
+
+	files, err := hashTree(dir)
+	if err != nil {
+		return fmt.Errorf("unable to hash acquisition: %w", err)
+	}
+	present := make(map[string]manifestEntry, len(files))
+	for _, f := range files {
+		present[f.Path] = f
+	}
+	for _, want := range m.Files {
+		got, ok := present[want.Path]
+		switch {
+		case !ok:
+			problems = append(problems, "missing: "+want.Path)
+		case got.Size != want.Size || got.SHA256 != want.SHA256:
+			problems = append(problems, "modified: "+want.Path)
+		}
+		delete(present, want.Path)
+	}
+	for _, f := range files {
+		if _, ok := present[f.Path]; ok {
+			problems = append(problems, "not in manifest: "+f.Path)
+		}
+	}
+
+	fmt.Printf("Acquisition: %s\n", m.Acquisition)
+	fmt.Printf("Created:     %s\n", m.Created.Format("2006-01-02 15:04:05 MST"))
+	fmt.Printf("Analyst:     %s (%s)\n", fingerprint, sanitizeForTerminal(m.Analyst.Host))
+	fmt.Printf("Device:      %s", sanitizeForTerminal(m.Device.Serial))
+	if m.Device.HostName != "" {
+		fmt.Printf(" / %s %s", sanitizeForTerminal(m.Device.HostName), strings.Join(m.Device.TailscaleIPs, ","))
+	}
+	if m.Device.NodeKey != "" {
+		fmt.Printf(" / %s", m.Device.NodeKey)
+	}
+	fmt.Printf("\n")
+	if m.Case != nil {
+		fmt.Printf("Case:        %s (entry %d, %s)\n", sanitizeForTerminal(m.Case.ID), m.Case.Seq, sanitizeForTerminal(m.Case.Head))
+	}
+	fmt.Printf("Files:       %d\n", len(m.Files))
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Printf("  FAIL: %s\n", sanitizeForTerminal(p))
+		}
+		return fmt.Errorf("acquisition verification failed with %d problem(s)", len(problems))
+	}
+	fmt.Println("Acquisition verified: signature valid and all files match the manifest.")
+	return nil
+}
+
+// expectedAnalyst returns the fingerprint a signature is checked against:
+// flagValue if given, else the local analyst key's, or "" if there is
+// neither. Only an existing local key is used; verifying must not create
+// one.
+func expectedAnalyst(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if _, err := os.Stat(analystKeyPath()); err != nil {
+		return "", nil
+	}
+	priv, err := loadAnalystKey()
+	if err != nil {
+		return "", err
+	}
+	return keyFingerprint(priv.Public().(ed25519.PublicKey)), nil
+}
+
+// checkCaseHead reports a problem if the case log entries no longer contain
+// the chain head recorded in a manifest.
+func checkCaseHead(entries []CaseEvent, mc *manifestCase) string {
+	if mc.Seq < len(entries) && entries[mc.Seq].Hash == mc.Head {
+		return ""
+	}
+	if mc.Seq >= len(entries) {
+		return fmt.Sprintf("case log has %d entries but the manifest recorded entry %d, the log was truncated", len(entries), mc.Seq)
+	}
+	return fmt.Sprintf("case log entry %d does not match the chain head recorded in the manifest, the log was rewritten", mc.Seq)
+}
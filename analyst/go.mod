@@ -3,18 +3,19 @@ module github.com/BARGHEST-ngo/MESH/analyst
 go 1.26.3
 
 require (
+	filippo.io/edwards25519 v1.2.0
 	github.com/BARGHEST-ngo/androidqf_mesh v0.3.0
 	github.com/botherder/go-savetime v1.5.0
 	github.com/google/uuid v1.6.0
 	github.com/mattn/go-isatty v0.0.20
 	github.com/peterbourgon/ff/v3 v3.4.0
 	github.com/toqueteos/webbrowser v1.2.1
+	golang.org/x/net v0.53.0
 	tailscale.com v1.94.1
 )
 
 require (
 	filippo.io/age v1.2.1 // indirect
-	filippo.io/edwards25519 v1.2.0 // indirect
 	github.com/akutz/memconn v0.1.0 // indirect
 	github.com/avast/apkparser v0.0.0-20250626104540-d53391f4d69d // indirect
 	github.com/avast/apkverifier v0.0.0-20250626104651-727e33396aec // indirect
@@ -40,7 +41,6 @@ require (
 	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba // indirect
 	golang.org/x/crypto v0.50.0 // indirect
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
-	golang.org/x/net v0.53.0 // indirect
 	golang.org/x/sync v0.20.0 // indirect
 	golang.org/x/sys v0.43.0 // indirect
 	golang.zx2c4.com/wireguard/windows v0.5.3 // indirect
@@ -5,6 +5,7 @@
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -20,6 +21,15 @@
 	"adbdisable": true,
 	"adbclean":   true,
 	"status":     true,
+	"case":       true,
+	"verify":     true,
+	"tui":        true,
+	"diagnose":   true,
+	"capture":    true,
+	"monitor":    true,
+	"dnslog":     true,
+	"ioc":        true,
+	"suricata":   true,
 	"help":       true,
 }
 
@@ -47,6 +57,15 @@ func main() {
 			cmd.AdbdisableCmd(),
 			cmd.AdbcleanCmd(),
 			cmd.StatusCmd(),
+			cmd.CaseCmd(),
+			cmd.VerifyCmd(),
+			cmd.TuiCmd(),
+			cmd.DiagnoseCmd(),
+			cmd.CaptureCmd(),
+			cmd.MonitorCmd(),
+			cmd.DNSLogCmd(),
+			cmd.IOCCmd(),
+			cmd.SuricataCmd(),
 		},
 		FlagSet: flag.NewFlagSet("meshcli", flag.ContinueOnError),
 		Exec: func(ctx context.Context, args []string) error {
@@ -58,6 +77,10 @@ func main() {
 	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
 		if err != flag.ErrHelp {
 			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			var exitErr *cmd.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.Code)
+			}
 			os.Exit(1)
 		}
 	}